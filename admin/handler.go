@@ -0,0 +1,132 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"mailer-ms/mail"
+	"mailer-ms/queue"
+	"mailer-ms/tracer"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	PathPrefix = "/admin/"
+	ReadyPath  = "/ready"
+)
+
+type State struct {
+	Ready        bool     `json:"ready"`
+	Connected    bool     `json:"connected"`
+	Paused       bool     `json:"paused"`
+	PauseReasons []string `json:"pause_reasons"`
+
+	// The provider send quota, only set if the send quota discovery is enabled
+	Quota *mail.QuotaState `json:"quota,omitempty"`
+}
+
+// Consumer is the mail requests consumption the handler reports and pauses
+type Consumer interface {
+	Pause(reason string) error
+	Resume(reason string) error
+	PauseReasons() []string
+	Connected() bool
+}
+
+// QuotaReporter reports the provider send quota, nil if unknown
+type QuotaReporter interface {
+	QuotaState() *mail.QuotaState
+}
+
+// Handler serves the operator endpoints to pause and resume the mail requests consumption,
+// authorized by a bearer token, and the readiness endpoint reporting the consumption state
+type Handler struct {
+	queue Consumer
+	quota QuotaReporter
+	token string
+}
+
+func New(queue Consumer, quota QuotaReporter, token string) *Handler {
+	return &Handler{queue: queue, quota: quota, token: token}
+}
+
+// Enabled returns if the admin endpoints are enabled, which requires a token
+func (h *Handler) Enabled() bool {
+	return h.token != ""
+}
+
+// ServeHTTP handles the admin endpoints, POST /admin/pause and /admin/resume change the consumption
+// state of this replica only, unlike the admin queue requests, and GET /admin/state returns it
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, span := tracer.NewSpan(r.Context(), "admin", "ServeHTTP")
+	defer span.End()
+
+	if !h.authorized(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	action := strings.TrimPrefix(r.URL.Path, PathPrefix)
+	span.SetAttributes(attribute.Key("action").String(action))
+
+	var err error
+
+	switch {
+	case action == "pause" && r.Method == http.MethodPost:
+		err = h.queue.Pause(queue.OperatorPause)
+	case action == "resume" && r.Method == http.MethodPost:
+		err = h.queue.Resume(queue.OperatorPause)
+	case action == "state" && r.Method == http.MethodGet:
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		tracer.AddSpanErrorAndFail(span, err, "failed to "+action+" the mail requests consumption")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeState(w, http.StatusOK)
+}
+
+// Ready reports if the service is connected, responding with 503 while disconnected so the instance is
+// restarted or taken out of rotation, a paused instance is still ready since restarting it does not help
+func (h *Handler) Ready(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+
+	if !h.state().Ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	h.writeState(w, status)
+}
+
+func (h *Handler) state() State {
+	s := State{
+		Connected:    h.queue.Connected(),
+		PauseReasons: h.queue.PauseReasons(),
+		Quota:        h.quota.QuotaState(),
+	}
+
+	s.Paused = len(s.PauseReasons) > 0
+	s.Ready = s.Connected
+
+	return s
+}
+
+func (h *Handler) writeState(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(h.state())
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	return h.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
@@ -0,0 +1,250 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"mailer-ms/mail"
+	"mailer-ms/queue"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// fakeConsumer keeps the pause reasons in memory, failing the pauses and resumes with err
+type fakeConsumer struct {
+	connected bool
+	reasons   map[string]bool
+	err       error
+}
+
+func (f *fakeConsumer) Pause(reason string) error {
+	if f.err != nil {
+		return f.err
+	}
+
+	f.reasons[reason] = true
+	return nil
+}
+
+func (f *fakeConsumer) Resume(reason string) error {
+	if f.err != nil {
+		return f.err
+	}
+
+	delete(f.reasons, reason)
+	return nil
+}
+
+func (f *fakeConsumer) PauseReasons() []string {
+	reasons := []string{}
+
+	for reason := range f.reasons {
+		reasons = append(reasons, reason)
+	}
+
+	sort.Strings(reasons)
+
+	return reasons
+}
+
+func (f *fakeConsumer) Connected() bool {
+	return f.connected
+}
+
+type fakeQuotaReporter struct {
+	state *mail.QuotaState
+}
+
+func (f *fakeQuotaReporter) QuotaState() *mail.QuotaState {
+	return f.state
+}
+
+func TestServeHTTP(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		paused     bool
+		err        error
+		wantStatus int
+		wantState  *State
+	}{
+		{
+			name:       "missing token",
+			method:     http.MethodPost,
+			path:       "/admin/pause",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "invalid token",
+			method:     http.MethodPost,
+			path:       "/admin/pause",
+			token:      "wrong",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "pause",
+			method:     http.MethodPost,
+			path:       "/admin/pause",
+			token:      "secret",
+			wantStatus: http.StatusOK,
+			wantState:  &State{Ready: true, Connected: true, Paused: true, PauseReasons: []string{queue.OperatorPause}},
+		},
+		{
+			name:       "resume",
+			method:     http.MethodPost,
+			path:       "/admin/resume",
+			token:      "secret",
+			paused:     true,
+			wantStatus: http.StatusOK,
+			wantState:  &State{Ready: true, Connected: true, PauseReasons: []string{}},
+		},
+		{
+			name:       "state",
+			method:     http.MethodGet,
+			path:       "/admin/state",
+			token:      "secret",
+			paused:     true,
+			wantStatus: http.StatusOK,
+			wantState:  &State{Ready: true, Connected: true, Paused: true, PauseReasons: []string{queue.OperatorPause}},
+		},
+		{
+			name:       "pause failing",
+			method:     http.MethodPost,
+			path:       "/admin/pause",
+			token:      "secret",
+			err:        errors.New("channel closed"),
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "pause with the wrong method",
+			method:     http.MethodGet,
+			path:       "/admin/pause",
+			token:      "secret",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "unknown action",
+			method:     http.MethodPost,
+			path:       "/admin/restart",
+			token:      "secret",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consumer := &fakeConsumer{connected: true, reasons: map[string]bool{}, err: tt.err}
+
+			if tt.paused {
+				consumer.reasons[queue.OperatorPause] = true
+			}
+
+			h := New(consumer, &fakeQuotaReporter{}, "secret")
+
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+
+			if tt.wantState == nil {
+				return
+			}
+
+			var state State
+			if err := json.NewDecoder(rec.Body).Decode(&state); err != nil {
+				t.Fatalf("failed to decode the state: %v", err)
+			}
+
+			if !reflect.DeepEqual(state, *tt.wantState) {
+				t.Errorf("expected the state %+v, got %+v", *tt.wantState, state)
+			}
+		})
+	}
+}
+
+func TestReady(t *testing.T) {
+	tests := []struct {
+		name       string
+		connected  bool
+		reasons    []string
+		quota      *mail.QuotaState
+		wantStatus int
+		wantState  State
+	}{
+		{
+			name:       "connected",
+			connected:  true,
+			wantStatus: http.StatusOK,
+			wantState:  State{Ready: true, Connected: true, PauseReasons: []string{}},
+		},
+		{
+			name:       "paused is still ready",
+			connected:  true,
+			reasons:    []string{"circuit breaker open", queue.OperatorPause},
+			wantStatus: http.StatusOK,
+			wantState:  State{Ready: true, Connected: true, Paused: true, PauseReasons: []string{"circuit breaker open", queue.OperatorPause}},
+		},
+		{
+			name:       "disconnected",
+			wantStatus: http.StatusServiceUnavailable,
+			wantState:  State{PauseReasons: []string{}},
+		},
+		{
+			name:       "quota is reported",
+			connected:  true,
+			quota:      &mail.QuotaState{Max24HourSend: 1000, SentLast24Hours: 10, MaxSendRate: 14},
+			wantStatus: http.StatusOK,
+			wantState:  State{Ready: true, Connected: true, PauseReasons: []string{}, Quota: &mail.QuotaState{Max24HourSend: 1000, SentLast24Hours: 10, MaxSendRate: 14}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consumer := &fakeConsumer{connected: tt.connected, reasons: map[string]bool{}}
+
+			for _, reason := range tt.reasons {
+				consumer.reasons[reason] = true
+			}
+
+			// the readiness endpoint does not require the admin token
+			h := New(consumer, &fakeQuotaReporter{tt.quota}, "")
+
+			rec := httptest.NewRecorder()
+			h.Ready(rec, httptest.NewRequest(http.MethodGet, ReadyPath, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+
+			var state State
+			if err := json.NewDecoder(rec.Body).Decode(&state); err != nil {
+				t.Fatalf("failed to decode the state: %v", err)
+			}
+
+			if !reflect.DeepEqual(state, tt.wantState) {
+				t.Errorf("expected the state %+v, got %+v", tt.wantState, state)
+			}
+		})
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	if New(&fakeConsumer{}, &fakeQuotaReporter{}, "").Enabled() {
+		t.Error("expected the admin endpoints to be disabled without a token")
+	}
+
+	if !New(&fakeConsumer{}, &fakeQuotaReporter{}, "secret").Enabled() {
+		t.Error("expected the admin endpoints to be enabled with a token")
+	}
+}
@@ -0,0 +1,329 @@
+package archive
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"mailer-ms/config"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	fileSuffix = ".json.gz"
+	tempSuffix = ".tmp"
+	redacted   = "[REDACTED]"
+)
+
+var (
+	// Matches the email addresses within header values, eg: <mailto:unsubscribe@rastercar.com>
+	emailRegex = regexp.MustCompile(`[^\s<>:,;"']+@[^\s<>,;"'?]+`)
+
+	// Matches the query and fragment of the urls within header values, which usually carry
+	// tokens identifying the recipient, eg: <https://rastercar.com/unsubscribe?token=abc>
+	urlQueryRegex = regexp.MustCompile(`((?:https?://|mailto:)[^\s<>?#,]*)[?#][^\s<>,]*`)
+)
+
+var ErrNotFound = errors.New("archived message not found")
+
+type Entry struct {
+	Uuid       string    `json:"uuid"`
+	ArchivedAt time.Time `json:"archived_at"`
+
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	Cc       []string `json:"cc"`
+	Bcc      []string `json:"bcc"`
+	ReplyTo  []string `json:"reply_to"`
+	Subject  string   `json:"subject"`
+	BodyHtml string   `json:"body_html"`
+	BodyText string   `json:"body_text"`
+
+	// The custom headers of the message
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// The name or arn of the SES template the message was rendered with, if any
+	Template string `json:"template,omitempty"`
+
+	// The name of the mail provider that sent the email, empty if not sent
+	Provider string `json:"provider,omitempty"`
+
+	// The id the mail provider assigned to the email, empty if not sent
+	ProviderId string `json:"provider_id,omitempty"`
+
+	Success bool `json:"success"`
+
+	// The failure description if the email was not sent
+	Error string `json:"error,omitempty"`
+}
+
+// Archive stores the final version of the sent messages as gzip compressed
+// json files named by the message uuid, within the configured directory
+type Archive struct {
+	cfg      config.ArchiveConfig
+	patterns []*regexp.Regexp
+}
+
+func New(cfg config.ArchiveConfig) (*Archive, error) {
+	patterns := make([]*regexp.Regexp, len(cfg.RedactPatterns))
+
+	for i, p := range cfg.RedactPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %q: %w", p, err)
+		}
+
+		patterns[i] = re
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &Archive{cfg: cfg, patterns: patterns}, nil
+}
+
+// Store redacts and persists a entry, replacing any previous entry with the same uuid, the entry is
+// written to a temporary file renamed once complete, so a crash never leaves a corrupted entry behind
+func (a *Archive) Store(e Entry) error {
+	e.ArchivedAt = time.Now()
+	a.redact(&e)
+
+	f, err := os.CreateTemp(a.cfg.Dir, filepath.Base(e.Uuid)+"-*"+tempSuffix)
+	if err != nil {
+		return err
+	}
+
+	if err := writeEntry(f, e); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Rename(f.Name(), a.path(e.Uuid)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
+
+func writeEntry(f *os.File, e Entry) error {
+	zw := gzip.NewWriter(f)
+
+	if err := json.NewEncoder(zw).Encode(e); err != nil {
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// Get returns the archived entry with the given uuid or ErrNotFound
+func (a *Archive) Get(uuid string) (*Entry, error) {
+	f, err := os.Open(a.path(uuid))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	entry := &Entry{}
+
+	return entry, json.NewDecoder(zr).Decode(entry)
+}
+
+// List returns the uuids of the archived entries, ordered from the oldest to the newest
+func (a *Archive) List() ([]string, error) {
+	files, err := os.ReadDir(a.cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type archived struct {
+		uuid    string
+		modTime time.Time
+	}
+
+	entries := make([]archived, 0, len(files))
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), fileSuffix) {
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+
+		entries = append(entries, archived{strings.TrimSuffix(f.Name(), fileSuffix), info.ModTime()})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+
+	uuids := make([]string, len(entries))
+	for i, e := range entries {
+		uuids[i] = e.uuid
+	}
+
+	return uuids, nil
+}
+
+// Purge removes the entries older than the configured retention, returning
+// how many were removed, entries are kept forever if the retention is zero
+func (a *Archive) Purge() (int, error) {
+	if a.cfg.RetentionDays <= 0 {
+		return 0, nil
+	}
+
+	files, err := os.ReadDir(a.cfg.Dir)
+	if err != nil {
+		return 0, err
+	}
+
+	limit := time.Now().AddDate(0, 0, -a.cfg.RetentionDays)
+	removed := 0
+
+	for _, f := range files {
+		// temporary files left behind by a crash while storing a entry expire as well
+		if f.IsDir() || !(strings.HasSuffix(f.Name(), fileSuffix) || strings.HasSuffix(f.Name(), tempSuffix)) {
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil || info.ModTime().After(limit) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(a.cfg.Dir, f.Name())); err != nil {
+			return removed, err
+		}
+
+		removed++
+	}
+
+	return removed, nil
+}
+
+// StartPurging removes the expired entries every hour until the stop channel is closed
+func (a *Archive) StartPurging(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Hour)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			if removed, err := a.Purge(); err != nil {
+				log.Printf("[ARCHIVE] failed to purge expired messages: %v", err)
+			} else if removed > 0 {
+				log.Printf("[ARCHIVE] purged %d expired messages", removed)
+			}
+
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (a *Archive) path(uuid string) string {
+	// the uuid is validated before archiving, but since it comes from
+	// the cli it should never be allowed to escape the archive dir
+	return filepath.Join(a.cfg.Dir, filepath.Base(uuid)+fileSuffix)
+}
+
+func (a *Archive) redact(e *Entry) {
+	// the headers map is shared with the caller, so it is copied before being redacted
+	headers := make(map[string]string, len(e.Headers))
+	for name, value := range e.Headers {
+		headers[name] = value
+	}
+
+	if len(headers) > 0 {
+		e.Headers = headers
+	}
+
+	if a.cfg.RedactRecipients {
+		e.To = redactAddresses(e.To)
+		e.Cc = redactAddresses(e.Cc)
+		e.Bcc = redactAddresses(e.Bcc)
+		e.ReplyTo = redactAddresses(e.ReplyTo)
+
+		for name, value := range e.Headers {
+			value = emailRegex.ReplaceAllStringFunc(value, redactEmail)
+			e.Headers[name] = urlQueryRegex.ReplaceAllString(value, "${1}?"+redacted)
+		}
+	}
+
+	if a.cfg.RedactBodies {
+		e.BodyHtml = redacted
+		e.BodyText = redacted
+	}
+
+	for _, re := range a.patterns {
+		e.Subject = re.ReplaceAllString(e.Subject, redacted)
+		e.BodyHtml = re.ReplaceAllString(e.BodyHtml, redacted)
+		e.BodyText = re.ReplaceAllString(e.BodyText, redacted)
+
+		for name, value := range e.Headers {
+			e.Headers[name] = re.ReplaceAllString(value, redacted)
+		}
+	}
+}
+
+// redactAddresses removes the display names and masks the local part of email addresses
+// keeping its first character and the domain, eg: "Bruce" <bruce@gmail.com> -> b***@gmail.com
+func redactAddresses(addresses []string) []string {
+	masked := make([]string, len(addresses))
+
+	for i, address := range addresses {
+		parsed, err := mail.ParseAddress(address)
+		if err != nil {
+			masked[i] = redacted
+			continue
+		}
+
+		masked[i] = redactEmail(parsed.Address)
+	}
+
+	return masked
+}
+
+// redactEmail masks the local part of a email address, keeping its first character and the domain
+func redactEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+
+	if at < 1 {
+		return redacted
+	}
+
+	return email[:1] + "***" + email[at:]
+}
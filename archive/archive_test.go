@@ -0,0 +1,163 @@
+package archive
+
+import (
+	"errors"
+	"mailer-ms/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestArchive(t *testing.T, cfg config.ArchiveConfig) *Archive {
+	t.Helper()
+
+	cfg.Dir = t.TempDir()
+
+	a, err := New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create archive: %v", err)
+	}
+
+	return a
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   config.ArchiveConfig
+		entry Entry
+		want  Entry
+	}{
+		{
+			name:  "nothing redacted",
+			entry: Entry{To: []string{"bruce@wayne.com"}, Subject: "hi", Headers: map[string]string{"X-Campaign": "news"}},
+			want:  Entry{To: []string{"bruce@wayne.com"}, Subject: "hi", Headers: map[string]string{"X-Campaign": "news"}},
+		},
+		{
+			name: "recipients",
+			cfg:  config.ArchiveConfig{RedactRecipients: true},
+			entry: Entry{
+				To:      []string{`"Bruce Wayne" <bruce@wayne.com>`, "invalid"},
+				Bcc:     []string{"alfred@wayne.com"},
+				Headers: map[string]string{"X-Customer": "lucius@wayne.com"},
+			},
+			want: Entry{
+				To:      []string{"b***@wayne.com", redacted},
+				Bcc:     []string{"a***@wayne.com"},
+				Headers: map[string]string{"X-Customer": "l***@wayne.com"},
+			},
+		},
+		{
+			name: "unsubscribe header addresses and tokens",
+			cfg:  config.ArchiveConfig{RedactRecipients: true},
+			entry: Entry{Headers: map[string]string{
+				"List-Unsubscribe": "<https://rastercar.com/unsubscribe?token=abc&user=bruce>, <mailto:unsubscribe@rastercar.com?subject=bruce>",
+			}},
+			want: Entry{Headers: map[string]string{
+				"List-Unsubscribe": "<https://rastercar.com/unsubscribe?[REDACTED]>, <mailto:u***@rastercar.com?[REDACTED]>",
+			}},
+		},
+		{
+			name:  "bodies",
+			cfg:   config.ArchiveConfig{RedactBodies: true},
+			entry: Entry{BodyHtml: "<p>secret</p>", BodyText: "secret"},
+			want:  Entry{BodyHtml: redacted, BodyText: redacted},
+		},
+		{
+			name: "patterns on the subject, bodies and headers",
+			cfg:  config.ArchiveConfig{RedactPatterns: []string{`\d{3}\.\d{3}\.\d{3}-\d{2}`}},
+			entry: Entry{
+				Subject:  "invoice of 123.456.789-00",
+				BodyText: "document: 123.456.789-00",
+				Headers:  map[string]string{"X-Document": "123.456.789-00"},
+			},
+			want: Entry{
+				Subject:  "invoice of " + redacted,
+				BodyText: "document: " + redacted,
+				Headers:  map[string]string{"X-Document": redacted},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestArchive(t, tt.cfg)
+			a.redact(&tt.entry)
+
+			if strings.Join(tt.entry.To, ",") != strings.Join(tt.want.To, ",") || strings.Join(tt.entry.Bcc, ",") != strings.Join(tt.want.Bcc, ",") {
+				t.Errorf("expected recipients %v %v, got %v %v", tt.want.To, tt.want.Bcc, tt.entry.To, tt.entry.Bcc)
+			}
+
+			if tt.entry.Subject != tt.want.Subject || tt.entry.BodyHtml != tt.want.BodyHtml || tt.entry.BodyText != tt.want.BodyText {
+				t.Errorf("expected content %q %q %q, got %q %q %q", tt.want.Subject, tt.want.BodyHtml, tt.want.BodyText, tt.entry.Subject, tt.entry.BodyHtml, tt.entry.BodyText)
+			}
+
+			for name, want := range tt.want.Headers {
+				if got := tt.entry.Headers[name]; got != want {
+					t.Errorf("expected header %s to be %q, got %q", name, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreAndGet(t *testing.T) {
+	a := newTestArchive(t, config.ArchiveConfig{})
+
+	entry := Entry{Uuid: "2221e2de-7385-433a-ac63-21ce013a6436", Subject: "hi", Provider: "ses", ProviderId: "id", Success: true}
+
+	if err := a.Store(entry); err != nil {
+		t.Fatalf("failed to store entry: %v", err)
+	}
+
+	entry.Subject = "replaced"
+
+	if err := a.Store(entry); err != nil {
+		t.Fatalf("failed to replace entry: %v", err)
+	}
+
+	got, err := a.Get(entry.Uuid)
+	if err != nil {
+		t.Fatalf("failed to get entry: %v", err)
+	}
+
+	if got.Subject != "replaced" || got.ProviderId != "id" {
+		t.Fatalf("expected the replaced entry, got %+v", got)
+	}
+
+	files, _ := os.ReadDir(a.cfg.Dir)
+	if len(files) != 1 {
+		t.Fatalf("expected only the entry file on the archive dir, got %d files", len(files))
+	}
+
+	if _, err := a.Get("unknown"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	a := newTestArchive(t, config.ArchiveConfig{RetentionDays: 1})
+
+	a.Store(Entry{Uuid: "old"})
+	a.Store(Entry{Uuid: "new"})
+
+	// a temporary file left behind by a crash while storing a entry
+	tmp := filepath.Join(a.cfg.Dir, "crashed-123"+tempSuffix)
+	os.WriteFile(tmp, []byte("partial"), 0600)
+
+	old := time.Now().AddDate(0, 0, -2)
+	os.Chtimes(a.path("old"), old, old)
+	os.Chtimes(tmp, old, old)
+
+	removed, err := a.Purge()
+	if err != nil || removed != 2 {
+		t.Fatalf("expected 2 files purged, got %d: %v", removed, err)
+	}
+
+	uuids, _ := a.List()
+	if len(uuids) != 1 || uuids[0] != "new" {
+		t.Fatalf("expected only the new entry to be kept, got %v", uuids)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mailer-ms/archive"
+	"mailer-ms/config"
+	"os"
+)
+
+const archiveUsage = `usage:
+  archive list          lists the uuids of the archived messages, from the oldest to the newest
+  archive get <uuid>    prints the archived message with the given uuid`
+
+// runArchiveCmd executes the archive subcommand, used to query the archived
+// messages on support investigations, eg:
+//
+//	mailer_ms --config-file="./config/config.yml" archive get 2221e2de-7385-433a-ac63-21ce013a6436
+func runArchiveCmd(cfg config.ArchiveConfig, args []string) error {
+	a, err := archive.New(cfg)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 1 && args[0] == "list" {
+		uuids, err := a.List()
+		if err != nil {
+			return err
+		}
+
+		for _, uuid := range uuids {
+			fmt.Println(uuid)
+		}
+
+		return nil
+	}
+
+	if len(args) == 2 && args[0] == "get" {
+		entry, err := a.Get(args[1])
+		if err != nil {
+			return err
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(entry)
+	}
+
+	return errors.New(archiveUsage)
+}
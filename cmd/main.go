@@ -2,14 +2,22 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log"
+	"mailer-ms/admin"
+	"mailer-ms/archive"
 	"mailer-ms/config"
 	"mailer-ms/mail"
 	"mailer-ms/queue"
+	"mailer-ms/status"
 	"mailer-ms/tracer"
+	"mailer-ms/tracking"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 // The version/build, this gets replaced at build time to the commit SHA
@@ -27,6 +35,21 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	flag.Parse()
+
+	if flag.Arg(0) == "archive" {
+		archiveCfg, err := config.ParseArchive()
+		if err != nil {
+			log.Fatalf("[CONFIG] failed to parse archive config: %v", err)
+		}
+
+		if err := runArchiveCmd(*archiveCfg, flag.Args()[1:]); err != nil {
+			log.Fatalf("[ARCHIVE] %v", err)
+		}
+
+		return
+	}
+
 	cfg, err := config.Parse()
 	if err != nil {
 		log.Fatalf("[CONFIG] failed to parse config: %v", err)
@@ -38,16 +61,116 @@ func main() {
 	}
 	defer tracer.Stop(ctx)
 
-	queue := queue.New(cfg.Rmq)
-	mailer := mail.New(cfg, &queue)
+	statusRetention := time.Duration(cfg.Mail.StatusRetentionDays) * 24 * time.Hour
+
+	statusStore, err := status.NewStore(cfg.Mail.StatusStore, cfg.Mail.StatusStorePath, cfg.Mail.StatusStoreRedisUrl, statusRetention)
+	if err != nil {
+		log.Fatalf("[STATUS] failed to open mail status store: %v", err)
+	}
+	defer statusStore.Close()
+
+	stopStatusPurging := make(chan struct{})
+	defer close(stopStatusPurging)
+
+	status.StartPurging(statusStore, statusRetention, stopStatusPurging)
+
+	var mailArchive *archive.Archive
+
+	if cfg.Archive.Enabled {
+		mailArchive, err = archive.New(cfg.Archive)
+		if err != nil {
+			log.Fatalf("[ARCHIVE] failed to open mail archive: %v", err)
+		}
+
+		stopPurging := make(chan struct{})
+		defer close(stopPurging)
+
+		mailArchive.StartPurging(stopPurging)
+	}
+
+	queue, err := queue.New(cfg.Rmq)
+	if err != nil {
+		log.Fatalf("[ RMQ ] failed to create queue server: %v", err)
+	}
+
+	tracker, err := tracking.New(cfg.Tracking, &queue)
+	if err != nil {
+		log.Fatalf("[TRACKING] failed to create tracker: %v", err)
+	}
+
+	mailer, err := mail.New(cfg, &queue, statusStore, mailArchive, tracker)
+	if err != nil {
+		log.Fatalf("[ MAIL ] failed to create mailer: %v", err)
+	}
+
+	if eventsQueue := tracker.EventsQueue(); eventsQueue != "" {
+		queue.Queues = append(queue.Queues, eventsQueue)
+	}
 
 	queue.ConsumerFn = mailer.HandleMailRequestDelivery
+	queue.AdminConsumerFn = mailer.HandleAdminRequestDelivery
+
+	mailer.StartQuotaDiscovery(ctx)
 
 	queue.Start()
 	defer queue.Stop()
 
+	adminHandler := admin.New(&queue, &mailer, cfg.Http.AdminToken)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(admin.ReadyPath, adminHandler.Ready)
+
+	if tracker.Enabled() {
+		mux.Handle(tracking.PathPrefix, tracker)
+	}
+
+	if adminHandler.Enabled() {
+		mux.Handle(admin.PathPrefix, adminHandler)
+	}
+
+	httpServer := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Http.Port), Handler: mux}
+
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("[ HTTP ] failed to serve: %v", err)
+		}
+	}()
+	defer httpServer.Shutdown(ctx)
+
+	go togglePauseOnSignal(&queue)
+
 	exit := make(chan os.Signal, 1)
 	signal.Notify(exit, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
 	<-exit
 }
+
+// togglePauseOnSignal pauses the mail requests consumption on SIGUSR1, resuming it on the next one
+func togglePauseOnSignal(q *queue.Server) {
+	toggle := make(chan os.Signal, 1)
+	signal.Notify(toggle, syscall.SIGUSR1)
+
+	for range toggle {
+		var err error
+
+		if isPausedByOperator(q) {
+			err = q.Resume(queue.OperatorPause)
+		} else {
+			err = q.Pause(queue.OperatorPause)
+		}
+
+		if err != nil {
+			log.Printf("[ RMQ ] failed to toggle the mail requests consumption: %v", err)
+		}
+	}
+}
+
+func isPausedByOperator(q *queue.Server) bool {
+	for _, reason := range q.PauseReasons() {
+		if reason == queue.OperatorPause {
+			return true
+		}
+	}
+
+	return false
+}
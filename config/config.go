@@ -3,7 +3,10 @@ package config
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
@@ -16,9 +19,51 @@ type AppConfig struct {
 
 type MailConfig struct {
 	Sender           string `env-required:"true" yaml:"sender" env:"MAIL_SENDER"`
+	SenderName       string `yaml:"sender_name" env:"MAIL_SENDER_NAME"`
 	RetryWaitTime    int    `env-required:"true" yaml:"retry_wait_time" env:"MAIL_RETRY_WAIT_TIME"`
-	ReqPerSecLimit   int    `env-required:"true" yaml:"req_per_sec_limit" env:"MAIL_REQ_PER_SEC_LIMIT"`
+	ReqPerSecLimit   int    `yaml:"req_per_sec_limit" env:"MAIL_REQ_PER_SEC_LIMIT"`
 	MaxRetryAttempts int    `env-required:"true" yaml:"max_retry_attempts" env:"MAIL_MAX_RETRY_ATTEMPTS"`
+
+	// Where the mail request statuses are stored: bolt, a local file only usable by a single
+	// replica, or redis, shared by every replica so any of them can answer the admin requests
+	StatusStore         string `env-default:"bolt" yaml:"status_store" env:"MAIL_STATUS_STORE"`
+	StatusStorePath     string `env-default:"./mail_status.db" yaml:"status_store_path" env:"MAIL_STATUS_STORE_PATH"`
+	StatusStoreRedisUrl string `yaml:"status_store_redis_url" env:"MAIL_STATUS_STORE_REDIS_URL"`
+
+	// Days the statuses are kept after their last update, 0 keeps them forever
+	StatusRetentionDays int `yaml:"status_retention_days" env:"MAIL_STATUS_RETENTION_DAYS"`
+
+	// The SES api version to send the emails with, v1 or v2
+	SesApi string `env-default:"v1" yaml:"ses_api" env:"MAIL_SES_API"`
+
+	// The default SES configuration set, mail requests can override it
+	ConfigurationSet string `yaml:"configuration_set" env:"MAIL_CONFIGURATION_SET"`
+
+	// If a plain text version of the email should be generated from its html when
+	// the request has no text body, otherwise the email is sent without a text part
+	GenerateText bool `yaml:"generate_text" env:"MAIL_GENERATE_TEXT"`
+
+	// Verified identities (addresses or domains) mail requests can use as sender,
+	// besides the default sender
+	AllowedSenders []string `yaml:"allowed_senders" env:"MAIL_ALLOWED_SENDERS" env-separator:","`
+
+	// Interval in seconds to fetch the SES send quota, adjusting the send rate to its
+	// max send rate, 0 disables it and only the req per sec limit is used
+	QuotaRefreshInterval int `yaml:"quota_refresh_interval" env:"MAIL_QUOTA_REFRESH_INTERVAL"`
+
+	// Fraction of the daily send quota, in (0, 1], that once sent pauses the sending until the quota frees up
+	QuotaPauseThreshold float64 `env-default:"0.95" yaml:"quota_pause_threshold" env:"MAIL_QUOTA_PAUSE_THRESHOLD"`
+
+	// Consecutive provider failures that open the circuit breaker, pausing the mail requests
+	// consumption until the cooldown (in seconds) expires and a trial send succeeds
+	BreakerFailures int `env-default:"10" yaml:"breaker_failures" env:"MAIL_BREAKER_FAILURES"`
+	BreakerCooldown int `env-default:"60" yaml:"breaker_cooldown" env:"MAIL_BREAKER_COOLDOWN"`
+
+	// When the provider throttles the send rate is multiplied by the backoff factor, down to the min
+	// rate, and restored by the recovery step every second with successful sends
+	ThrottleBackoffFactor float64 `yaml:"throttle_backoff_factor" env:"MAIL_THROTTLE_BACKOFF_FACTOR"`
+	ThrottleRecoveryStep  float64 `yaml:"throttle_recovery_step" env:"MAIL_THROTTLE_RECOVERY_STEP"`
+	ThrottleMinRate       float64 `yaml:"throttle_min_rate" env:"MAIL_THROTTLE_MIN_RATE"`
 }
 
 type TracerConfig struct {
@@ -29,7 +74,297 @@ type TracerConfig struct {
 type RmqConfig struct {
 	Url               string `env-required:"true" yaml:"url" env:"RMQ_URL"`
 	Queue             string `env-required:"true" yaml:"queue" env:"RMQ_QUEUE"`
+	AdminQueue        string `env-default:"mail_sender_admin" yaml:"admin_queue" env:"RMQ_ADMIN_QUEUE"`
 	ReconnectWaitTime int    `env-required:"true" yaml:"reconnect_wait_time" env:"RMQ_RECONNECT_WAIT_TIME"`
+
+	// Fanout exchange the pause and resume admin requests are broadcasted on, so every replica
+	// applies them, each replica consumes it with a exclusive queue of its own
+	AdminExchange string `env-default:"mail_sender_admin_broadcast" yaml:"admin_exchange" env:"RMQ_ADMIN_EXCHANGE"`
+
+	// Seconds to wait for the broker to confirm a published message
+	PublishTimeout int `env-default:"5" yaml:"publish_timeout" env:"RMQ_PUBLISH_TIMEOUT"`
+
+	// Channels used to publish messages in parallel
+	PublishChannels int `env-default:"4" yaml:"publish_channels" env:"RMQ_PUBLISH_CHANNELS"`
+
+	// Name the connection is shown with on the management ui
+	ConnectionName string `yaml:"connection_name" env:"RMQ_CONNECTION_NAME"`
+
+	// Heartbeat interval in seconds, 0 uses the server interval
+	Heartbeat int `yaml:"heartbeat" env:"RMQ_HEARTBEAT"`
+
+	// Overrides the vhost of the url
+	Vhost string `yaml:"vhost" env:"RMQ_VHOST"`
+
+	// PEM encoded CA bundle to verify the server certificate, client certificate and key
+	// and the expected server name, setting any of them requires a amqps:// url
+	TlsCaFile     string `yaml:"tls_ca_file" env:"RMQ_TLS_CA_FILE"`
+	TlsCertFile   string `yaml:"tls_cert_file" env:"RMQ_TLS_CERT_FILE"`
+	TlsKeyFile    string `yaml:"tls_key_file" env:"RMQ_TLS_KEY_FILE"`
+	TlsServerName string `yaml:"tls_server_name" env:"RMQ_TLS_SERVER_NAME"`
+
+	// Authenticate with the EXTERNAL mechanism (the client certificate) instead of the url credentials
+	ExternalAuth bool `yaml:"external_auth" env:"RMQ_EXTERNAL_AUTH"`
+
+	// The reconnect wait time doubles on every failed attempt, up to this max (in seconds)
+	ReconnectMaxWaitTime int `env-default:"60" yaml:"reconnect_max_wait_time" env:"RMQ_RECONNECT_MAX_WAIT_TIME"`
+
+	// Prefix of the queues where mail requests over their tenant or domain limits wait, a queue is declared per
+	// delay tier (in seconds) with the tier as its message ttl, once it expires the requests are dead lettered
+	// back to the mail requests queue. delays are rounded up to a tier, eg: mail_requests_delayed.30s
+	DelayQueue string `env-default:"mail_requests_delayed" yaml:"delay_queue" env:"RMQ_DELAY_QUEUE"`
+	DelayTiers []int  `env-default:"1,5,30,60,300" yaml:"delay_tiers" env:"RMQ_DELAY_TIERS" env-separator:","`
+
+	// Type of the mail requests queue: classic, quorum or stream
+	QueueType string `env-default:"classic" yaml:"queue_type" env:"RMQ_QUEUE_TYPE"`
+
+	// Deliveries of a message to a quorum queue before it is dropped or dead lettered, 0 is unlimited
+	DeliveryLimit int `yaml:"delivery_limit" env:"RMQ_DELIVERY_LIMIT"`
+
+	// Unacknowledged deliveries of the mail requests queue at once, also bounds the deliveries that are
+	// requeued when the consumption is paused, since they were already consumed, eg: 2x the send rate
+	Prefetch int `env-default:"20" yaml:"prefetch" env:"RMQ_PREFETCH"`
+
+	// Where a stream is consumed from when no offset was processed: first (the default), last, next,
+	// a offset or a RFC3339 timestamp
+	StreamOffset string `yaml:"stream_offset" env:"RMQ_STREAM_OFFSET"`
+
+	// Mail requests whose processing failed (panicked or was redelivered) more than the threshold are moved to the parking
+	// queue instead of being processed again, 0 disables the poison message detection, ignored on streams
+	PoisonThreshold int    `yaml:"poison_threshold" env:"RMQ_POISON_THRESHOLD"`
+	ParkingQueue    string `yaml:"parking_queue" env:"RMQ_PARKING_QUEUE"`
+
+	// Exchanges, queues and bindings declared on every connection, before the service queues
+	Topology TopologyConfig `yaml:"topology"`
+}
+
+// ExchangeConfig is a exchange of the rmq topology
+type ExchangeConfig struct {
+	Name string `yaml:"name"`
+
+	// direct, fanout, topic or headers, defaults to direct
+	Type string `yaml:"type"`
+
+	Durable    bool                   `yaml:"durable"`
+	AutoDelete bool                   `yaml:"auto_delete"`
+	Internal   bool                   `yaml:"internal"`
+	Args       map[string]interface{} `yaml:"args"`
+}
+
+// QueueConfig is a queue of the rmq topology, its args set options such as
+// x-queue-type, x-message-ttl, x-max-length and x-dead-letter-exchange
+type QueueConfig struct {
+	Name       string                 `yaml:"name"`
+	Durable    bool                   `yaml:"durable"`
+	AutoDelete bool                   `yaml:"auto_delete"`
+	Exclusive  bool                   `yaml:"exclusive"`
+	Args       map[string]interface{} `yaml:"args"`
+}
+
+// BindingConfig binds a queue to a exchange of the rmq topology
+type BindingConfig struct {
+	Exchange   string                 `yaml:"exchange"`
+	Queue      string                 `yaml:"queue"`
+	RoutingKey string                 `yaml:"routing_key"`
+	Args       map[string]interface{} `yaml:"args"`
+}
+
+type TopologyConfig struct {
+	Exchanges []ExchangeConfig `yaml:"exchanges"`
+
+	// The mail requests, admin and delay queues are only declared by the service if they
+	// are not listed here, so their options and args can be overridden per environment
+	Queues []QueueConfig `yaml:"queues"`
+
+	Bindings []BindingConfig `yaml:"bindings"`
+}
+
+type ContentConfig struct {
+	// Moves the css rules of <style> elements to the style attribute of the
+	// elements they match, since most email clients strip <style> elements
+	InlineCss bool `yaml:"inline_css" env:"CONTENT_INLINE_CSS"`
+
+	// Keeps only the allowed formatting elements and attributes, removing scripts, forms, embedded
+	// content and the urls with schemes other than http, https, mailto, tel and cid
+	Sanitize bool `yaml:"sanitize" env:"CONTENT_SANITIZE"`
+
+	// If set relative urls are resolved against it, eg: https://rastercar.com
+	BaseUrl string `yaml:"base_url" env:"CONTENT_BASE_URL"`
+}
+
+type HttpConfig struct {
+	Port int `env-default:"8080" yaml:"port" env:"HTTP_PORT"`
+
+	// Bearer token of the admin endpoints, the endpoints are disabled if empty
+	AdminToken string `yaml:"admin_token" env:"HTTP_ADMIN_TOKEN"`
+}
+
+type TrackingConfig struct {
+	// The public url the tracking handler is served on, eg: https://t.rastercar.com
+	// tracking is disabled if not set
+	BaseUrl string `yaml:"base_url" env:"TRACKING_BASE_URL"`
+
+	// Secret used to sign the tracking tokens
+	Secret string `yaml:"secret" env:"TRACKING_SECRET"`
+
+	// Where the open and click events are published to
+	EventsExchange   string `yaml:"events_exchange" env:"TRACKING_EVENTS_EXCHANGE"`
+	EventsRoutingKey string `env-default:"mail_tracking_events" yaml:"events_routing_key" env:"TRACKING_EVENTS_ROUTING_KEY"`
+}
+
+type DkimKey struct {
+	Domain   string `yaml:"domain"`
+	Selector string `yaml:"selector"`
+	// Path to the PEM encoded RSA or Ed25519 private key
+	KeyFile string `yaml:"key_file"`
+}
+
+// DkimKeys implements cleanenv.Setter so keys can be set with a env var
+// in the format: `domain:selector:key_file,domain:selector:key_file`
+type DkimKeys []DkimKey
+
+func (k *DkimKeys) SetValue(s string) error {
+	*k = nil
+
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+
+		if len(parts) != 3 {
+			return fmt.Errorf("invalid dkim key %q, expected domain:selector:key_file", entry)
+		}
+
+		*k = append(*k, DkimKey{Domain: parts[0], Selector: parts[1], KeyFile: parts[2]})
+	}
+
+	return nil
+}
+
+type DkimConfig struct {
+	// Keys to sign the emails with, selected by the sender domain
+	Keys DkimKeys `yaml:"keys" env:"DKIM_KEYS"`
+
+	// relaxed or simple, only validated if there are keys
+	HeaderCanonicalization string `env-default:"relaxed" yaml:"header_canonicalization" env:"DKIM_HEADER_CANONICALIZATION"`
+	BodyCanonicalization   string `env-default:"relaxed" yaml:"body_canonicalization" env:"DKIM_BODY_CANONICALIZATION"`
+
+	SignedHeaders []string `env-default:"From,To,Cc,Reply-To,Subject,Date,MIME-Version,Content-Type" yaml:"signed_headers" env:"DKIM_SIGNED_HEADERS" env-separator:","`
+}
+
+type ArchiveConfig struct {
+	Enabled          bool     `yaml:"enabled" env:"ARCHIVE_ENABLED"`
+	Dir              string   `env-default:"./mail_archive" yaml:"dir" env:"ARCHIVE_DIR"`
+	RetentionDays    int      `yaml:"retention_days" env:"ARCHIVE_RETENTION_DAYS"`
+	RedactRecipients bool     `yaml:"redact_recipients" env:"ARCHIVE_REDACT_RECIPIENTS"`
+	RedactBodies     bool     `yaml:"redact_bodies" env:"ARCHIVE_REDACT_BODIES"`
+	RedactPatterns   []string `yaml:"redact_patterns" env:"ARCHIVE_REDACT_PATTERNS" env-separator:";"`
+}
+
+type BucketLimit struct {
+	// Sends per second, 0 means unlimited
+	Rate float64 `yaml:"rate" env:"RATE"`
+
+	// Sends allowed at once, defaults to 1
+	Burst int `yaml:"burst" env:"BURST"`
+}
+
+// BucketLimits implements cleanenv.Setter so limits can be set with a env var
+// in the format: `key:rate:burst,key:rate:burst`
+type BucketLimits map[string]BucketLimit
+
+func (l *BucketLimits) SetValue(s string) error {
+	*l = make(BucketLimits)
+
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+
+		if len(parts) != 3 {
+			return fmt.Errorf("invalid limit %q, expected key:rate:burst", entry)
+		}
+
+		rate, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return fmt.Errorf("invalid limit %q rate: %w", entry, err)
+		}
+
+		burst, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return fmt.Errorf("invalid limit %q burst: %w", entry, err)
+		}
+
+		(*l)[parts[0]] = BucketLimit{Rate: rate, Burst: burst}
+	}
+
+	return nil
+}
+
+// LimitsConfig configures the token buckets of each tenant and recipient domain, mail
+// requests over the limit of their tenant or any of their recipient domains are delayed
+type LimitsConfig struct {
+	// Limit of the tenants without a specific limit
+	Tenant BucketLimit `yaml:"tenant" env-prefix:"LIMITS_TENANT_"`
+
+	// Limits by tenant id
+	Tenants BucketLimits `yaml:"tenants" env:"LIMITS_TENANTS"`
+
+	// Limit of the recipient domains without a specific limit
+	Domain BucketLimit `yaml:"domain" env-prefix:"LIMITS_DOMAIN_"`
+
+	// Limits by recipient domain, eg: gmail.com
+	Domains BucketLimits `yaml:"domains" env:"LIMITS_DOMAINS"`
+}
+
+type ProviderConfig struct {
+	// Unique name of the provider, recorded on the status and reply of the emails it sends
+	Name string `yaml:"name"`
+
+	// ses, sesv2 or smtp
+	Type string `yaml:"type"`
+
+	// Share of the emails routed to the provider, relative to the weight of the other candidates
+	Weight int `yaml:"weight"`
+
+	// AWS region of the ses and sesv2 providers, defaults to AWS_REGION
+	Region string `yaml:"region"`
+
+	// SMTP relay address and credentials, the password is read from the env var named by PasswordEnv
+	Host        string `yaml:"host"`
+	Port        int    `yaml:"port"`
+	Username    string `yaml:"username"`
+	PasswordEnv string `yaml:"password_env"`
+
+	// Connect to the SMTP relay with implicit TLS (usually port 465), otherwise STARTTLS is used when supported
+	Tls bool `yaml:"tls"`
+}
+
+// RoutingRule restricts the emails matching every non empty condition to the listed providers
+type RoutingRule struct {
+	SenderDomain string   `yaml:"sender_domain"`
+	Category     string   `yaml:"category"`
+	Providers    []string `yaml:"providers"`
+}
+
+type RoutingConfig struct {
+	// Providers to route the emails to, if empty the emails are sent with MAIL_SES_API on AWS_REGION
+	Providers []ProviderConfig `yaml:"providers"`
+
+	// Rules are checked in order, emails not matching any rule can be sent by every provider
+	Rules []RoutingRule `yaml:"rules"`
+
+	// Consecutive failures that open the circuit breaker of a provider, skipping it
+	// until the cooldown (in seconds) expires and a trial send succeeds, only used with providers
+	BreakerFailures int `env-default:"5" yaml:"breaker_failures" env:"ROUTING_BREAKER_FAILURES"`
+	BreakerCooldown int `env-default:"30" yaml:"breaker_cooldown" env:"ROUTING_BREAKER_COOLDOWN"`
+}
+
+type RateLimitConfig struct {
+	// local limits the send rate per replica, redis shares the send rate budget between every replica
+	Backend string `env-default:"local" yaml:"backend" env:"RATE_LIMIT_BACKEND"`
+
+	// redis://[:password@]host:port[/db]
+	RedisUrl string `yaml:"redis_url" env:"RATE_LIMIT_REDIS_URL"`
+
+	// Prefix of the redis keys counting the sends of each second
+	RedisKey string `env-default:"mail_sender:rate" yaml:"redis_key" env:"RATE_LIMIT_REDIS_KEY"`
 }
 
 type AwsConfig struct {
@@ -40,11 +375,19 @@ type AwsConfig struct {
 }
 
 type Config struct {
-	App    AppConfig    `yaml:"app"`
-	Rmq    RmqConfig    `yaml:"rmq"`
-	Aws    AwsConfig    `yaml:"aws"`
-	Mail   MailConfig   `yaml:"mail"`
-	Tracer TracerConfig `yaml:"tracer"`
+	App       AppConfig       `yaml:"app"`
+	Rmq       RmqConfig       `yaml:"rmq"`
+	Aws       AwsConfig       `yaml:"aws"`
+	Mail      MailConfig      `yaml:"mail"`
+	Tracer    TracerConfig    `yaml:"tracer"`
+	Archive   ArchiveConfig   `yaml:"archive"`
+	Dkim      DkimConfig      `yaml:"dkim"`
+	Content   ContentConfig   `yaml:"content"`
+	Http      HttpConfig      `yaml:"http"`
+	Tracking  TrackingConfig  `yaml:"tracking"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	Limits    LimitsConfig    `yaml:"limits"`
+	Routing   RoutingConfig   `yaml:"routing"`
 }
 
 func setAwsEnvVars(awsCfg AwsConfig) {
@@ -58,8 +401,9 @@ func setAwsEnvVars(awsCfg AwsConfig) {
 	os.Setenv("AWS_SECRET_ACCESS_KEY", awsCfg.SecretAccessKey)
 }
 
+var cfgFilePath = flag.String("config-file", "/etc/config.yml", "A filepath to the yml file containing the microservice configuration")
+
 func Parse() (*Config, error) {
-	var cfgFilePath = flag.String("config-file", "/etc/config.yml", "A filepath to the yml file containing the microservice configuration")
 	flag.Parse()
 
 	cfg := &Config{}
@@ -79,3 +423,19 @@ func Parse() (*Config, error) {
 
 	return cfg, nil
 }
+
+// ParseArchive reads only the archive config, so the archive subcommand can
+// be used without setting the variables required by the service
+func ParseArchive() (*ArchiveConfig, error) {
+	flag.Parse()
+
+	cfg := &struct {
+		Archive ArchiveConfig `yaml:"archive"`
+	}{}
+
+	if err := cleanenv.ReadConfig(*cfgFilePath, cfg); err != nil {
+		return nil, err
+	}
+
+	return &cfg.Archive, nil
+}
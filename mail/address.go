@@ -0,0 +1,82 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+func (a *Address) UnmarshalJSON(data []byte) error {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("\"")) {
+		// the alias prevents the object decoding from calling this method again
+		type address Address
+		return json.Unmarshal(data, (*address)(a))
+	}
+
+	var raw string
+
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	parsed, err := mail.ParseAddress(raw)
+	if err != nil {
+		return fmt.Errorf("invalid email address %q: %w", raw, err)
+	}
+
+	a.Name = parsed.Name
+	a.Email = parsed.Address
+
+	return nil
+}
+
+// format returns the address as a RFC 5322 address with its domain converted to
+// punycode and its display name encoded as a RFC 2047 encoded-word when needed
+func (a Address) format() (string, error) {
+	email, err := toASCIIEmail(a.Email)
+	if err != nil {
+		return "", err
+	}
+
+	if a.Name == "" {
+		return email, nil
+	}
+
+	return (&mail.Address{Name: a.Name, Address: email}).String(), nil
+}
+
+func formatAddresses(addresses []Address) ([]string, error) {
+	formatted := make([]string, len(addresses))
+
+	for i, a := range addresses {
+		f, err := a.format()
+		if err != nil {
+			return nil, err
+		}
+
+		formatted[i] = f
+	}
+
+	return formatted, nil
+}
+
+// toASCIIEmail converts the domain of a email address to punycode, as
+// internationalized domain names are not supported by SMTP, eg:
+// bruce@wäyne.com -> bruce@xn--wyne-loa.com
+func toASCIIEmail(email string) (string, error) {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return "", fmt.Errorf("invalid email address %q", email)
+	}
+
+	domain, err := idna.Lookup.ToASCII(email[at+1:])
+	if err != nil {
+		return "", fmt.Errorf("invalid email domain %q: %w", email[at+1:], err)
+	}
+
+	return email[:at+1] + domain, nil
+}
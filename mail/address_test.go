@@ -0,0 +1,91 @@
+package mail
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAddressUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		want    Address
+		wantErr bool
+	}{
+		{name: "plain address", json: `"bruce@wayne.com"`, want: Address{Email: "bruce@wayne.com"}},
+		{name: "address with display name", json: `"\"Bruce Wayne\" <bruce@wayne.com>"`, want: Address{Name: "Bruce Wayne", Email: "bruce@wayne.com"}},
+		{name: "unquoted display name", json: `"Alfred <alfred@wayne.com>"`, want: Address{Name: "Alfred", Email: "alfred@wayne.com"}},
+		{name: "encoded display name", json: `"=?utf-8?q?Jos=C3=A9?= <jose@wayne.com>"`, want: Address{Name: "José", Email: "jose@wayne.com"}},
+		{name: "object", json: `{"name": "Lucius Fox", "email": "lucius@wayne.com"}`, want: Address{Name: "Lucius Fox", Email: "lucius@wayne.com"}},
+		{name: "invalid address", json: `"bruce"`, wantErr: true},
+		{name: "not a string nor object", json: `42`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Address
+
+			err := json.Unmarshal([]byte(tt.json), &got)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			if got != tt.want {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAddressFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		address Address
+		want    string
+		wantErr bool
+	}{
+		{name: "without display name", address: Address{Email: "bruce@wayne.com"}, want: "bruce@wayne.com"},
+		{name: "ascii display name", address: Address{Name: "Bruce Wayne", Email: "bruce@wayne.com"}, want: `"Bruce Wayne" <bruce@wayne.com>`},
+		{name: "non ascii display name", address: Address{Name: "José", Email: "jose@wayne.com"}, want: "=?utf-8?q?Jos=C3=A9?= <jose@wayne.com>"},
+		{name: "idn domain", address: Address{Email: "bruce@wäyne.com"}, want: "bruce@xn--wyne-loa.com"},
+		{name: "missing at sign", address: Address{Email: "bruce"}, wantErr: true},
+		{name: "invalid domain", address: Address{Email: "bruce@-"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.address.format()
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			if got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSendEmailDtoAcceptsMixedAddressLists(t *testing.T) {
+	body := `{"to": ["bruce@wayne.com", "\"Alfred\" <alfred@wayne.com>", {"name": "Lucius", "email": "lucius@wayne.com"}]}`
+
+	var dto SendEmailDto
+
+	if err := json.Unmarshal([]byte(body), &dto); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+
+	want := []Address{{Email: "bruce@wayne.com"}, {Name: "Alfred", Email: "alfred@wayne.com"}, {Name: "Lucius", Email: "lucius@wayne.com"}}
+
+	if len(dto.To) != len(want) {
+		t.Fatalf("expected %d addresses, got %+v", len(want), dto.To)
+	}
+
+	for i := range want {
+		if dto.To[i] != want[i] {
+			t.Errorf("expected address %d to be %+v, got %+v", i, want[i], dto.To[i])
+		}
+	}
+}
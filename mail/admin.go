@@ -0,0 +1,109 @@
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mailer-ms/status"
+	"mailer-ms/tracer"
+
+	"github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+func (m *Mailer) HandleAdminRequestDelivery(d *amqp091.Delivery) {
+	ctx, span := tracer.NewSpan(context.TODO(), "mail", "HandleAdminRequest")
+	defer span.End()
+
+	// admin requests are not retried, their failure is only informed on the response
+	d.Ack(false)
+
+	var req AdminReq
+
+	if err := json.Unmarshal(d.Body, &req); err != nil {
+		tracer.AddSpanErrorAndFail(span, err, "failed to unmarshal admin request")
+		m.replyAdminRequest(ctx, d, nil, err)
+		return
+	}
+
+	if err := m.validate.Struct(req); err != nil {
+		tracer.AddSpanErrorAndFail(span, err, "invalid admin request")
+		m.replyAdminRequest(ctx, d, nil, fmt.Errorf("validation error: %w", err))
+		return
+	}
+
+	span.SetAttributes(attribute.Key("action").String(req.Action))
+	span.SetAttributes(attribute.Key("uuid").String(req.Uuid))
+
+	var record *status.Record
+	var err error
+
+	switch req.Action {
+	case "pause", "resume":
+		// every replica consumes the admin queue, so the request is broadcasted to the other replicas
+		if req.Action == "pause" {
+			err = m.queue.PauseAll(ctx)
+		} else {
+			err = m.queue.ResumeAll(ctx)
+		}
+
+		if err != nil {
+			tracer.AddSpanErrorAndFail(span, err, fmt.Sprintf("admin %s request failed", req.Action))
+		}
+
+		m.replyAdminPause(ctx, d, err)
+		return
+
+	case "status":
+		record, err = m.status.Get(req.Uuid)
+	case "cancel":
+		record, err = status.Cancel(m.status, req.Uuid)
+
+		if err == status.ErrNotCancellable {
+			record, _ = m.status.Get(req.Uuid)
+		}
+	}
+
+	if err != nil {
+		tracer.AddSpanErrorAndFail(span, err, fmt.Sprintf("admin %s request failed", req.Action))
+	}
+
+	m.replyAdminRequest(ctx, d, record, err)
+}
+
+// replyAdminPause replies a pause or resume request with the current pause state
+func (m *Mailer) replyAdminPause(ctx context.Context, d *amqp091.Delivery, failure error) {
+	paused := m.queue.Paused()
+
+	res := AdminRes{Success: failure == nil, Message: "admin request executed successfully", Paused: &paused, PauseReasons: m.queue.PauseReasons()}
+	resType := "success"
+
+	if failure != nil {
+		res.Message = failure.Error()
+		resType = "error"
+	}
+
+	body, _ := json.Marshal(res)
+
+	m.reply(ctx, d, resType, body)
+}
+
+func (m *Mailer) replyAdminRequest(ctx context.Context, d *amqp091.Delivery, record *status.Record, failure error) {
+	span := tracer.SpanFromContext(ctx)
+
+	var resType string
+	var body []byte
+
+	if failure == nil {
+		resType = "success"
+		body, _ = json.Marshal(AdminRes{Success: true, Message: "admin request executed successfully", Status: record})
+
+		span.SetStatus(codes.Ok, "admin request executed successfully")
+	} else {
+		resType = "error"
+		body, _ = json.Marshal(AdminRes{Success: false, Message: failure.Error(), Status: record})
+	}
+
+	m.reply(ctx, d, resType, body)
+}
@@ -0,0 +1,130 @@
+package mail
+
+import (
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+
+	return "closed"
+}
+
+// breaker is a circuit breaker that opens after a number of consecutive failures, once the
+// cooldown expires it half opens, allowing a single trial call that closes it on success
+// or opens it again on failure
+type breaker struct {
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	threshold int
+	cooldown  time.Duration
+	openedAt  time.Time
+
+	// if the trial call of the half open breaker is in progress
+	trial bool
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow returns if a call can be made, half opening the breaker if its cooldown expired
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+
+		b.state = breakerHalfOpen
+		b.trial = true
+
+		return true
+
+	case breakerHalfOpen:
+		if b.trial {
+			return false
+		}
+
+		b.trial = true
+
+		return true
+	}
+
+	return true
+}
+
+// success records a successful call, closing the breaker, returns true if it was not closed
+func (b *breaker) success() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	closed := b.state != breakerClosed
+
+	b.state = breakerClosed
+	b.failures = 0
+	b.trial = false
+
+	return closed
+}
+
+// failure records a failed call, opening the breaker if the threshold is reached or if it
+// was the trial call of the half open breaker, returns true if the breaker was opened
+func (b *breaker) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+
+	if b.state == breakerOpen {
+		return false
+	}
+
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+
+		return true
+	}
+
+	return false
+}
+
+// release ends a call without recording its result, if it was the trial call of the half open
+// breaker another trial call is allowed
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+}
+
+func (b *breaker) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
@@ -0,0 +1,110 @@
+package mail
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	type call struct {
+		// success, failure, release or allow
+		op string
+
+		// result of the call, if it opened or closed the breaker or was allowed
+		want bool
+	}
+
+	tests := []struct {
+		name      string
+		threshold int
+		cooldown  time.Duration
+		calls     []call
+		wantState breakerState
+	}{
+		{
+			name:      "closed breaker allows calls",
+			threshold: 3,
+			cooldown:  time.Hour,
+			calls:     []call{{"allow", true}, {"failure", false}, {"failure", false}, {"allow", true}},
+			wantState: breakerClosed,
+		},
+		{
+			name:      "opens on the consecutive failures threshold",
+			threshold: 2,
+			cooldown:  time.Hour,
+			calls:     []call{{"failure", false}, {"failure", true}, {"allow", false}},
+			wantState: breakerOpen,
+		},
+		{
+			name:      "success resets the consecutive failures",
+			threshold: 2,
+			cooldown:  time.Hour,
+			calls:     []call{{"failure", false}, {"success", false}, {"failure", false}, {"allow", true}},
+			wantState: breakerClosed,
+		},
+		{
+			name:      "half opens once the cooldown expires allowing a single trial call",
+			threshold: 1,
+			cooldown:  0,
+			calls:     []call{{"failure", true}, {"allow", true}, {"allow", false}},
+			wantState: breakerHalfOpen,
+		},
+		{
+			name:      "successful trial call closes the breaker",
+			threshold: 1,
+			cooldown:  0,
+			calls:     []call{{"failure", true}, {"allow", true}, {"success", true}, {"allow", true}},
+			wantState: breakerClosed,
+		},
+		{
+			name:      "failed trial call opens the breaker again",
+			threshold: 3,
+			cooldown:  0,
+			calls:     []call{{"failure", false}, {"failure", false}, {"failure", true}, {"allow", true}, {"failure", true}},
+			wantState: breakerOpen,
+		},
+		{
+			name:      "released trial call allows another trial",
+			threshold: 1,
+			cooldown:  0,
+			calls:     []call{{"failure", true}, {"allow", true}, {"release", false}, {"allow", true}},
+			wantState: breakerHalfOpen,
+		},
+		{
+			name:      "threshold is at least one",
+			threshold: 0,
+			cooldown:  time.Hour,
+			calls:     []call{{"failure", true}},
+			wantState: breakerOpen,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBreaker(tt.threshold, tt.cooldown)
+
+			for i, c := range tt.calls {
+				var got bool
+
+				switch c.op {
+				case "allow":
+					got = b.allow()
+				case "success":
+					got = b.success()
+				case "failure":
+					got = b.failure()
+				case "release":
+					b.release()
+				}
+
+				if got != c.want {
+					t.Fatalf("call %d: %s() = %v, want %v", i, c.op, got, c.want)
+				}
+			}
+
+			if state := b.currentState(); state != tt.wantState {
+				t.Errorf("state = %s, want %s", state, tt.wantState)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"log"
+	"mailer-ms/tracer"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Pause reason of the mail requests consumption while the circuit breaker is open
+const breakerPause = "circuit breaker open"
+
+// errBreakerOpen is returned for the mail requests consumed while the circuit breaker is open
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// send sends the message through the circuit breaker of the sender, while the breaker is open the mail
+// requests consumption is paused and the sends fail with errBreakerOpen, so the requests are requeued
+func (m *Mailer) send(ctx context.Context, msg *Message) (*Receipt, error) {
+	span := tracer.SpanFromContext(ctx)
+
+	if !m.breaker.allow() {
+		tracer.AddSpanEvent(span, "circuit breaker open", nil)
+		return nil, errBreakerOpen
+	}
+
+	receipt, err := m.sender.Send(ctx, msg)
+
+	switch {
+	// throttling is handled by the adaptive rate limiter and says nothing about the provider health,
+	// so it neither opens nor closes the breaker
+	case err != nil && isThrottlingError(err):
+		m.breaker.release()
+
+	case err != nil && isProviderFailure(err):
+		if m.breaker.failure() {
+			log.Printf("[ MAIL ] circuit breaker open, pausing for %s: %v", m.breaker.cooldown, err)
+			m.pauseForBreaker()
+		}
+
+	default:
+		if m.breaker.success() {
+			log.Printf("[ MAIL ] circuit breaker closed, provider recovered")
+			m.resumeForBreaker()
+		}
+	}
+
+	span.SetAttributes(attribute.Key("breaker_state").String(m.breaker.currentState().String()))
+
+	return receipt, err
+}
+
+// pauseForBreaker pauses the mail requests consumption while the breaker is open, once
+// its cooldown expires the consumption is resumed so a request can be sent as a trial
+func (m *Mailer) pauseForBreaker() {
+	if err := m.queue.Pause(breakerPause); err != nil {
+		log.Printf("[ MAIL ] failed to pause mail requests consumption: %v", err)
+	}
+
+	time.AfterFunc(m.breaker.cooldown, m.resumeForBreaker)
+}
+
+func (m *Mailer) resumeForBreaker() {
+	if err := m.queue.Resume(breakerPause); err != nil {
+		log.Printf("[ MAIL ] failed to resume mail requests consumption: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"mailer-ms/queue"
+	"net/textproto"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestSendUpdatesBreaker(t *testing.T) {
+	throttled := &smithy.GenericAPIError{Code: "Throttling", Fault: smithy.FaultClient}
+	outage := &smithy.GenericAPIError{Code: "ServiceUnavailable", Fault: smithy.FaultServer}
+
+	tests := []struct {
+		name string
+
+		// opens the breaker and expires its cooldown before the send, so the send is its trial call
+		halfOpen bool
+
+		err         error
+		wantState   breakerState
+		wantReasons []string
+	}{
+		{
+			name:        "success keeps the breaker closed",
+			wantState:   breakerClosed,
+			wantReasons: []string{},
+		},
+		{
+			name:        "provider failure opens the breaker and pauses the consumption",
+			err:         outage,
+			wantState:   breakerOpen,
+			wantReasons: []string{breakerPause},
+		},
+		{
+			name:        "message errors do not open the breaker",
+			err:         &textproto.Error{Code: 554, Msg: "message rejected"},
+			wantState:   breakerClosed,
+			wantReasons: []string{},
+		},
+		{
+			name:        "throttling does not open the breaker",
+			err:         throttled,
+			wantState:   breakerClosed,
+			wantReasons: []string{},
+		},
+		{
+			name:        "successful trial closes the breaker",
+			halfOpen:    true,
+			wantState:   breakerClosed,
+			wantReasons: []string{},
+		},
+		{
+			name:        "throttled trial does not close the breaker",
+			halfOpen:    true,
+			err:         throttled,
+			wantState:   breakerHalfOpen,
+			wantReasons: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cooldown := time.Hour
+			if tt.halfOpen {
+				cooldown = 0
+			}
+
+			m := &Mailer{
+				sender:  &fakeSender{name: "ses", err: tt.err},
+				queue:   &queue.Server{},
+				breaker: newBreaker(1, cooldown),
+			}
+
+			if tt.halfOpen {
+				m.breaker.failure()
+			}
+
+			if _, err := m.send(context.Background(), &Message{}); !errors.Is(err, tt.err) {
+				t.Fatalf("expected the send error %v, got %v", tt.err, err)
+			}
+
+			if state := m.breaker.currentState(); state != tt.wantState {
+				t.Errorf("expected the breaker to be %s, got %s", tt.wantState, state)
+			}
+
+			if reasons := m.queue.PauseReasons(); !reflect.DeepEqual(reasons, tt.wantReasons) {
+				t.Errorf("expected the pause reasons %v, got %v", tt.wantReasons, reasons)
+			}
+
+			// a call whose result was not recorded must not keep the breaker waiting for it
+			if tt.wantState == breakerHalfOpen && !m.breaker.allow() {
+				t.Error("expected another trial call to be allowed")
+			}
+		})
+	}
+}
+
+func TestSendWithRetryRequeuesWhilePaused(t *testing.T) {
+	sender := &fakeSender{name: "ses"}
+
+	m := newQuotaMailer(0.95)
+	m.sender = sender
+	m.breaker = newBreaker(1, time.Hour)
+
+	m.queue.Pause(queue.OperatorPause)
+
+	_, _, err := m.sendWithRetry(context.Background(), 1, &Message{Uuid: "uuid", To: []string{"bruce@wayne.com"}})
+
+	if !errors.Is(err, errPaused) {
+		t.Fatalf("expected errPaused, got %v", err)
+	}
+
+	if sender.calls != 0 {
+		t.Fatalf("expected the message to not be sent while paused, got %d sends", sender.calls)
+	}
+}
+
+func TestSendWithRetryRequeuesWhileBreakerOpen(t *testing.T) {
+	sender := &fakeSender{name: "ses"}
+
+	m := newQuotaMailer(0.95)
+	m.sender = sender
+	m.breaker = newBreaker(1, time.Hour)
+	m.status = newTestStatusStore(t)
+
+	// opened without pausing, as for the requests prefetched before the consumption was paused
+	m.breaker.failure()
+
+	_, _, err := m.sendWithRetry(context.Background(), 1, &Message{Uuid: "uuid", To: []string{"bruce@wayne.com"}})
+
+	if !errors.Is(err, errBreakerOpen) {
+		t.Fatalf("expected errBreakerOpen, got %v", err)
+	}
+
+	if sender.calls != 0 {
+		t.Fatalf("expected the message to not be sent while the breaker is open, got %d sends", sender.calls)
+	}
+}
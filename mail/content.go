@@ -0,0 +1,338 @@
+package mail
+
+import (
+	"fmt"
+	"mailer-ms/config"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/aymerick/douceur/inliner"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var cssCommentRegex = regexp.MustCompile(`(?s)/\*.*?\*/`)
+
+// Elements kept by the sanitizer, elements not listed are removed but their content is kept
+var allowedElements = map[atom.Atom]bool{
+	atom.Html: true, atom.Head: true, atom.Body: true, atom.Title: true, atom.Style: true,
+	atom.A: true, atom.Abbr: true, atom.Address: true, atom.Article: true, atom.Aside: true,
+	atom.B: true, atom.Big: true, atom.Blockquote: true, atom.Br: true, atom.Caption: true,
+	atom.Center: true, atom.Cite: true, atom.Code: true, atom.Col: true, atom.Colgroup: true,
+	atom.Dd: true, atom.Del: true, atom.Details: true, atom.Dfn: true, atom.Div: true,
+	atom.Dl: true, atom.Dt: true, atom.Em: true, atom.Figcaption: true, atom.Figure: true,
+	atom.Font: true, atom.Footer: true, atom.H1: true, atom.H2: true, atom.H3: true,
+	atom.H4: true, atom.H5: true, atom.H6: true, atom.Header: true, atom.Hr: true,
+	atom.I: true, atom.Img: true, atom.Ins: true, atom.Kbd: true, atom.Li: true,
+	atom.Main: true, atom.Mark: true, atom.Nav: true, atom.Ol: true, atom.P: true,
+	atom.Picture: true, atom.Pre: true, atom.Q: true, atom.S: true, atom.Samp: true,
+	atom.Section: true, atom.Small: true, atom.Source: true, atom.Span: true, atom.Strike: true,
+	atom.Strong: true, atom.Sub: true, atom.Summary: true, atom.Sup: true, atom.Table: true,
+	atom.Tbody: true, atom.Td: true, atom.Tfoot: true, atom.Th: true, atom.Thead: true,
+	atom.Time: true, atom.Tr: true, atom.Tt: true, atom.U: true, atom.Ul: true,
+	atom.Var: true, atom.Wbr: true,
+}
+
+// Elements removed with their content by the sanitizer
+var removedElements = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Noscript: true,
+	atom.Template: true,
+	atom.Iframe:   true,
+	atom.Frame:    true,
+	atom.Frameset: true,
+	atom.Object:   true,
+	atom.Embed:    true,
+	atom.Applet:   true,
+	atom.Svg:      true,
+	atom.Math:     true,
+	atom.Select:   true,
+	atom.Textarea: true,
+}
+
+// Attributes kept by the sanitizer on the allowed elements
+var allowedAttributes = map[string]bool{
+	"align": true, "alt": true, "bgcolor": true, "border": true, "cellpadding": true,
+	"cellspacing": true, "class": true, "color": true, "colspan": true, "datetime": true,
+	"dir": true, "face": true, "height": true, "id": true, "lang": true, "media": true,
+	"name": true, "nowrap": true, "rel": true, "role": true, "rowspan": true, "scope": true,
+	"size": true, "sizes": true, "span": true, "start": true, "style": true, "summary": true,
+	"target": true, "title": true, "type": true, "valign": true, "value": true, "width": true,
+	"href": true, "src": true, "srcset": true, "background": true, "cite": true,
+}
+
+// Attributes containing urls, checked by the sanitizer and rewritten against the base url
+var urlAttributes = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"background": true,
+	"cite":       true,
+	"action":     true,
+	"formaction": true,
+	"poster":     true,
+	"xlink:href": true,
+}
+
+// Url schemes kept by the sanitizer, urls without a scheme are relative and kept as well
+var allowedSchemes = map[string]bool{
+	"http":   true,
+	"https":  true,
+	"mailto": true,
+	"tel":    true,
+	"cid":    true,
+}
+
+// contentStage transforms the html content of a email
+type contentStage func(doc string) (string, error)
+
+// contentPipeline is the sequence of stages applied to the html content of every
+// email before sending it, each stage can be toggled on the content config
+type contentPipeline []contentStage
+
+func newContentPipeline(cfg config.ContentConfig) (contentPipeline, error) {
+	var pipeline contentPipeline
+
+	if cfg.InlineCss {
+		pipeline = append(pipeline, inliner.Inline)
+	}
+
+	if cfg.Sanitize {
+		pipeline = append(pipeline, transformHtml(sanitizeNode))
+	}
+
+	if cfg.BaseUrl != "" {
+		base, err := url.Parse(cfg.BaseUrl)
+		if err != nil || !base.IsAbs() {
+			return nil, fmt.Errorf("invalid content base url: %q", cfg.BaseUrl)
+		}
+
+		pipeline = append(pipeline, transformHtml(func(n *html.Node) { rewriteRelativeUrls(n, base) }))
+	}
+
+	return pipeline, nil
+}
+
+func (p contentPipeline) process(doc string) (string, error) {
+	var err error
+
+	for _, stage := range p {
+		if doc, err = stage(doc); err != nil {
+			return "", err
+		}
+	}
+
+	return doc, nil
+}
+
+// transformHtml creates a stage that parses the html document, applies fn to its root node and renders it
+func transformHtml(fn func(root *html.Node)) contentStage {
+	return func(doc string) (string, error) {
+		root, err := html.Parse(strings.NewReader(doc))
+		if err != nil {
+			return "", err
+		}
+
+		fn(root)
+
+		var rendered strings.Builder
+
+		if err := html.Render(&rendered, root); err != nil {
+			return "", err
+		}
+
+		return rendered.String(), nil
+	}
+}
+
+// sanitizeNode keeps only the allowed elements and attributes of the node and its descendants,
+// removing the urls with schemes that are not allowed and styles that could execute code
+func sanitizeNode(n *html.Node) {
+	for child := n.FirstChild; child != nil; {
+		next := child.NextSibling
+
+		if child.Type == html.CommentNode || (child.Type == html.ElementNode && removedElements[child.DataAtom]) {
+			n.RemoveChild(child)
+			child = next
+			continue
+		}
+
+		sanitizeNode(child)
+
+		if child.Type == html.ElementNode && !allowedElements[child.DataAtom] {
+			unwrap(child)
+		}
+
+		child = next
+	}
+
+	if n.Type != html.ElementNode {
+		return
+	}
+
+	if n.DataAtom == atom.Style && isDangerousStyle(textContent(n)) {
+		n.Parent.RemoveChild(n)
+		return
+	}
+
+	attrs := n.Attr[:0]
+
+	for _, a := range n.Attr {
+		key := strings.ToLower(a.Key)
+
+		if a.Namespace != "" || !allowedAttributes[key] {
+			continue
+		}
+
+		if urlAttributes[key] && !isSafeUrl(a.Val, n.DataAtom == atom.Img && key == "src") {
+			continue
+		}
+
+		if key == "srcset" && !isSafeSrcset(a.Val) {
+			continue
+		}
+
+		if key == "style" && isDangerousStyle(a.Val) {
+			continue
+		}
+
+		attrs = append(attrs, a)
+	}
+
+	n.Attr = attrs
+}
+
+// unwrap replaces the node with its children
+func unwrap(n *html.Node) {
+	for child := n.FirstChild; child != nil; {
+		next := child.NextSibling
+
+		n.RemoveChild(child)
+		n.Parent.InsertBefore(child, n)
+
+		child = next
+	}
+
+	n.Parent.RemoveChild(n)
+}
+
+func textContent(n *html.Node) string {
+	var text strings.Builder
+
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.TextNode {
+			text.WriteString(child.Data)
+		}
+	}
+
+	return text.String()
+}
+
+// isSafeUrl checks if the url is relative or has a allowed scheme, data
+// urls are only allowed for images if allowDataImage is set
+func isSafeUrl(u string, allowDataImage bool) bool {
+	// browsers ignore whitespace and control characters within the scheme
+	u = strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, u)
+
+	colon := strings.IndexByte(u, ':')
+
+	// a colon after a path, query or fragment is not a scheme separator
+	if colon == -1 || strings.ContainsAny(u[:colon], "/?#") {
+		return true
+	}
+
+	scheme := strings.ToLower(u[:colon])
+
+	if scheme == "data" {
+		return allowDataImage && strings.HasPrefix(strings.ToLower(u), "data:image/")
+	}
+
+	return allowedSchemes[scheme]
+}
+
+// isSafeSrcset checks the url of every image candidate of a srcset attribute, eg: `a.png 1x, b.png 2x`
+func isSafeSrcset(srcset string) bool {
+	for _, candidate := range strings.Split(srcset, ",") {
+		fields := strings.Fields(candidate)
+
+		if len(fields) > 0 && !isSafeUrl(fields[0], false) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isDangerousStyle checks if the css could execute code or load external stylesheets, the comments
+// are removed before checking and escapes are not allowed, since both could hide dangerous constructs
+func isDangerousStyle(style string) bool {
+	style = strings.ToLower(cssCommentRegex.ReplaceAllString(style, ""))
+
+	for _, s := range []string{"expression(", "javascript:", "vbscript:", "behavior:", "-moz-binding", "@import", "\\", "/*"} {
+		if strings.Contains(style, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rewriteRelativeUrls resolves the relative urls of the node and its descendants against the base url
+func rewriteRelativeUrls(n *html.Node, base *url.URL) {
+	if n.Type == html.ElementNode {
+		for i, a := range n.Attr {
+			key := strings.ToLower(a.Key)
+
+			switch {
+			case key == "srcset":
+				n.Attr[i].Val = resolveSrcset(a.Val, base)
+			case urlAttributes[key]:
+				n.Attr[i].Val = resolveUrl(a.Val, base)
+			}
+		}
+	}
+
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		rewriteRelativeUrls(child, base)
+	}
+}
+
+// resolveUrl resolves the url against the base url if it is relative, fragments and
+// absolute or invalid urls are returned unchanged
+func resolveUrl(val string, base *url.URL) string {
+	trimmed := strings.TrimSpace(val)
+
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return val
+	}
+
+	u, err := url.Parse(trimmed)
+	if err != nil || u.IsAbs() {
+		return val
+	}
+
+	return base.ResolveReference(u).String()
+}
+
+// resolveSrcset resolves the url of every image candidate of a srcset attribute, keeping their descriptors
+func resolveSrcset(srcset string, base *url.URL) string {
+	candidates := strings.Split(srcset, ",")
+
+	for i, candidate := range candidates {
+		fields := strings.Fields(candidate)
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		fields[0] = resolveUrl(fields[0], base)
+		candidates[i] = strings.Join(fields, " ")
+	}
+
+	return strings.Join(candidates, ", ")
+}
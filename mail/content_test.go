@@ -0,0 +1,163 @@
+package mail
+
+import (
+	"mailer-ms/config"
+	"strings"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name    string
+		html    string
+		want    string
+		wantNot []string
+	}{
+		{
+			name:    "scripts and embedded content are removed with their content",
+			html:    `<p>Hi</p><script>alert(1)</script><iframe src="https://evil.com"></iframe><object data="x.swf">fallback</object><svg><script>alert(1)</script></svg>`,
+			want:    "<p>Hi</p>",
+			wantNot: []string{"alert", "evil.com", "fallback", "<svg"},
+		},
+		{
+			name:    "meta refresh, links and base are removed",
+			html:    `<head><meta http-equiv="refresh" content="0;url=https://evil.com"><link rel="stylesheet" href="https://evil.com/a.css"><base href="https://evil.com/"></head><p>Hi</p>`,
+			want:    "<p>Hi</p>",
+			wantNot: []string{"<meta", "<link", "<base", "evil.com"},
+		},
+		{
+			name:    "forms are unwrapped and their controls removed",
+			html:    `<form action="https://evil.com/login"><p>Password</p><input name="password"><button formaction="javascript:alert(1)">Send</button></form>`,
+			want:    "<p>Password</p>Send",
+			wantNot: []string{"<form", "<input", "<button", "action"},
+		},
+		{
+			name:    "event handlers and unknown attributes are removed",
+			html:    `<p onclick="alert(1)" data-x="1" style="color: red">Hi</p>`,
+			want:    `<p style="color: red">Hi</p>`,
+			wantNot: []string{"onclick", "data-x"},
+		},
+		{
+			name:    "links with scripts schemes are removed",
+			html:    `<a href=" java&#x09;script:alert(1)">a</a><a href="vbscript:msgbox">b</a><a href="data:text/html,x">c</a>`,
+			want:    `<a>a</a><a>b</a><a>c</a>`,
+			wantNot: []string{"script:", "data:"},
+		},
+		{
+			name: "allowed urls are kept",
+			html: `<a href="https://rastercar.com/a?b=c:d">a</a><a href="mailto:bruce@wayne.com">b</a><a href="/relative:path">c</a><img src="cid:logo"><img src="data:image/png;base64,AAAA">`,
+			want: `<a href="https://rastercar.com/a?b=c:d">a</a><a href="mailto:bruce@wayne.com">b</a><a href="/relative:path">c</a><img src="cid:logo"/><img src="data:image/png;base64,AAAA"/>`,
+		},
+		{
+			name:    "data urls are only allowed on image sources",
+			html:    `<a href="data:image/png;base64,AAAA">a</a>`,
+			want:    `<a>a</a>`,
+			wantNot: []string{"data:"},
+		},
+		{
+			name:    "srcset candidates are checked",
+			html:    `<img srcset="a.png 1x, javascript:alert(1) 2x"><img srcset="a.png 1x, https://rastercar.com/b.png 2x">`,
+			want:    `<img/><img srcset="a.png 1x, https://rastercar.com/b.png 2x"/>`,
+			wantNot: []string{"javascript"},
+		},
+		{
+			name:    "dangerous styles are removed",
+			html:    `<p style="width: expression(alert(1))">a</p><p style="background: url(java\73 cript:alert(1))">b</p><style>@import url(https://evil.com/a.css);</style><style>/* reset */ p { margin: 0 }</style>`,
+			want:    `<p>a</p><p>b</p>`,
+			wantNot: []string{"expression", "cript", "@import"},
+		},
+		{
+			name: "styles with comments are kept",
+			html: `<style>/* reset */ p { margin: 0 }</style><p>Hi</p>`,
+			want: `<style>/* reset */ p { margin: 0 }</style>`,
+		},
+	}
+
+	pipeline, err := newContentPipeline(config.ContentConfig{Sanitize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pipeline.process(tt.html)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("expected %q to contain %q", got, tt.want)
+			}
+
+			for _, s := range tt.wantNot {
+				if strings.Contains(got, s) {
+					t.Errorf("expected %q to not contain %q", got, s)
+				}
+			}
+		})
+	}
+}
+
+func TestContentPipeline(t *testing.T) {
+	pipeline, err := newContentPipeline(config.ContentConfig{InlineCss: true, Sanitize: true, BaseUrl: "https://rastercar.com/emails/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := pipeline.process(`<style>p { color: red }</style><p>Hi <a href="invoice?id=1">invoice</a> <a href="#top">top</a></p>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{`<p style="color: red;">`, `href="https://rastercar.com/emails/invoice?id=1"`, `href="#top"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q to contain %q", got, want)
+		}
+	}
+
+	if _, err := newContentPipeline(config.ContentConfig{BaseUrl: "rastercar.com"}); err == nil {
+		t.Error("expected a relative base url to be rejected")
+	}
+}
+
+func TestRewriteRelativeUrls(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{
+			name: "relative urls are resolved",
+			html: `<a href="invoice?id=1"><img src="/logo.png"></a>`,
+			want: `<a href="https://rastercar.com/emails/invoice?id=1"><img src="https://rastercar.com/logo.png"/></a>`,
+		},
+		{
+			name: "absolute urls and fragments are kept",
+			html: `<a href="https://wayne.com/a">a</a><a href="#top">top</a><a href="mailto:bruce@wayne.com">mail</a>`,
+			want: `<a href="https://wayne.com/a">a</a><a href="#top">top</a><a href="mailto:bruce@wayne.com">mail</a>`,
+		},
+		{
+			name: "srcset candidates are resolved keeping their descriptors",
+			html: `<img srcset="logo.png 1x,/logo@2x.png 2x, https://cdn.rastercar.com/logo@3x.png 3x">`,
+			want: `<img srcset="https://rastercar.com/emails/logo.png 1x, https://rastercar.com/logo@2x.png 2x, https://cdn.rastercar.com/logo@3x.png 3x"/>`,
+		},
+	}
+
+	pipeline, err := newContentPipeline(config.ContentConfig{BaseUrl: "https://rastercar.com/emails/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pipeline.process(tt.html)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("expected %q to contain %q", got, tt.want)
+			}
+		})
+	}
+}
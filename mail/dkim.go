@@ -0,0 +1,138 @@
+package mail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"mailer-ms/config"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// dkimSigner signs raw messages with the key of their sender domain
+type dkimSigner struct {
+	keys map[string]*dkim.SignOptions
+}
+
+// newDkimSigner creates a signer for the configured keys, returns nil if there are none
+func newDkimSigner(cfg config.DkimConfig) (*dkimSigner, error) {
+	if len(cfg.Keys) == 0 {
+		return nil, nil
+	}
+
+	if len(cfg.SignedHeaders) == 0 {
+		return nil, errors.New("dkim signed headers cannot be empty")
+	}
+
+	headerCanonicalization, err := parseCanonicalization(cfg.HeaderCanonicalization)
+	if err != nil {
+		return nil, err
+	}
+
+	bodyCanonicalization, err := parseCanonicalization(cfg.BodyCanonicalization)
+	if err != nil {
+		return nil, err
+	}
+
+	signer := &dkimSigner{keys: make(map[string]*dkim.SignOptions, len(cfg.Keys))}
+
+	for _, k := range cfg.Keys {
+		key, err := loadPrivateKey(k.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load dkim key for %s: %w", k.Domain, err)
+		}
+
+		signer.keys[strings.ToLower(k.Domain)] = &dkim.SignOptions{
+			Domain:                 k.Domain,
+			Selector:               k.Selector,
+			Signer:                 key,
+			HeaderCanonicalization: headerCanonicalization,
+			BodyCanonicalization:   bodyCanonicalization,
+			HeaderKeys:             cfg.SignedHeaders,
+		}
+	}
+
+	return signer, nil
+}
+
+// options returns the signing options for the domain of the source address, if any
+func (s *dkimSigner) options(source string) *dkim.SignOptions {
+	if s == nil {
+		return nil
+	}
+
+	address, err := mail.ParseAddress(source)
+	if err != nil {
+		return nil
+	}
+
+	domain := address.Address[strings.LastIndex(address.Address, "@")+1:]
+
+	return s.keys[strings.ToLower(domain)]
+}
+
+// canSign returns if there is a key for the domain of the source address
+func (s *dkimSigner) canSign(source string) bool {
+	return s.options(source) != nil
+}
+
+// sign returns the raw message with a DKIM-Signature header prepended, the
+// message is returned unchanged if there is no key for the source domain
+func (s *dkimSigner) sign(source string, raw []byte) ([]byte, error) {
+	options := s.options(source)
+	if options == nil {
+		return raw, nil
+	}
+
+	var signed bytes.Buffer
+
+	if err := dkim.Sign(&signed, bytes.NewReader(raw), options); err != nil {
+		return nil, fmt.Errorf("failed to dkim sign message: %w", err)
+	}
+
+	return signed.Bytes(), nil
+}
+
+func parseCanonicalization(c string) (dkim.Canonicalization, error) {
+	switch dkim.Canonicalization(c) {
+	case dkim.CanonicalizationSimple, dkim.CanonicalizationRelaxed:
+		return dkim.Canonicalization(c), nil
+	}
+
+	return "", fmt.Errorf("invalid dkim canonicalization: %q, expected simple or relaxed", c)
+}
+
+// loadPrivateKey loads a PEM encoded PKCS #1 RSA key or a PKCS #8 RSA or Ed25519 key
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+
+	return signer, nil
+}
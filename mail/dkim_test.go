@@ -0,0 +1,160 @@
+package mail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"mailer-ms/config"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+var testSignedHeaders = []string{"From", "To", "Subject", "Date", "Content-Type"}
+
+// writeKey writes the private key to a PEM file and returns its path and the DNS record of its public key
+func writeKey(t *testing.T, key crypto.Signer) (string, string) {
+	t.Helper()
+
+	var block *pem.Block
+	var algorithm string
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+		algorithm = "rsa"
+	default:
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+		algorithm = "ed25519"
+	}
+
+	var public []byte
+
+	if algorithm == "rsa" {
+		public, _ = x509.MarshalPKIXPublicKey(key.Public())
+	} else {
+		public = key.Public().(ed25519.PublicKey)
+	}
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path, "v=DKIM1; k=" + algorithm + "; p=" + base64.StdEncoding.EncodeToString(public)
+}
+
+func TestDkimSigner(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, ed25519Key, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name          string
+		key           crypto.Signer
+		canonicalize  string
+		source        string
+		wantSignature bool
+	}{
+		{name: "rsa key", key: rsaKey, canonicalize: "relaxed", source: `"Rastercar" <noreply@rastercar.com>`, wantSignature: true},
+		{name: "ed25519 key", key: ed25519Key, canonicalize: "simple", source: "noreply@rastercar.com", wantSignature: true},
+		{name: "domain is case insensitive", key: rsaKey, canonicalize: "relaxed", source: "noreply@RASTERCAR.com", wantSignature: true},
+		{name: "domain without key", key: rsaKey, canonicalize: "relaxed", source: "noreply@wayne.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, record := writeKey(t, tt.key)
+
+			signer, err := newDkimSigner(config.DkimConfig{
+				Keys:                   config.DkimKeys{{Domain: "rastercar.com", Selector: "mailer", KeyFile: path}},
+				HeaderCanonicalization: tt.canonicalize,
+				BodyCanonicalization:   tt.canonicalize,
+				SignedHeaders:          testSignedHeaders,
+			})
+			if err != nil {
+				t.Fatalf("failed to create signer: %v", err)
+			}
+
+			if signer.canSign(tt.source) != tt.wantSignature {
+				t.Fatalf("expected canSign to be %v", tt.wantSignature)
+			}
+
+			msg := Message{Uuid: "uuid", Source: tt.source, To: []string{"bruce@wayne.com"}, Subject: "Hi", Html: "<p>Hi</p>", dkim: signer}
+
+			raw, err := msg.Raw()
+			if err != nil {
+				t.Fatalf("failed to build raw message: %v", err)
+			}
+
+			verifications, err := dkim.VerifyWithOptions(bytes.NewReader(raw), &dkim.VerifyOptions{
+				LookupTXT: func(domain string) ([]string, error) {
+					if domain != "mailer._domainkey.rastercar.com" {
+						t.Errorf("unexpected dkim record lookup: %s", domain)
+					}
+
+					return []string{record}, nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("failed to verify message: %v", err)
+			}
+
+			if !tt.wantSignature {
+				if len(verifications) != 0 {
+					t.Fatalf("expected the message to not be signed, got %d signatures", len(verifications))
+				}
+
+				return
+			}
+
+			if len(verifications) != 1 || verifications[0].Err != nil {
+				t.Fatalf("expected a valid signature, got %+v", verifications)
+			}
+		})
+	}
+}
+
+func TestNewDkimSigner(t *testing.T) {
+	path, _ := writeKey(t, ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+	keys := config.DkimKeys{{Domain: "rastercar.com", Selector: "mailer", KeyFile: path}}
+
+	tests := []struct {
+		name       string
+		cfg        config.DkimConfig
+		wantSigner bool
+		wantErr    bool
+	}{
+		{name: "without keys the options are not validated", cfg: config.DkimConfig{HeaderCanonicalization: "invalid"}},
+		{name: "valid config", cfg: config.DkimConfig{Keys: keys, HeaderCanonicalization: "relaxed", BodyCanonicalization: "simple", SignedHeaders: testSignedHeaders}, wantSigner: true},
+		{name: "invalid canonicalization", cfg: config.DkimConfig{Keys: keys, HeaderCanonicalization: "loose", BodyCanonicalization: "simple", SignedHeaders: testSignedHeaders}, wantErr: true},
+		{name: "no signed headers", cfg: config.DkimConfig{Keys: keys, HeaderCanonicalization: "relaxed", BodyCanonicalization: "relaxed"}, wantErr: true},
+		{name: "missing key file", cfg: config.DkimConfig{Keys: config.DkimKeys{{Domain: "rastercar.com", Selector: "mailer", KeyFile: "missing.pem"}}, HeaderCanonicalization: "relaxed", BodyCanonicalization: "relaxed", SignedHeaders: testSignedHeaders}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := newDkimSigner(tt.cfg)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			if (signer != nil) != tt.wantSigner {
+				t.Fatalf("expected signer %v, got %v", tt.wantSigner, signer)
+			}
+		})
+	}
+}
@@ -1,39 +1,151 @@
 package mail
 
+import (
+	"encoding/json"
+	"mailer-ms/status"
+)
+
+// Address is a email address with a optional display name, on json it can be either
+// a object or a RFC 5322 address string, eg: `"Bruce Wayne" <bruce@wayne.com>`
+type Address struct {
+	// Optional display name, eg: Bruce Wayne
+	Name string `json:"name"`
+
+	Email string `json:"email" validate:"required,email"`
+}
+
 type SendEmailDto struct {
 	Uuid string `json:"uuid" validate:"required"`
 
+	// Optional sender identity, if not set the default sender is used, the
+	// address must be on the allowed senders list (or its domain)
+	From *Address `json:"from"`
+
 	// Email adresses to send the email to
-	To []string `json:"to" validate:"dive,email"`
+	To []Address `json:"to" validate:"dive"`
 
 	// Carbon copy: an array of email adresses to send a copy of the email,
 	// the only difference between `cc` and `to` is that `to` is the intended original
 	// recipients of the email, whereas `cc` is just people that should be notified
 	// between the emails, from a technical perspective they work the same
-	Cc []string `json:"cc" validate:"dive,email"`
+	Cc []Address `json:"cc" validate:"dive"`
 
 	// Blind carbon copy: similar to the `cc` field but theyre not show to the recipients
 	// meaning they cant se the email adresses on `bcc` and be aware of the copies sent
-	Bcc []string `json:"bcc" validate:"dive,email"`
+	Bcc []Address `json:"bcc" validate:"dive"`
 
 	// Reply-To header: most email clients use this to determine the email to reply to
 	// when a user opens the email and clicks reply, should be a different email address
 	// than the sender, otherwise it would not make a difference
-	ReplyToAddresses []string `json:"reply_to_addresses" validate:"dive,email"`
+	ReplyToAddresses []Address `json:"reply_to_addresses" validate:"dive"`
 
 	// Subject header: by default, the text must be 7-bit ASCII due to SMTP limitations,
 	// if a different charset is to be used (like UTF-8) specify it in the SubjectCharset
-	SubjectText string `json:"subject_text" validate:"required"`
+	SubjectText string `json:"subject_text" validate:"required_without=Template"`
 
-	// Optional email text content: displayed on clients that do not support Html
+	// Optional email text content: displayed on clients that do not support Html, if not
+	// set its generated from the html content, unless disabled by MAIL_GENERATE_TEXT
 	BodyText string `json:"body_text"`
 
 	// Email html content
-	BodyHtml string `json:"body_html" validate:"required"`
+	BodyHtml string `json:"body_html" validate:"required_without=Template"`
+
+	// Optional custom headers, headers set by the mailer such as `From`, `Subject`
+	// or `List-Unsubscribe` cannot be set, emails with custom headers are sent as raw
+	Headers map[string]string `json:"headers"`
+
+	// Optional List-Unsubscribe header options, required by most providers for bulk emails
+	ListUnsubscribe *ListUnsubscribe `json:"list_unsubscribe"`
+
+	// Optional open and click tracking, requires tracking to be enabled on the service
+	Tracking *TrackingOptions `json:"tracking"`
+
+	// Optional SES configuration set to send the email with, overrides the default configuration set
+	ConfigurationSet string `json:"configuration_set" validate:"omitempty,max=64,ses_tag"`
+
+	// Optional SES template to render the subject and bodies with, requires the sesv2 api
+	Template *TemplateContent `json:"template"`
+
+	// Optional SES tenant to send the email through, its identities, configuration set and
+	// template must be associated with the tenant, requires the sesv2 api
+	SesTenant string `json:"ses_tenant" validate:"omitempty,max=64,ses_tag"`
+
+	// Optional SES contact list and topic the email belongs to, SES uses it to add
+	// the List-Unsubscribe headers and to skip unsubscribed contacts, requires the sesv2 api
+	ListManagement *ListManagement `json:"list_management"`
+
+	// Optional SES message tags, used to segment the sending events by category, tenant, etc. names and
+	// values can only contain ASCII letters, numbers, underscores and dashes, `mail_uuid` is reserved
+	Tags map[string]string `json:"tags" validate:"max=49,dive,keys,required,max=256,ses_tag,endkeys,required,max=256,ses_tag"`
+
+	// Optional category of the email, eg: invoice, marketing. used by the provider routing rules
+	Category string `json:"category" validate:"max=128"`
+
+	// Optional id of the tenant the email is sent on behalf of, selects the tenant send rate limit
+	Tenant string `json:"tenant" validate:"max=128"`
+}
+
+type TemplateContent struct {
+	// The name or arn of the SES template
+	Name string `json:"name" validate:"required_without=Arn"`
+	Arn  string `json:"arn"`
+
+	// The template replacement data
+	Data json.RawMessage `json:"data"`
+}
+
+type ListManagement struct {
+	ContactList string `json:"contact_list" validate:"required"`
+	Topic       string `json:"topic"`
+}
+
+type TrackingOptions struct {
+	// Appends a tracking pixel to the html body to track when the email is opened
+	Opens bool `json:"opens"`
+
+	// Rewrites the http links of the html body to track when they are clicked
+	Clicks bool `json:"clicks"`
+}
+
+type ListUnsubscribe struct {
+	// Url to unsubscribe the recipient, must be https if one click is enabled
+	Url string `json:"url" validate:"required_without=Mailto,omitempty,url"`
+
+	// Email address to send unsubscribe requests to
+	Mailto string `json:"mailto" validate:"required_without=Url,omitempty,email"`
+
+	// Sets the List-Unsubscribe-Post header, indicating the url accepts
+	// POST requests to unsubscribe with a single click (RFC 8058)
+	OneClick bool `json:"one_click"`
 }
 
 type SendEmailRes struct {
 	Success bool `json:"success"`
 	// Generic message describring the success or error
 	Message string `json:"message"`
+
+	// The name of the provider that sent the email and the id it assigned to it, set on success
+	Provider   string `json:"provider,omitempty"`
+	ProviderId string `json:"provider_id,omitempty"`
+}
+
+type AdminReq struct {
+	// The admin operation to execute, `status` to query the mail request status, `cancel` to cancel
+	// a mail request waiting to be sent or `pause` and `resume` to stop and restart sending
+	Action string `json:"action" validate:"required,oneof=status cancel pause resume"`
+
+	// The uuid of the mail request to query or cancel
+	Uuid string `json:"uuid" validate:"required_if=Action status,required_if=Action cancel,omitempty,uuid"`
+}
+
+type AdminRes struct {
+	Success bool `json:"success"`
+	// Generic message describring the success or error
+	Message string `json:"message"`
+	// The mail request status after the operation, if found
+	Status *status.Record `json:"status,omitempty"`
+
+	// If the mail requests consumption is paused and why, set on pause and resume requests
+	Paused       *bool    `json:"paused,omitempty"`
+	PauseReasons []string `json:"pause_reasons,omitempty"`
 }
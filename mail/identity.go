@@ -0,0 +1,54 @@
+package mail
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// isAllowedSender checks if a email address is the default sender or is on the allowed
+// senders list, where each entry is either a full address or a domain, eg: `billing.com`
+func (m *Mailer) isAllowedSender(email string) bool {
+	email, err := toASCIIEmail(strings.ToLower(email))
+	if err != nil {
+		return false
+	}
+
+	if email == strings.ToLower(m.cfg.Mail.Sender) {
+		return true
+	}
+
+	domain := email[strings.LastIndex(email, "@")+1:]
+
+	for _, allowed := range m.cfg.Mail.AllowedSenders {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+
+		if strings.Contains(allowed, "@") && !strings.HasPrefix(allowed, "@") {
+			if allowed, err := toASCIIEmail(allowed); err == nil && allowed == email {
+				return true
+			}
+
+			continue
+		}
+
+		if allowed, err := idna.Lookup.ToASCII(strings.TrimPrefix(allowed, "@")); err == nil && allowed == domain {
+			return true
+		}
+	}
+
+	return false
+}
+
+// source returns the formatted sender of the email
+func (m *Mailer) source(from *Address) (string, error) {
+	if from == nil {
+		return Address{Name: m.cfg.Mail.SenderName, Email: m.cfg.Mail.Sender}.format()
+	}
+
+	if !m.isAllowedSender(from.Email) {
+		return "", fmt.Errorf("sender %s is not allowed", from.Email)
+	}
+
+	return from.format()
+}
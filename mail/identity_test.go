@@ -0,0 +1,45 @@
+package mail
+
+import (
+	"mailer-ms/config"
+	"testing"
+)
+
+func TestSource(t *testing.T) {
+	m := &Mailer{cfg: &config.Config{Mail: config.MailConfig{
+		Sender:         "noreply@rastercar.com",
+		SenderName:     "Rastercar",
+		AllowedSenders: []string{"alerts@rastercar.com", "billing.rastercar.com", " @wäyne.com "},
+	}}}
+
+	tests := []struct {
+		name    string
+		from    *Address
+		want    string
+		wantErr bool
+	}{
+		{name: "default sender", want: `"Rastercar" <noreply@rastercar.com>`},
+		{name: "default sender explicitly", from: &Address{Email: "NoReply@rastercar.com"}, want: "NoReply@rastercar.com"},
+		{name: "allowed address", from: &Address{Name: "Alerts", Email: "alerts@rastercar.com"}, want: `"Alerts" <alerts@rastercar.com>`},
+		{name: "allowed domain", from: &Address{Email: "invoices@billing.rastercar.com"}, want: "invoices@billing.rastercar.com"},
+		{name: "allowed idn domain", from: &Address{Email: "bruce@wäyne.com"}, want: "bruce@xn--wyne-loa.com"},
+		{name: "address of a allowed address domain", from: &Address{Email: "other@rastercar.com"}, wantErr: true},
+		{name: "subdomain of a allowed domain", from: &Address{Email: "a@x.billing.rastercar.com"}, wantErr: true},
+		{name: "unknown domain", from: &Address{Email: "joker@arkham.com"}, wantErr: true},
+		{name: "invalid address", from: &Address{Email: "not an email"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := m.source(tt.from)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			if got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
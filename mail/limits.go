@@ -0,0 +1,239 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"mailer-ms/config"
+	"mailer-ms/queue"
+	"mailer-ms/status"
+	"mailer-ms/tracer"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/time/rate"
+)
+
+// Header counting how many times a mail request was delayed
+const delaysHeader = "x-mail-delays"
+
+// Header with the time (unix milliseconds) the sends of a delayed mail request were reserved at, the request
+// is sent once consumed after it without reserving its sends again
+const scheduledHeader = "x-mail-scheduled-at"
+
+// Buckets idle for longer than this are dropped, so unused tenants and domains do not pile up
+const bucketIdleTime = 10 * time.Minute
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// bucketSet holds the token buckets of a kind of key (tenants or domains), created on demand
+type bucketSet struct {
+	defaults config.BucketLimit
+	limits   config.BucketLimits
+	buckets  map[string]*bucket
+}
+
+func newBucketSet(defaults config.BucketLimit, limits config.BucketLimits) *bucketSet {
+	normalized := make(config.BucketLimits, len(limits))
+
+	for key, limit := range limits {
+		normalized[strings.ToLower(key)] = limit
+	}
+
+	return &bucketSet{defaults: defaults, limits: normalized, buckets: make(map[string]*bucket)}
+}
+
+// reserve reserves n tokens of the key bucket, returning nil if the key is unlimited
+func (s *bucketSet) reserve(key string, n int, now time.Time) *rate.Reservation {
+	key = strings.ToLower(key)
+
+	limit, ok := s.limits[key]
+	if !ok {
+		limit = s.defaults
+	}
+
+	if limit.Rate <= 0 {
+		return nil
+	}
+
+	burst := limit.Burst
+	if burst < 1 {
+		burst = 1
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(limit.Rate), burst)}
+		s.buckets[key] = b
+	}
+
+	b.lastUsed = now
+
+	// more tokens than the burst can never be reserved, the request takes the whole burst instead
+	if n > burst {
+		n = burst
+	}
+
+	return b.limiter.ReserveN(now, n)
+}
+
+func (s *bucketSet) purge(now time.Time) {
+	for key, b := range s.buckets {
+		if now.Sub(b.lastUsed) > bucketIdleTime {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// requestLimiter limits the sends by tenant and by recipient domain
+type requestLimiter struct {
+	mu        sync.Mutex
+	tenants   *bucketSet
+	domains   *bucketSet
+	lastPurge time.Time
+}
+
+func newRequestLimiter(cfg config.LimitsConfig) *requestLimiter {
+	return &requestLimiter{
+		tenants:   newBucketSet(cfg.Tenant, cfg.Tenants),
+		domains:   newBucketSet(cfg.Domain, cfg.Domains),
+		lastPurge: time.Now(),
+	}
+}
+
+// reservation holds the tokens reserved for a mail request on each of its buckets
+type reservation []*rate.Reservation
+
+// delay returns how long the mail request must wait until it can be sent
+func (r reservation) delay(now time.Time) time.Duration {
+	var delay time.Duration
+
+	for _, res := range r {
+		if d := res.DelayFrom(now); d > delay {
+			delay = d
+		}
+	}
+
+	return delay
+}
+
+// cancel returns the reserved tokens, for the requests that will not be sent at their reserved time
+func (r reservation) cancel(now time.Time) {
+	for _, res := range r {
+		res.CancelAt(now)
+	}
+}
+
+// reserve reserves a token of the tenant bucket and, for each recipient domain,
+// a token per recipient of the domain bucket
+func (l *requestLimiter) reserve(tenant string, recipients []Address) reservation {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(l.lastPurge) > bucketIdleTime {
+		l.tenants.purge(now)
+		l.domains.purge(now)
+		l.lastPurge = now
+	}
+
+	var r reservation
+
+	if tenant != "" {
+		if res := l.tenants.reserve(tenant, 1, now); res != nil {
+			r = append(r, res)
+		}
+	}
+
+	for domain, count := range recipientDomains(recipients) {
+		if res := l.domains.reserve(domain, count, now); res != nil {
+			r = append(r, res)
+		}
+	}
+
+	return r
+}
+
+// recipientDomains counts the recipients of each domain, domains are converted to punycode
+func recipientDomains(recipients []Address) map[string]int {
+	domains := make(map[string]int)
+
+	for _, r := range recipients {
+		email, err := toASCIIEmail(r.Email)
+		if err != nil {
+			continue
+		}
+
+		domains[strings.ToLower(email[strings.LastIndex(email, "@")+1:])]++
+	}
+
+	return domains
+}
+
+// scheduledAt returns the time the sends of a delayed mail request were reserved at, if it was delayed
+func scheduledAt(d *amqp091.Delivery) (time.Time, bool) {
+	ms, ok := d.Headers[scheduledHeader].(int64)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.UnixMilli(ms), true
+}
+
+// delayRequest publishes the mail request to the delay queue of the tier its delay is rounded up to, to be
+// consumed again once the tier expires and sent once scheduled, the request status is set to scheduled so it
+// can still be canceled meanwhile, status.ErrCanceled is returned if it was canceled before being delayed
+func (m *Mailer) delayRequest(ctx context.Context, d *amqp091.Delivery, uuid string, delay time.Duration, scheduled time.Time) error {
+	ctx, span := tracer.NewSpan(ctx, "mail", "DelayRequest")
+	defer span.End()
+
+	delay = queue.DelayTier(m.cfg.Rmq.DelayTiers, delay)
+
+	delays := int32(1)
+	if previous, ok := d.Headers[delaysHeader].(int32); ok {
+		delays = previous + 1
+	}
+
+	span.SetAttributes(attribute.Key("delay_ms").Int64(delay.Milliseconds()))
+	span.SetAttributes(attribute.Key("delays").Int(int(delays)))
+
+	headers := amqp091.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+
+	headers[delaysHeader] = delays
+	headers[scheduledHeader] = scheduled.UnixMilli()
+
+	if err := m.setStatus(ctx, uuid, status.Scheduled, 0, "over the send rate limit, delayed by "+delay.String(), ""); err != nil {
+		tracer.AddSpanErrorAndFail(span, err, "mail request was canceled")
+		return err
+	}
+
+	err := m.queue.Publish(ctx, "", queue.DelayQueueName(m.cfg.Rmq.DelayQueue, delay), amqp091.Publishing{
+		Headers:       headers,
+		ContentType:   d.ContentType,
+		Body:          d.Body,
+		Type:          d.Type,
+		ReplyTo:       d.ReplyTo,
+		CorrelationId: d.CorrelationId,
+		DeliveryMode:  amqp091.Persistent,
+	})
+
+	if err != nil {
+		tracer.AddSpanErrorAndFail(span, err, "failed to publish the mail request to the delay queue")
+		return err
+	}
+
+	if err := d.Ack(false); err != nil {
+		tracer.AddSpanError(span, fmt.Errorf("failed to ack delayed mail request: %w", err))
+	}
+
+	return nil
+}
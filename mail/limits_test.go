@@ -0,0 +1,176 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"mailer-ms/config"
+	"mailer-ms/mocks"
+	"mailer-ms/queue"
+	"mailer-ms/status"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestRecipientDomains(t *testing.T) {
+	got := recipientDomains([]Address{{Email: "bruce@Wayne.com"}, {Email: "alfred@wayne.com"}, {Email: "jose@wäyne.com"}, {Email: "invalid"}})
+	want := map[string]int{"wayne.com": 2, "xn--wyne-loa.com": 1}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestRequestLimiter(t *testing.T) {
+	limiter := newRequestLimiter(config.LimitsConfig{
+		Tenant:  config.BucketLimit{Rate: 1, Burst: 1},
+		Domain:  config.BucketLimit{},
+		Domains: config.BucketLimits{"wayne.com": {Rate: 1, Burst: 2}},
+	})
+
+	tests := []struct {
+		name       string
+		tenant     string
+		recipients []Address
+		wantDelay  bool
+	}{
+		{name: "unlimited domain", recipients: []Address{{Email: "a@gotham.com"}, {Email: "b@gotham.com"}, {Email: "c@gotham.com"}}},
+		{name: "within the domain burst", recipients: []Address{{Email: "a@wayne.com"}, {Email: "b@wayne.com"}}},
+		{name: "over the domain burst", recipients: []Address{{Email: "c@wayne.com"}}, wantDelay: true},
+		{name: "within the tenant burst", tenant: "acme", recipients: []Address{{Email: "a@gotham.com"}}},
+		{name: "over the tenant burst", tenant: "ACME", recipients: []Address{{Email: "a@gotham.com"}}, wantDelay: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay := limiter.reserve(tt.tenant, tt.recipients).delay(time.Now())
+
+			if (delay > 0) != tt.wantDelay {
+				t.Fatalf("expected delay %v, got %s", tt.wantDelay, delay)
+			}
+		})
+	}
+}
+
+func TestRequestLimiterBacklog(t *testing.T) {
+	limiter := newRequestLimiter(config.LimitsConfig{Tenant: config.BucketLimit{Rate: 1, Burst: 1}})
+	tiers := []int{1, 5, 30}
+
+	limiter.reserve("acme", nil)
+
+	var got []time.Duration
+
+	// delayed requests keep their reservation, so each request of a backlog waits for the ones before it
+	for i := 0; i < 7; i++ {
+		delay := limiter.reserve("acme", nil).delay(time.Now()).Round(time.Second)
+		got = append(got, queue.DelayTier(tiers, delay))
+	}
+
+	want := []time.Duration{time.Second, 5 * time.Second, 5 * time.Second, 5 * time.Second, 5 * time.Second, 30 * time.Second, 30 * time.Second}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the delay tiers %v, got %v", want, got)
+	}
+}
+
+func TestApplyLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		scheduled time.Duration
+		delayed   bool
+
+		wantHandled  bool
+		wantRequeued bool
+		wantReserved bool
+	}{
+		{name: "within the limit", wantReserved: true},
+		{name: "over the limit and not delayed is requeued", delayed: true, wantHandled: true, wantRequeued: true},
+		{name: "scheduled is sent without being limited again", delayed: true, scheduled: -time.Second},
+		{name: "scheduled later and not delayed is requeued", delayed: true, scheduled: time.Minute, wantHandled: true, wantRequeued: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Mailer{
+				cfg:    &config.Config{Rmq: config.RmqConfig{DelayQueue: "mail_requests_delayed", DelayTiers: []int{1, 30}}},
+				queue:  &queue.Server{},
+				status: newTestStatusStore(t),
+				limits: newRequestLimiter(config.LimitsConfig{Tenant: config.BucketLimit{Rate: 0.1, Burst: 1}}),
+			}
+
+			dto := &SendEmailDto{Uuid: "uuid", Tenant: "acme", To: []Address{{Email: "bruce@wayne.com"}}}
+
+			if tt.delayed {
+				m.limits.reserve(dto.Tenant, nil)
+			}
+
+			ctrl := gomock.NewController(t)
+			acknowledger := mocks.NewMockAcknowledger(ctrl)
+			d := &amqp091.Delivery{Acknowledger: acknowledger, DeliveryTag: 1}
+
+			if tt.scheduled != 0 {
+				d.Headers = amqp091.Table{scheduledHeader: time.Now().Add(tt.scheduled).UnixMilli()}
+			}
+
+			// the queue is not connected, so the requests over the limit cannot be delayed
+			if tt.wantRequeued {
+				acknowledger.EXPECT().Nack(uint64(1), false, true)
+			}
+
+			if handled := m.applyLimits(context.Background(), d, dto); handled != tt.wantHandled {
+				t.Fatalf("expected handled %v, got %v", tt.wantHandled, handled)
+			}
+
+			// requests that were not delayed do not keep their reservation
+			reserved := m.limits.reserve(dto.Tenant, nil).delay(time.Now()) > 0
+
+			if reserved != (tt.wantReserved || tt.delayed) {
+				t.Fatalf("expected the sends to be reserved %v, got %v", tt.wantReserved || tt.delayed, reserved)
+			}
+		})
+	}
+}
+
+func TestApplyLimitsCanceledRequest(t *testing.T) {
+	store := newTestStatusStore(t)
+
+	m := &Mailer{
+		cfg:    &config.Config{Rmq: config.RmqConfig{DelayQueue: "mail_requests_delayed", DelayTiers: []int{1, 30}}},
+		queue:  &queue.Server{},
+		status: store,
+		limits: newRequestLimiter(config.LimitsConfig{Tenant: config.BucketLimit{Rate: 0.1, Burst: 1}}),
+	}
+
+	dto := &SendEmailDto{Uuid: "uuid", Tenant: "acme", To: []Address{{Email: "bruce@wayne.com"}}}
+
+	ctrl := gomock.NewController(t)
+	acknowledger := mocks.NewMockAcknowledger(ctrl)
+	d := &amqp091.Delivery{Acknowledger: acknowledger, DeliveryTag: 1}
+
+	if delayed := m.applyLimits(context.Background(), d, dto); delayed {
+		t.Fatal("expected the first request to be within the limit")
+	}
+
+	store.Update("uuid", func(r *status.Record) error {
+		r.Status = status.Canceled
+		return nil
+	})
+
+	if err := m.delayRequest(context.Background(), d, "uuid", 10*time.Second, time.Now().Add(10*time.Second)); !errors.Is(err, status.ErrCanceled) {
+		t.Fatalf("expected ErrCanceled, got %v", err)
+	}
+
+	// the canceled request is not published to the delay queue, it is rejected instead
+	acknowledger.EXPECT().Reject(uint64(1), false)
+
+	if delayed := m.applyLimits(context.Background(), d, dto); !delayed {
+		t.Fatal("expected the canceled request to be answered")
+	}
+
+	if record, _ := store.Get("uuid"); record.Status != status.Canceled {
+		t.Fatalf("expected the request to stay canceled, got %s", record.Status)
+	}
+}
@@ -5,13 +5,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"mailer-ms/archive"
 	"mailer-ms/config"
 	"mailer-ms/queue"
+	"mailer-ms/status"
 	"mailer-ms/tracer"
+	"mailer-ms/tracking"
+	"regexp"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/ses"
-	"github.com/aws/aws-sdk-go-v2/service/ses/types"
 	"github.com/google/uuid"
 	"golang.org/x/time/rate"
 
@@ -26,30 +29,97 @@ var (
 	utf8             = "utf-8"
 	mailUuidTag      = "mail_uuid"
 	maxSesRecipients = 50
+	sesTagRegex      = regexp.MustCompile(`^[a-zA-Z0-9_-]*$`)
 )
 
 type Mailer struct {
-	client      SesApi
+	sender      Sender
 	cfg         *config.Config
 	queue       *queue.Server
+	status      status.Store
+	archive     *archive.Archive
+	dkim        *dkimSigner
+	content     contentPipeline
+	tracker     *tracking.Tracker
 	validate    *validator.Validate
-	rateLimiter *rate.Limiter
+	rateLimiter *adaptiveLimiter
+	limits      *requestLimiter
+
+	// opens when the provider keeps failing, pausing the mail requests consumption
+	breaker *breaker
+
+	// the last send quota, the sending is paused while the daily quota is nearly exhausted
+	quota *quotaGate
 }
 
-func New(cfg *config.Config, queue *queue.Server) Mailer {
-	requestsPerMs := 1000 / cfg.Mail.ReqPerSecLimit
-	limit := rate.Every(time.Duration(requestsPerMs) * time.Millisecond)
+// New creates a mailer, archive can be nil if the sent messages should not be archived
+func New(cfg *config.Config, queue *queue.Server, statusStore status.Store, archive *archive.Archive, tracker *tracking.Tracker) (Mailer, error) {
+	if t := cfg.Mail.QuotaPauseThreshold; t <= 0 || t > 1 {
+		return Mailer{}, fmt.Errorf("invalid quota pause threshold %v, expected a fraction of the daily quota in (0, 1]", t)
+	}
+
+	limit := rate.Limit(cfg.Mail.ReqPerSecLimit)
+
+	if limit <= 0 {
+		if !quotaDiscoveryEnabled(cfg) {
+			return Mailer{}, errors.New("the req per sec limit must be positive when the send quota discovery is disabled")
+		}
+
+		// until the send quota is discovered send at the minimum SES rate
+		limit = 1
+		log.Printf("[ MAIL ] no req per sec limit set, sending at %v emails per second until the send quota is discovered", limit)
+	}
+
+	limiter, err := newRateLimiter(cfg.RateLimit, limit)
+	if err != nil {
+		return Mailer{}, err
+	}
+
+	sender, err := newSender(cfg)
+	if err != nil {
+		return Mailer{}, err
+	}
+
+	dkim, err := newDkimSigner(cfg.Dkim)
+	if err != nil {
+		return Mailer{}, err
+	}
+
+	content, err := newContentPipeline(cfg.Content)
+	if err != nil {
+		return Mailer{}, err
+	}
 
 	return Mailer{
 		cfg:         cfg,
 		queue:       queue,
-		validate:    validator.New(),
-		client:      ses.NewFromConfig(cfg.Aws.Instance),
-		rateLimiter: rate.NewLimiter(limit, 1),
-	}
+		status:      statusStore,
+		archive:     archive,
+		dkim:        dkim,
+		content:     content,
+		tracker:     tracker,
+		validate:    newValidator(),
+		sender:      sender,
+		rateLimiter: newAdaptiveLimiter(cfg.Mail, limiter),
+		quota:       newQuotaGate(),
+		limits:      newRequestLimiter(cfg.Limits),
+		breaker:     newBreaker(cfg.Mail.BreakerFailures, time.Duration(cfg.Mail.BreakerCooldown)*time.Second),
+	}, nil
+}
+
+func newValidator() *validator.Validate {
+	validate := validator.New()
+
+	// SES tag names and values, as well as configuration set names, can only
+	// contain ASCII letters, numbers, underscores and dashes
+	validate.RegisterValidation("ses_tag", func(fl validator.FieldLevel) bool {
+		return sesTagRegex.MatchString(fl.Field().String())
+	})
+
+	return validate
 }
 
-func (m *Mailer) handleMailRequestResult(ctx context.Context, originalDelivery *amqp091.Delivery, failure error) {
+func (m *Mailer) handleMailRequestResult(ctx context.Context, originalDelivery *amqp091.Delivery, receipt *Receipt, failure error) {
 	ctx, span := tracer.NewSpan(ctx, "mail", "handleMailRequestResult")
 	defer span.End()
 
@@ -60,7 +130,14 @@ func (m *Mailer) handleMailRequestResult(ctx context.Context, originalDelivery *
 
 	if failure == nil {
 		resType = "success"
-		body, _ = json.Marshal(SendEmailRes{Success: true, Message: successMsg})
+		res := SendEmailRes{Success: true, Message: successMsg}
+
+		if receipt != nil {
+			res.Provider = receipt.Provider
+			res.ProviderId = receipt.MessageId
+		}
+
+		body, _ = json.Marshal(res)
 
 		span.SetStatus(codes.Ok, successMsg)
 
@@ -75,17 +152,40 @@ func (m *Mailer) handleMailRequestResult(ctx context.Context, originalDelivery *
 		originalDelivery.Reject(false)
 	}
 
-	if originalDelivery.ReplyTo != "" && originalDelivery.CorrelationId != "" {
-		err := m.queue.Publish(ctx, "", originalDelivery.ReplyTo, amqp091.Publishing{
-			Body:          body,
-			Type:          resType,
-			CorrelationId: originalDelivery.CorrelationId,
-		})
+	m.reply(ctx, originalDelivery, resType, body)
+}
 
-		if err != nil {
-			tracer.AddSpanErrorAndFail(span, err, "failed to publish rpc response")
-		}
+// reply publishes a rpc response to a delivery if its `reply to` and `correlation id` are set
+func (m *Mailer) reply(ctx context.Context, delivery *amqp091.Delivery, resType string, body []byte) {
+	if delivery.ReplyTo == "" || delivery.CorrelationId == "" {
+		return
+	}
+
+	err := m.queue.Publish(ctx, "", delivery.ReplyTo, amqp091.Publishing{
+		Body:          body,
+		Type:          resType,
+		CorrelationId: delivery.CorrelationId,
+	})
+
+	if err != nil {
+		tracer.AddSpanErrorAndFail(tracer.SpanFromContext(ctx), err, "failed to publish rpc response")
+	}
+}
+
+// setStatus stores the status of a mail request, since failing to store the
+// status should not prevent the email from being sent only ErrCanceled is returned
+func (m *Mailer) setStatus(ctx context.Context, uuid string, s status.MailStatus, attempt int, reason, providerId string) error {
+	err := status.Set(m.status, uuid, s, attempt, reason, providerId)
+
+	if errors.Is(err, status.ErrCanceled) {
+		return err
+	}
+
+	if err != nil {
+		tracer.AddSpanError(tracer.SpanFromContext(ctx), fmt.Errorf("failed to store mail status: %w", err))
 	}
+
+	return nil
 }
 
 func (m *Mailer) HandleMailRequestDelivery(d *amqp091.Delivery) {
@@ -96,102 +196,293 @@ func (m *Mailer) HandleMailRequestDelivery(d *amqp091.Delivery) {
 
 	if err := json.Unmarshal(d.Body, &dto); err != nil {
 		tracer.AddSpanErrorAndFail(span, err, "failed to unmarshal send mail request")
-		m.handleMailRequestResult(ctx, d, err)
+		m.handleMailRequestResult(ctx, d, nil, err)
 		return
 	}
 
 	if _, err := uuid.Parse(dto.Uuid); err != nil {
 		tracer.AddSpanErrorAndFail(span, err, "invalid email uuid")
-		m.handleMailRequestResult(ctx, d, errors.New("invalid email uuid"))
+		m.handleMailRequestResult(ctx, d, nil, errors.New("invalid email uuid"))
 		return
 	}
 
+	if record, err := status.Queue(m.status, dto.Uuid); err != nil {
+		if m.handleFinalRequest(ctx, d, record, err) {
+			return
+		}
+
+		tracer.AddSpanError(span, fmt.Errorf("failed to store mail status: %w", err))
+	}
+
 	recipientCnt := len(dto.To) + len(dto.Cc) + len(dto.Bcc)
 
 	if recipientCnt > maxSesRecipients {
 		span.SetStatus(codes.Error, "email recipient count is over 50")
-		m.handleMailRequestResult(ctx, d, errors.New("email recipient count is over 50"))
+		m.failMailRequest(ctx, d, dto.Uuid, 0, errors.New("email recipient count is over 50"))
 		return
 	}
 
 	if recipientCnt == 0 {
 		span.SetStatus(codes.Error, "email has no recipients")
-		m.handleMailRequestResult(ctx, d, errors.New("email recipient count is over 50"))
+		m.failMailRequest(ctx, d, dto.Uuid, 0, errors.New("email recipient count is over 50"))
 		return
 	}
 
 	if err := m.validate.Struct(dto); err != nil {
 		tracer.AddSpanErrorAndFail(span, err, "invalid email request")
-		m.handleMailRequestResult(ctx, d, fmt.Errorf("validation error: %w", err))
+		m.failMailRequest(ctx, d, dto.Uuid, 0, fmt.Errorf("validation error: %w", err))
 		return
 	}
 
-	input := ses.SendEmailInput{
-		Source:           &m.cfg.Mail.Sender,
-		ReplyToAddresses: dto.ReplyToAddresses,
-		Destination: &types.Destination{
-			ToAddresses:  dto.To,
-			CcAddresses:  dto.Cc,
-			BccAddresses: dto.Bcc,
-		},
-		Message: &types.Message{
-			Subject: &types.Content{
-				Data:    &dto.SubjectText,
-				Charset: &utf8,
-			},
-			Body: &types.Body{
-				Html: &types.Content{
-					Data:    &dto.BodyHtml,
-					Charset: &utf8,
-				},
-				Text: &types.Content{
-					Data:    &dto.BodyText,
-					Charset: &utf8,
-				},
-			},
-		},
-		Tags: []types.MessageTag{
-			{
-				Name:  &mailUuidTag,
-				Value: &dto.Uuid,
-			},
-		},
-	}
-
-	if err := m.sendWithRetry(ctx, 1, &input); err != nil {
+	msg, err := m.newMessage(&dto)
+	if err != nil {
 		tracer.AddSpanErrorAndFail(span, err, "invalid email request")
-		m.handleMailRequestResult(ctx, d, fmt.Errorf("validation error: %w", err))
+		m.failMailRequest(ctx, d, dto.Uuid, 0, fmt.Errorf("validation error: %w", err))
+		return
+	}
+
+	if delayed := m.applyLimits(ctx, d, &dto); delayed {
+		return
+	}
+
+	receipt, attempt, err := m.sendWithRetry(ctx, 1, msg)
+
+	if errors.Is(err, errQuotaExhausted) || errors.Is(err, errRateLimitWait) || errors.Is(err, errPaused) || errors.Is(err, errBreakerOpen) {
+		m.requeue(ctx, d)
+		return
+	}
+
+	m.archiveMessage(ctx, msg, receipt, err)
+
+	if errors.Is(err, status.ErrCanceled) {
+		tracer.AddSpanErrorAndFail(span, err, "mail request was canceled")
+		m.handleMailRequestResult(ctx, d, nil, err)
+		return
+	}
+
+	if err != nil {
+		tracer.AddSpanErrorAndFail(span, err, "invalid email request")
+		m.failMailRequest(ctx, d, dto.Uuid, attempt, fmt.Errorf("validation error: %w", err))
+		return
+	}
+
+	// the request can not be canceled once sending starts, so a canceled error here means the
+	// store changed under it and the email was still sent, which the reply should report
+	if err := status.SetSent(m.status, dto.Uuid, attempt, receipt.Provider, receipt.MessageId); err != nil {
+		tracer.AddSpanError(span, fmt.Errorf("failed to store mail status: %w", err))
+	}
+
+	span.SetAttributes(attribute.Key("provider").String(receipt.Provider))
+	m.handleMailRequestResult(ctx, d, receipt, nil)
+}
+
+// handleFinalRequest answers mail requests that were already canceled, sent or failed with their stored result, so
+// redelivered or duplicated requests are not sent again, returns false if the error is not about a final request
+func (m *Mailer) handleFinalRequest(ctx context.Context, d *amqp091.Delivery, record *status.Record, err error) bool {
+	span := tracer.SpanFromContext(ctx)
+
+	switch {
+	case errors.Is(err, status.ErrCanceled):
+		tracer.AddSpanErrorAndFail(span, err, "mail request was canceled")
+		m.handleMailRequestResult(ctx, d, nil, err)
+
+	case errors.Is(err, status.ErrProcessed) && record.Status == status.Sent:
+		tracer.AddSpanEvent(span, "mail request already sent", map[string]string{"provider_id": record.ProviderId})
+		m.handleMailRequestResult(ctx, d, &Receipt{Provider: record.Provider, MessageId: record.ProviderId}, nil)
+
+	case errors.Is(err, status.ErrProcessed):
+		tracer.AddSpanErrorAndFail(span, err, "mail request already failed")
+		m.handleMailRequestResult(ctx, d, nil, errors.New(record.Reason))
+
+	default:
+		return false
+	}
+
+	return true
+}
+
+// applyLimits reserves the mail request sends on its tenant and recipient domain buckets, requests over the
+// limit are delayed on the queue until the time their sends were reserved at, returning true. the reservation
+// is kept so the next requests are reserved after it, a backlog is delayed by longer delay tiers instead of
+// every request retrying on the shortest one. delayed requests are not reserved again once consumed, requests
+// canceled before being delayed are answered and the ones that could not be delayed are requeued
+func (m *Mailer) applyLimits(ctx context.Context, d *amqp091.Delivery, dto *SendEmailDto) bool {
+	now := time.Now()
+
+	// delayed requests are consumed once their delay tier expires, which may be before their reserved sends
+	// (eg: a delay over the longest tier), they are delayed again by the remaining time
+	if scheduled, ok := scheduledAt(d); ok {
+		if !now.Before(scheduled) {
+			return false
+		}
+
+		return m.delayUntilScheduled(ctx, d, dto, scheduled.Sub(now), scheduled, nil)
+	}
+
+	recipients := make([]Address, 0, len(dto.To)+len(dto.Cc)+len(dto.Bcc))
+	recipients = append(recipients, dto.To...)
+	recipients = append(recipients, dto.Cc...)
+	recipients = append(recipients, dto.Bcc...)
+
+	reservation := m.limits.reserve(dto.Tenant, recipients)
+
+	now = time.Now()
+
+	delay := reservation.delay(now)
+	if delay <= 0 {
+		return false
+	}
+
+	return m.delayUntilScheduled(ctx, d, dto, delay, now.Add(delay), reservation)
+}
+
+// delayUntilScheduled delays the request, canceling its reservation if it will not be sent at the reserved time
+func (m *Mailer) delayUntilScheduled(ctx context.Context, d *amqp091.Delivery, dto *SendEmailDto, delay time.Duration, scheduled time.Time, r reservation) bool {
+	err := m.delayRequest(ctx, d, dto.Uuid, delay, scheduled)
+	if err == nil {
+		return true
+	}
+
+	r.cancel(time.Now())
+
+	if errors.Is(err, status.ErrCanceled) {
+		m.handleMailRequestResult(ctx, d, nil, err)
+		return true
+	}
+
+	// the request is reserved again once consumed
+	m.requeue(ctx, d)
+
+	return true
+}
+
+// errPaused is returned for the mail requests that were consumed before the consumption was paused
+var errPaused = errors.New("mail requests consumption paused")
+
+// requeue returns the mail request to the queue, to be sent once the mail requests consumption is resumed
+func (m *Mailer) requeue(ctx context.Context, d *amqp091.Delivery) {
+	tracer.AddSpanEvent(tracer.SpanFromContext(ctx), "mail request requeued", nil)
+
+	if err := m.queue.Requeue(ctx, d); err != nil {
+		tracer.AddSpanError(tracer.SpanFromContext(ctx), fmt.Errorf("failed to requeue mail request: %w", err))
+	}
+}
+
+// archiveMessage stores the final version of the message on the archive, if enabled
+func (m *Mailer) archiveMessage(ctx context.Context, msg *Message, receipt *Receipt, failure error) {
+	if m.archive == nil {
 		return
 	}
 
-	m.handleMailRequestResult(ctx, d, nil)
+	entry := archive.Entry{
+		Uuid:     msg.Uuid,
+		From:     msg.Source,
+		To:       msg.To,
+		Cc:       msg.Cc,
+		Bcc:      msg.Bcc,
+		ReplyTo:  msg.ReplyTo,
+		Subject:  msg.Subject,
+		BodyHtml: msg.Html,
+		BodyText: msg.Text,
+		Success:  failure == nil,
+	}
+
+	if receipt != nil {
+		entry.Provider = receipt.Provider
+		entry.ProviderId = receipt.MessageId
+	}
+
+	if msg.Template != nil {
+		entry.Template = msg.Template.Name + msg.Template.Arn
+	}
+
+	if len(msg.Headers) > 0 {
+		entry.Headers = make(map[string]string, len(msg.Headers))
+
+		for _, h := range msg.Headers {
+			entry.Headers[h.Name] = h.Value
+		}
+	}
+
+	if failure != nil {
+		entry.Error = failure.Error()
+	}
+
+	if err := m.archive.Store(entry); err != nil {
+		tracer.AddSpanError(tracer.SpanFromContext(ctx), fmt.Errorf("failed to archive message: %w", err))
+	}
 }
 
-func (m *Mailer) sendWithRetry(ctx context.Context, currentAttempt int, emailInput *ses.SendEmailInput) error {
+// failMailRequest stores the failed status of the mail request and publishes the failure result
+func (m *Mailer) failMailRequest(ctx context.Context, d *amqp091.Delivery, uuid string, attempt int, failure error) {
+	m.setStatus(ctx, uuid, status.Failed, attempt, failure.Error(), "")
+	m.handleMailRequestResult(ctx, d, nil, failure)
+}
+
+// sendWithRetry sends the email, retrying on failures, returning the receipt
+// of the provider that sent it and the number of the last send attempt
+func (m *Mailer) sendWithRetry(ctx context.Context, currentAttempt int, msg *Message) (*Receipt, int, error) {
 	ctx, span := tracer.NewSpan(ctx, "mail", "SendWithRetry")
 	defer span.End()
 
-	span.SetAttributes(attribute.Key("recipient").String(emailInput.Destination.ToAddresses[0]))
-	span.SetAttributes(attribute.Key("subject").String(*emailInput.Message.Subject.Data))
+	span.SetAttributes(attribute.Key("recipient").String(msg.recipients()[0]))
+	span.SetAttributes(attribute.Key("subject").String(msg.Subject))
 	span.SetAttributes(attribute.Key("attempt").Int(currentAttempt))
 
-	m.rateLimiter.Wait(ctx)
+	if err := m.checkQuota(ctx); err != nil {
+		tracer.AddSpanError(span, err)
+		return nil, currentAttempt, err
+	}
+
+	// requests consumed before the consumption was paused are requeued instead of sent
+	if m.queue.Paused() {
+		tracer.AddSpanEvent(span, "mail requests consumption paused", nil)
+		return nil, currentAttempt, errPaused
+	}
+
+	if err := m.rateLimiter.Wait(ctx); err != nil {
+		tracer.AddSpanError(span, err)
+		return nil, currentAttempt, fmt.Errorf("%w: %v", errRateLimitWait, err)
+	}
+
+	span.SetAttributes(attribute.Key("effective_rate").Float64(float64(m.rateLimiter.Limit())))
 
-	_, sesError := m.client.SendEmail(ctx, emailInput)
+	// leave the retrying status before sending, so the request can no longer be canceled
+	if err := m.setStatus(ctx, msg.Uuid, status.Queued, currentAttempt, "", ""); err != nil {
+		tracer.AddSpanErrorAndFail(span, err, "mail request was canceled")
+		return nil, currentAttempt, err
+	}
+
+	receipt, sesError := m.send(ctx, msg)
+
+	if errors.Is(sesError, errBreakerOpen) {
+		tracer.AddSpanError(span, sesError)
+		return nil, currentAttempt, sesError
+	}
 
 	if sesError == nil {
+		m.rateLimiter.OnSuccess()
 		span.SetStatus(codes.Ok, "email sent successfully")
-		return nil
+		return receipt, currentAttempt, nil
+	}
+
+	if isThrottlingError(sesError) {
+		m.rateLimiter.OnThrottled()
+		span.SetAttributes(attribute.Key("throttled").Bool(true))
 	}
 
 	if currentAttempt > m.cfg.Mail.MaxRetryAttempts {
 		tracer.AddSpanErrorAndFail(span, sesError, fmt.Sprintf("MAX_SES_RETRY_ATTEMPTS of: %d reached", m.cfg.Mail.MaxRetryAttempts))
-		return sesError
+		return nil, currentAttempt, sesError
 	}
 
 	span.RecordError(sesError)
 
+	if err := m.setStatus(ctx, msg.Uuid, status.Retrying, currentAttempt, sesError.Error(), ""); err != nil {
+		return nil, currentAttempt, err
+	}
+
 	time.Sleep(time.Duration(m.cfg.Mail.RetryWaitTime) * time.Second)
 
-	return m.sendWithRetry(ctx, currentAttempt+1, emailInput)
+	return m.sendWithRetry(ctx, currentAttempt+1, msg)
 }
@@ -0,0 +1,71 @@
+package mail
+
+import (
+	"encoding/json"
+	"mailer-ms/mocks"
+	"mailer-ms/status"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func newTestStatusStore(t *testing.T) status.Store {
+	t.Helper()
+
+	store, err := status.NewBoltStore(filepath.Join(t.TempDir(), "status.db"))
+	if err != nil {
+		t.Fatalf("failed to open status store: %v", err)
+	}
+
+	t.Cleanup(func() { store.Close() })
+
+	return store
+}
+
+func TestHandleMailRequestDeliveryDoesNotResendFinalRequests(t *testing.T) {
+	tests := []struct {
+		name    string
+		stored  status.MailStatus
+		wantAck bool
+	}{
+		{name: "sent request is acked", stored: status.Sent, wantAck: true},
+		{name: "failed request is rejected", stored: status.Failed},
+		{name: "canceled request is rejected", stored: status.Canceled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			acknowledger := mocks.NewMockAcknowledger(ctrl)
+
+			if tt.wantAck {
+				acknowledger.EXPECT().Ack(gomock.Any(), false).Return(nil)
+			} else {
+				acknowledger.EXPECT().Reject(gomock.Any(), false).Return(nil)
+			}
+
+			store := newTestStatusStore(t)
+			uuid := "2221e2de-7385-433a-ac63-21ce013a6436"
+
+			store.Update(uuid, func(r *status.Record) error {
+				r.Status = tt.stored
+				r.ProviderId = "provider-id"
+				return nil
+			})
+
+			// the mailer has no sender, so the test panics if the request is sent again
+			m := &Mailer{status: store}
+
+			body, _ := json.Marshal(SendEmailDto{Uuid: uuid})
+			m.HandleMailRequestDelivery(&amqp091.Delivery{Acknowledger: acknowledger, Body: body})
+
+			record, _ := store.Get(uuid)
+
+			if record.Status != tt.stored || record.ProviderId != "provider-id" {
+				t.Fatalf("expected the stored record to be kept, got %+v", record)
+			}
+		})
+	}
+}
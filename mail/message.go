@@ -0,0 +1,267 @@
+package mail
+
+import (
+	"fmt"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// Headers that are set by the mailer and cannot be overwritten by custom headers
+var protectedHeaders = map[string]bool{
+	"From":                      true,
+	"Sender":                    true,
+	"To":                        true,
+	"Cc":                        true,
+	"Bcc":                       true,
+	"Reply-To":                  true,
+	"Subject":                   true,
+	"Date":                      true,
+	"Message-Id":                true,
+	"Return-Path":               true,
+	"Received":                  true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+	"Dkim-Signature":            true,
+	"List-Unsubscribe":          true,
+	"List-Unsubscribe-Post":     true,
+}
+
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Message is a validated mail request with its addresses formatted, ready to be sent
+type Message struct {
+	Uuid    string
+	Source  string
+	To      []string
+	Cc      []string
+	Bcc     []string
+	ReplyTo []string
+	Subject string
+	Html    string
+	Text    string
+
+	// Custom headers, only set on raw messages
+	Headers []Header
+
+	ConfigurationSet string
+	Tags             []Tag
+
+	// Selects the providers the message can be routed to
+	Category string
+
+	// SES template to render the email with instead of the subject and bodies, sesv2 only
+	Template *TemplateContent
+
+	// SES contact list management options, sesv2 only
+	ListManagement *ListManagement
+
+	// SES tenant to send the message through, sesv2 only
+	SesTenant string
+
+	// signs the raw message, if there is a key for the source domain
+	dkim *dkimSigner
+}
+
+type Tag struct {
+	Name  string
+	Value string
+}
+
+// needsRaw returns if the message can only be sent as a raw message, since the
+// simple send operations do not support custom headers nor DKIM signatures
+func (msg *Message) needsRaw() bool {
+	return len(msg.Headers) > 0 || msg.dkim.canSign(msg.Source)
+}
+
+// needsSesV2 returns if the message uses options only supported by the sesv2 api
+func (msg *Message) needsSesV2() bool {
+	return msg.Template != nil || msg.ListManagement != nil || msg.SesTenant != ""
+}
+
+// recipients returns every address the message should be delivered to
+func (msg *Message) recipients() []string {
+	recipients := make([]string, 0, len(msg.To)+len(msg.Cc)+len(msg.Bcc))
+	recipients = append(recipients, msg.To...)
+	recipients = append(recipients, msg.Cc...)
+
+	return append(recipients, msg.Bcc...)
+}
+
+// newMessage creates a message from a validated mail request
+func (m *Mailer) newMessage(dto *SendEmailDto) (*Message, error) {
+	var err error
+
+	msg := &Message{
+		Uuid:             dto.Uuid,
+		Subject:          dto.SubjectText,
+		Html:             dto.BodyHtml,
+		Text:             dto.BodyText,
+		ConfigurationSet: m.cfg.Mail.ConfigurationSet,
+		Category:         dto.Category,
+		Template:         dto.Template,
+		ListManagement:   dto.ListManagement,
+		SesTenant:        dto.SesTenant,
+		dkim:             m.dkim,
+	}
+
+	if dto.ConfigurationSet != "" {
+		msg.ConfigurationSet = dto.ConfigurationSet
+	}
+
+	if msg.Tags, err = messageTags(dto); err != nil {
+		return nil, err
+	}
+
+	if msg.Source, err = m.source(dto.From); err != nil {
+		return nil, err
+	}
+
+	if msg.To, err = formatAddresses(dto.To); err != nil {
+		return nil, err
+	}
+
+	if msg.Cc, err = formatAddresses(dto.Cc); err != nil {
+		return nil, err
+	}
+
+	if msg.Bcc, err = formatAddresses(dto.Bcc); err != nil {
+		return nil, err
+	}
+
+	if msg.ReplyTo, err = formatAddresses(dto.ReplyToAddresses); err != nil {
+		return nil, err
+	}
+
+	if msg.Headers, err = customHeaders(dto); err != nil {
+		return nil, err
+	}
+
+	if msg.Template != nil {
+		if len(msg.Headers) > 0 {
+			return nil, fmt.Errorf("custom headers cannot be set on template emails")
+		}
+
+		if dto.Tracking != nil {
+			return nil, fmt.Errorf("tracking is not supported on template emails")
+		}
+
+		return msg, nil
+	}
+
+	if msg.Html, err = m.content.process(msg.Html); err != nil {
+		return nil, fmt.Errorf("failed to process html body: %w", err)
+	}
+
+	if msg.Text == "" && m.cfg.Mail.GenerateText {
+		if msg.Text, err = htmlToText(msg.Html); err != nil {
+			return nil, fmt.Errorf("failed to generate text body: %w", err)
+		}
+	}
+
+	// the links are rewritten after generating the text body, so it keeps the original links
+	if t := dto.Tracking; t != nil && (t.Opens || t.Clicks) {
+		if msg.Html, err = m.tracker.Rewrite(msg.Html, msg.Uuid, t.Opens, t.Clicks); err != nil {
+			return nil, fmt.Errorf("failed to add tracking: %w", err)
+		}
+	}
+
+	return msg, nil
+}
+
+// messageTags returns the mail request tags ordered by name, with the reserved mail uuid tag first
+func messageTags(dto *SendEmailDto) ([]Tag, error) {
+	tags := make([]Tag, 0, len(dto.Tags)+1)
+
+	for name, value := range dto.Tags {
+		if name == mailUuidTag {
+			return nil, fmt.Errorf("tag %s is reserved", mailUuidTag)
+		}
+
+		tags = append(tags, Tag{name, value})
+	}
+
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+
+	return append([]Tag{{mailUuidTag, dto.Uuid}}, tags...), nil
+}
+
+// customHeaders validates the custom headers and the list unsubscribe options of
+// a mail request, returning the headers to be set, ordered by name
+func customHeaders(dto *SendEmailDto) ([]Header, error) {
+	headers := make([]Header, 0, len(dto.Headers)+2)
+
+	for name, value := range dto.Headers {
+		if !isValidHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name: %q", name)
+		}
+
+		name = textproto.CanonicalMIMEHeaderKey(name)
+
+		if protectedHeaders[name] || strings.HasPrefix(name, "X-Ses-") {
+			return nil, fmt.Errorf("header %s cannot be set", name)
+		}
+
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("header %s value contains line breaks", name)
+		}
+
+		headers = append(headers, Header{name, value})
+	}
+
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+
+	if unsubscribe := dto.ListUnsubscribe; unsubscribe != nil {
+		var targets []string
+
+		if unsubscribe.Url != "" {
+			targets = append(targets, "<"+unsubscribe.Url+">")
+		}
+
+		if unsubscribe.Mailto != "" {
+			targets = append(targets, "<mailto:"+unsubscribe.Mailto+">")
+		}
+
+		headers = append(headers, Header{"List-Unsubscribe", strings.Join(targets, ", ")})
+
+		// RFC 8058: one click unsubscribe requires a https url to receive the POST request
+		if unsubscribe.OneClick {
+			if !strings.HasPrefix(unsubscribe.Url, "https://") {
+				return nil, fmt.Errorf("one click unsubscribe requires a https url")
+			}
+
+			headers = append(headers, Header{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"})
+		}
+	}
+
+	// headers are folded on their spaces, so a word too long for a line cannot be folded
+	for _, h := range headers {
+		for _, word := range strings.Split(h.Value, " ") {
+			if len(h.Name)+len(": ")+len(word) > maxLineLength {
+				return nil, fmt.Errorf("header %s contains a value longer than %d characters without spaces", h.Name, maxLineLength)
+			}
+		}
+	}
+
+	return headers, nil
+}
+
+// isValidHeaderName checks if a header name contains only printable
+// US-ASCII characters other than the colon, as defined by RFC 5322
+func isValidHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		if c < 33 || c > 126 || c == ':' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,94 @@
+package mail
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCustomHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		dto     SendEmailDto
+		want    []Header
+		wantErr bool
+	}{
+		{
+			name: "headers are canonicalized and ordered by name",
+			dto:  SendEmailDto{Headers: map[string]string{"x-priority": "1", "X-Campaign-Id": "abc"}},
+			want: []Header{{"X-Campaign-Id", "abc"}, {"X-Priority", "1"}},
+		},
+		{
+			name:    "protected header",
+			dto:     SendEmailDto{Headers: map[string]string{"subject": "hijacked"}},
+			wantErr: true,
+		},
+		{
+			name:    "list unsubscribe cannot be set as a custom header",
+			dto:     SendEmailDto{Headers: map[string]string{"List-Unsubscribe": "<https://evil.com>"}},
+			wantErr: true,
+		},
+		{
+			name:    "ses header",
+			dto:     SendEmailDto{Headers: map[string]string{"X-SES-CONFIGURATION-SET": "other"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid header name",
+			dto:     SendEmailDto{Headers: map[string]string{"X Priority": "1"}},
+			wantErr: true,
+		},
+		{
+			name:    "header injection",
+			dto:     SendEmailDto{Headers: map[string]string{"X-Priority": "1\r\nBcc: victim@wayne.com"}},
+			wantErr: true,
+		},
+		{
+			name: "long header values are accepted to be folded",
+			dto:  SendEmailDto{Headers: map[string]string{"X-Tags": strings.Repeat("tag ", 300)}},
+			want: []Header{{"X-Tags", strings.Repeat("tag ", 300)}},
+		},
+		{
+			name:    "header value that cannot be folded",
+			dto:     SendEmailDto{Headers: map[string]string{"X-Tags": strings.Repeat("t", 995)}},
+			wantErr: true,
+		},
+		{
+			name:    "list unsubscribe url that cannot be folded",
+			dto:     SendEmailDto{ListUnsubscribe: &ListUnsubscribe{Url: "https://rastercar.com/unsubscribe?token=" + strings.Repeat("a", 1000)}},
+			wantErr: true,
+		},
+		{
+			name: "list unsubscribe url and mailto",
+			dto:  SendEmailDto{ListUnsubscribe: &ListUnsubscribe{Url: "http://rastercar.com/unsubscribe", Mailto: "unsubscribe@rastercar.com"}},
+			want: []Header{{"List-Unsubscribe", "<http://rastercar.com/unsubscribe>, <mailto:unsubscribe@rastercar.com>"}},
+		},
+		{
+			name: "one click list unsubscribe",
+			dto:  SendEmailDto{ListUnsubscribe: &ListUnsubscribe{Url: "https://rastercar.com/unsubscribe", OneClick: true}},
+			want: []Header{
+				{"List-Unsubscribe", "<https://rastercar.com/unsubscribe>"},
+				{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"},
+			},
+		},
+		{
+			name:    "one click list unsubscribe requires https",
+			dto:     SendEmailDto{ListUnsubscribe: &ListUnsubscribe{Url: "http://rastercar.com/unsubscribe", OneClick: true}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := customHeaders(&tt.dto)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
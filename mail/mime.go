@@ -0,0 +1,123 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Raw builds the raw message, signed if there is a DKIM key for the sender domain
+func (msg *Message) Raw() ([]byte, error) {
+	raw, err := msg.raw()
+	if err != nil {
+		return nil, err
+	}
+
+	return msg.dkim.sign(msg.Source, raw)
+}
+
+// raw builds the RFC 5322 message, with a multipart/alternative body containing
+// the text and html versions of the email encoded as quoted-printable, the bcc
+// addresses are not written to the headers and must be set as destinations
+func (msg *Message) raw() ([]byte, error) {
+	var buf bytes.Buffer
+
+	body := multipart.NewWriter(&buf)
+
+	writeHeader(&buf, "From", msg.Source)
+	writeHeader(&buf, "To", strings.Join(msg.To, ", "))
+	writeHeader(&buf, "Cc", strings.Join(msg.Cc, ", "))
+	writeHeader(&buf, "Reply-To", strings.Join(msg.ReplyTo, ", "))
+	writeHeader(&buf, "Subject", mime.QEncoding.Encode(utf8, msg.Subject))
+	writeHeader(&buf, "Date", time.Now().Format(time.RFC1123Z))
+	writeHeader(&buf, "Message-Id", msg.messageId())
+	writeHeader(&buf, "MIME-Version", "1.0")
+
+	for _, h := range msg.Headers {
+		writeHeader(&buf, h.Name, mime.QEncoding.Encode(utf8, h.Value))
+	}
+
+	writeHeader(&buf, "Content-Type", "multipart/alternative; boundary="+body.Boundary())
+	buf.WriteString("\r\n")
+
+	if msg.Text != "" {
+		if err := writePart(body, "text/plain", msg.Text); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writePart(body, "text/html", msg.Html); err != nil {
+		return nil, err
+	}
+
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// messageId returns a unique message id on the sender domain, eg: <uuid@rastercar.com>
+func (msg *Message) messageId() string {
+	domain := "localhost"
+
+	if source, err := mail.ParseAddress(msg.Source); err == nil {
+		domain = source.Address[strings.LastIndex(source.Address, "@")+1:]
+	}
+
+	return fmt.Sprintf("<%s@%s>", msg.Uuid, domain)
+}
+
+// Max length of a line of a message, without the line break, and the length headers are folded at (RFC 5322)
+const (
+	maxLineLength  = 998
+	foldLineLength = 78
+)
+
+// writeHeader writes the header folded on the spaces of its value, so its lines are within the fold line
+// length where possible, the words of the value must fit a line (validated with the custom headers)
+func writeHeader(buf *bytes.Buffer, name, value string) {
+	if value == "" {
+		return
+	}
+
+	line := len(name) + len(": ")
+	buf.WriteString(name + ":")
+
+	for i, word := range strings.Split(value, " ") {
+		// the space of a folded line is the first character of the next line
+		if i > 0 && line+len(" ")+len(word) > foldLineLength {
+			buf.WriteString("\r\n")
+			line = 0
+		}
+
+		buf.WriteString(" " + word)
+		line += len(" ") + len(word)
+	}
+
+	buf.WriteString("\r\n")
+}
+
+func writePart(w *multipart.Writer, contentType, content string) error {
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType + "; charset=" + utf8},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+
+	qp := quotedprintable.NewWriter(part)
+
+	if _, err := qp.Write([]byte(content)); err != nil {
+		return err
+	}
+
+	return qp.Close()
+}
@@ -0,0 +1,183 @@
+package mail
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestMessageRaw(t *testing.T) {
+	tests := []struct {
+		name      string
+		msg       Message
+		wantParts map[string]string
+	}{
+		{
+			name: "text and html",
+			msg: Message{
+				Uuid:    "uuid",
+				Source:  `"Rastercar" <noreply@rastercar.com>`,
+				To:      []string{"bruce@wayne.com", "alfred@wayne.com"},
+				Cc:      []string{"lucius@wayne.com"},
+				Bcc:     []string{"secret@wayne.com"},
+				Subject: "Relatório mensal",
+				Html:    "<p>Olá</p>",
+				Text:    "Olá",
+				Headers: []Header{{"X-Campaign-Id", "abc"}, {"List-Unsubscribe", "<https://rastercar.com/unsubscribe>"}},
+			},
+			wantParts: map[string]string{"text/plain": "Olá", "text/html": "<p>Olá</p>"},
+		},
+		{
+			name:      "without text part",
+			msg:       Message{Uuid: "uuid", Source: "noreply@rastercar.com", To: []string{"bruce@wayne.com"}, Subject: "Hi", Html: "<p>Hi</p>"},
+			wantParts: map[string]string{"text/html": "<p>Hi</p>"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := tt.msg.Raw()
+			if err != nil {
+				t.Fatalf("failed to build raw message: %v", err)
+			}
+
+			parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+			if err != nil {
+				t.Fatalf("failed to parse raw message: %v", err)
+			}
+
+			if got := parsed.Header.Get("From"); got != tt.msg.Source {
+				t.Errorf("expected From %q, got %q", tt.msg.Source, got)
+			}
+
+			if got := parsed.Header.Get("To"); got != strings.Join(tt.msg.To, ", ") {
+				t.Errorf("expected To %q, got %q", strings.Join(tt.msg.To, ", "), got)
+			}
+
+			if got := parsed.Header.Get("Bcc"); got != "" {
+				t.Errorf("expected no Bcc header, got %q", got)
+			}
+
+			if subject, _ := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject")); subject != tt.msg.Subject {
+				t.Errorf("expected Subject %q, got %q", tt.msg.Subject, subject)
+			}
+
+			if got := parsed.Header.Get("Message-Id"); got != "<uuid@rastercar.com>" {
+				t.Errorf("expected Message-Id on the sender domain, got %q", got)
+			}
+
+			for _, h := range tt.msg.Headers {
+				if got := parsed.Header.Get(h.Name); got != h.Value {
+					t.Errorf("expected header %s to be %q, got %q", h.Name, h.Value, got)
+				}
+			}
+
+			mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+			if err != nil || mediaType != "multipart/alternative" {
+				t.Fatalf("expected a multipart/alternative body, got %q: %v", mediaType, err)
+			}
+
+			parts := map[string]string{}
+			reader := multipart.NewReader(parsed.Body, params["boundary"])
+
+			for {
+				part, err := reader.NextRawPart()
+				if err == io.EOF {
+					break
+				}
+
+				if err != nil {
+					t.Fatalf("failed to read part: %v", err)
+				}
+
+				if encoding := part.Header.Get("Content-Transfer-Encoding"); encoding != "quoted-printable" {
+					t.Errorf("expected quoted-printable part, got %q", encoding)
+				}
+
+				content, _ := io.ReadAll(quotedprintable.NewReader(part))
+				contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+
+				parts[contentType] = string(content)
+			}
+
+			if len(parts) != len(tt.wantParts) {
+				t.Fatalf("expected parts %v, got %v", tt.wantParts, parts)
+			}
+
+			for contentType, want := range tt.wantParts {
+				if parts[contentType] != want {
+					t.Errorf("expected %s part %q, got %q", contentType, want, parts[contentType])
+				}
+			}
+		})
+	}
+}
+
+func TestNeedsRaw(t *testing.T) {
+	if (&Message{Source: "noreply@rastercar.com"}).needsRaw() {
+		t.Error("expected a message without custom headers nor dkim key to not need a raw message")
+	}
+
+	if !(&Message{Source: "noreply@rastercar.com", Headers: []Header{{"X-Priority", "1"}}}).needsRaw() {
+		t.Error("expected a message with custom headers to need a raw message")
+	}
+}
+
+func TestWriteHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "empty value is not written", value: "", want: ""},
+		{name: "short value", value: "1", want: "X-Priority: 1\r\n"},
+		{
+			name:  "long value is folded on its spaces",
+			value: strings.Repeat("word ", 20) + "end",
+			want: "X-Priority: " + strings.TrimSuffix(strings.Repeat("word ", 13), " ") + "\r\n" +
+				strings.Repeat(" word", 7) + " end\r\n",
+		},
+		{
+			name:  "long word is kept on its own line",
+			value: "<mailto:unsubscribe@rastercar.com>, <https://rastercar.com/unsubscribe?token=" + strings.Repeat("a", 80) + ">",
+			want: "X-Priority: <mailto:unsubscribe@rastercar.com>,\r\n" +
+				" <https://rastercar.com/unsubscribe?token=" + strings.Repeat("a", 80) + ">\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			writeHeader(&buf, "X-Priority", tt.value)
+
+			if buf.String() != tt.want {
+				t.Fatalf("expected the header %q, got %q", tt.want, buf.String())
+			}
+
+			// unfolding the header gives back the value
+			if tt.value != "" {
+				unfolded := strings.TrimSuffix(strings.ReplaceAll(buf.String(), "\r\n ", " "), "\r\n")
+
+				if unfolded != "X-Priority: "+tt.value {
+					t.Errorf("expected the unfolded header to keep the value, got %q", unfolded)
+				}
+			}
+
+			for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n") {
+				if len(line) > foldLineLength && !strings.Contains(strings.TrimSpace(line), " ") {
+					continue
+				}
+
+				if len(line) > foldLineLength {
+					t.Errorf("expected a line of at most %d characters, got %d: %q", foldLineLength, len(line), line)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mailer-ms/config"
+	"mailer-ms/tracer"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type SendQuota struct {
+	// The maximum number of emails that can be sent per second
+	MaxSendRate float64
+
+	// The maximum number of emails that can be sent in 24 hours, -1 means unlimited
+	Max24HourSend float64
+
+	// The number of emails sent in the last 24 hours
+	SentLast24Hours float64
+}
+
+// Pause reason of the mail requests consumption while the daily send quota is nearly exhausted
+const quotaPause = "send quota exhausted"
+
+var errQuotaExhausted = errors.New("daily send quota exhausted")
+
+// QuotaProvider is implemented by the senders whose provider has a send quota
+type QuotaProvider interface {
+	SendQuota(ctx context.Context) (*SendQuota, error)
+}
+
+// QuotaState is the last send quota fetched from the provider
+type QuotaState struct {
+	MaxSendRate     float64   `json:"max_send_rate"`
+	Max24HourSend   float64   `json:"max_24_hour_send"`
+	SentLast24Hours float64   `json:"sent_last_24_hours"`
+	Exhausted       bool      `json:"exhausted"`
+	RefreshedAt     time.Time `json:"refreshed_at"`
+}
+
+// quotaGate holds the last send quota, the sends are refused while the daily quota is nearly exhausted
+type quotaGate struct {
+	mu    sync.Mutex
+	state *QuotaState
+}
+
+func newQuotaGate() *quotaGate {
+	return &quotaGate{}
+}
+
+func (g *quotaGate) exhausted() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.state != nil && g.state.Exhausted
+}
+
+func (g *quotaGate) set(state QuotaState) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.state = &state
+}
+
+// get returns a copy of the last send quota, nil if it was never fetched
+func (g *quotaGate) get() *QuotaState {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.state == nil {
+		return nil
+	}
+
+	state := *g.state
+
+	return &state
+}
+
+// QuotaState returns the last send quota fetched from the provider, nil if the quota discovery is disabled
+func (m *Mailer) QuotaState() *QuotaState {
+	return m.quota.get()
+}
+
+// quotaDiscoveryEnabled returns if the send quota is discovered, only the SES senders of the default
+// region have a send quota, since the quota of routed providers is not shared between them
+func quotaDiscoveryEnabled(cfg *config.Config) bool {
+	return cfg.Mail.QuotaRefreshInterval > 0 && len(cfg.Routing.Providers) == 0
+}
+
+// StartQuotaDiscovery periodically fetches the send quota of the provider, setting the rate limit
+// to its max send rate and pausing the sending while the daily quota is nearly exhausted, until
+// the context is done. It does nothing if the sender has no quota or discovery is disabled
+func (m *Mailer) StartQuotaDiscovery(ctx context.Context) {
+	provider, ok := m.sender.(QuotaProvider)
+
+	if !ok || m.cfg.Mail.QuotaRefreshInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(m.cfg.Mail.QuotaRefreshInterval) * time.Second)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			m.refreshQuota(ctx, provider)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (m *Mailer) refreshQuota(ctx context.Context, provider QuotaProvider) {
+	ctx, span := tracer.NewSpan(ctx, "mail", "RefreshQuota")
+	defer span.End()
+
+	quota, err := provider.SendQuota(ctx)
+	if err != nil {
+		log.Printf("[ MAIL ] failed to fetch send quota: %v", err)
+		tracer.AddSpanErrorAndFail(span, err, "failed to fetch send quota")
+		return
+	}
+
+	tracer.AddSpanEvent(span, "quota", map[string]string{
+		"max_send_rate":      fmt.Sprintf("%.2f", quota.MaxSendRate),
+		"max_24_hour_send":   fmt.Sprintf("%.0f", quota.Max24HourSend),
+		"sent_last_24_hours": fmt.Sprintf("%.0f", quota.SentLast24Hours),
+	})
+
+	if limit := rate.Limit(quota.MaxSendRate); quota.MaxSendRate > 0 && limit != m.rateLimiter.Ceiling() {
+		log.Printf("[ MAIL ] send rate limit changed from %.2f to %.2f emails per second", m.rateLimiter.Ceiling(), limit)
+		m.rateLimiter.SetCeiling(limit)
+	}
+
+	exhausted := quota.Max24HourSend >= 0 && quota.SentLast24Hours >= quota.Max24HourSend*m.cfg.Mail.QuotaPauseThreshold
+	wasExhausted := m.quota.exhausted()
+
+	m.quota.set(QuotaState{
+		MaxSendRate:     quota.MaxSendRate,
+		Max24HourSend:   quota.Max24HourSend,
+		SentLast24Hours: quota.SentLast24Hours,
+		Exhausted:       exhausted,
+		RefreshedAt:     time.Now(),
+	})
+
+	if exhausted && !wasExhausted {
+		log.Printf("[ MAIL ] daily send quota nearly exhausted (%.0f of %.0f sent), sending paused", quota.SentLast24Hours, quota.Max24HourSend)
+
+		if err := m.queue.Pause(quotaPause); err != nil {
+			log.Printf("[ MAIL ] failed to pause mail requests consumption: %v", err)
+		}
+	}
+
+	if !exhausted && wasExhausted {
+		log.Printf("[ MAIL ] daily send quota available (%.0f of %.0f sent), sending resumed", quota.SentLast24Hours, quota.Max24HourSend)
+
+		if err := m.queue.Resume(quotaPause); err != nil {
+			log.Printf("[ MAIL ] failed to resume mail requests consumption: %v", err)
+		}
+	}
+}
+
+// checkQuota returns errQuotaExhausted while the daily send quota is nearly exhausted, so
+// the mail requests consumed before the consumption was paused are requeued instead of sent
+func (m *Mailer) checkQuota(ctx context.Context) error {
+	if !m.quota.exhausted() {
+		return nil
+	}
+
+	tracer.AddSpanEvent(tracer.SpanFromContext(ctx), "daily send quota exhausted", nil)
+
+	return errQuotaExhausted
+}
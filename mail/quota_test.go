@@ -0,0 +1,180 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"mailer-ms/config"
+	"mailer-ms/mocks"
+	"mailer-ms/queue"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/rabbitmq/amqp091-go"
+	"golang.org/x/time/rate"
+)
+
+// fakeQuotaProvider returns the quota set on it
+type fakeQuotaProvider struct {
+	quota *SendQuota
+	err   error
+}
+
+func (f *fakeQuotaProvider) SendQuota(ctx context.Context) (*SendQuota, error) {
+	return f.quota, f.err
+}
+
+func newQuotaMailer(threshold float64) *Mailer {
+	cfg := &config.Config{Mail: config.MailConfig{QuotaPauseThreshold: threshold}}
+
+	return &Mailer{
+		cfg:         cfg,
+		queue:       &queue.Server{},
+		quota:       newQuotaGate(),
+		rateLimiter: newAdaptiveLimiter(cfg.Mail, rate.NewLimiter(1, 1)),
+	}
+}
+
+func TestRefreshQuota(t *testing.T) {
+	tests := []struct {
+		name          string
+		quotas        []SendQuota
+		wantExhausted bool
+		wantReasons   []string
+		wantCeiling   rate.Limit
+	}{
+		{
+			name:        "quota available",
+			quotas:      []SendQuota{{MaxSendRate: 14, Max24HourSend: 1000, SentLast24Hours: 10}},
+			wantReasons: []string{},
+			wantCeiling: 14,
+		},
+		{
+			name:          "quota nearly exhausted pauses the consumption",
+			quotas:        []SendQuota{{MaxSendRate: 14, Max24HourSend: 1000, SentLast24Hours: 950}},
+			wantExhausted: true,
+			wantReasons:   []string{quotaPause},
+			wantCeiling:   14,
+		},
+		{
+			name:        "quota freed resumes the consumption",
+			quotas:      []SendQuota{{MaxSendRate: 14, Max24HourSend: 1000, SentLast24Hours: 990}, {MaxSendRate: 20, Max24HourSend: 1000, SentLast24Hours: 100}},
+			wantReasons: []string{},
+			wantCeiling: 20,
+		},
+		{
+			name:        "unlimited quota",
+			quotas:      []SendQuota{{MaxSendRate: 14, Max24HourSend: -1, SentLast24Hours: 100000}},
+			wantReasons: []string{},
+			wantCeiling: 14,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newQuotaMailer(0.95)
+
+			for i := range tt.quotas {
+				m.refreshQuota(context.Background(), &fakeQuotaProvider{quota: &tt.quotas[i]})
+			}
+
+			state := m.QuotaState()
+
+			if state == nil || state.Exhausted != tt.wantExhausted {
+				t.Fatalf("expected exhausted %v, got %+v", tt.wantExhausted, state)
+			}
+
+			if reasons := m.queue.PauseReasons(); !reflect.DeepEqual(reasons, tt.wantReasons) {
+				t.Fatalf("expected pause reasons %v, got %v", tt.wantReasons, reasons)
+			}
+
+			if ceiling := m.rateLimiter.Ceiling(); ceiling != tt.wantCeiling {
+				t.Fatalf("expected rate ceiling %v, got %v", tt.wantCeiling, ceiling)
+			}
+		})
+	}
+}
+
+func TestRefreshQuotaError(t *testing.T) {
+	m := newQuotaMailer(0.95)
+
+	m.refreshQuota(context.Background(), &fakeQuotaProvider{err: errors.New("unavailable")})
+
+	if m.QuotaState() != nil {
+		t.Fatal("expected the quota to be unknown")
+	}
+}
+
+func TestQuotaPauseThresholdValidation(t *testing.T) {
+	for _, threshold := range []float64{0, -0.5, 1.5} {
+		_, err := New(&config.Config{Mail: config.MailConfig{QuotaPauseThreshold: threshold}}, &queue.Server{}, nil, nil, nil)
+
+		if err == nil || !strings.Contains(err.Error(), "quota pause threshold") {
+			t.Errorf("expected threshold %v to be rejected, got %v", threshold, err)
+		}
+	}
+}
+
+func TestReqPerSecLimitValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int
+		interval int
+		routing  config.RoutingConfig
+		wantErr  bool
+	}{
+		{name: "limit", limit: 5},
+		{name: "no limit with quota discovery", interval: 300},
+		{name: "no limit without quota discovery", wantErr: true},
+		{
+			name:     "no limit with providers, which have no quota discovery",
+			interval: 300,
+			routing:  config.RoutingConfig{Providers: []config.ProviderConfig{{Name: "ses", Type: "ses", Weight: 1}}},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Mail: config.MailConfig{
+					SesApi:               "v1",
+					ReqPerSecLimit:       tt.limit,
+					QuotaRefreshInterval: tt.interval,
+					QuotaPauseThreshold:  0.95,
+				},
+				RateLimit: config.RateLimitConfig{Backend: "local"},
+				Routing:   tt.routing,
+			}
+
+			_, err := New(cfg, &queue.Server{}, nil, nil, nil)
+
+			if tt.wantErr != (err != nil && strings.Contains(err.Error(), "req per sec limit")) {
+				t.Fatalf("expected the req per sec limit error %v, got %v", tt.wantErr, err)
+			}
+
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestSendWithRetryRequeuesWhenQuotaExhausted(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	acknowledger := mocks.NewMockAcknowledger(ctrl)
+
+	m := newQuotaMailer(0.95)
+	m.refreshQuota(context.Background(), &fakeQuotaProvider{quota: &SendQuota{MaxSendRate: 1, Max24HourSend: 10, SentLast24Hours: 10}})
+
+	_, _, err := m.sendWithRetry(context.Background(), 1, &Message{Uuid: "uuid", To: []string{"bruce@wayne.com"}})
+
+	if !errors.Is(err, errQuotaExhausted) {
+		t.Fatalf("expected errQuotaExhausted, got %v", err)
+	}
+
+	acknowledger.EXPECT().Nack(uint64(1), false, true)
+
+	m.requeue(context.Background(), &amqp091.Delivery{Acknowledger: acknowledger, DeliveryTag: 1})
+}
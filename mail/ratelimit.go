@@ -0,0 +1,37 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mailer-ms/config"
+
+	"golang.org/x/time/rate"
+)
+
+// errRateLimitWait is returned when waiting for the send rate limit fails, the mail request is requeued
+var errRateLimitWait = errors.New("failed to wait for the send rate limit")
+
+// RateLimiter limits the rate emails are sent
+type RateLimiter interface {
+	// Wait blocks until a email can be sent or the context is done
+	Wait(ctx context.Context) error
+
+	// Limit returns the rate limit, in emails per second
+	Limit() rate.Limit
+
+	SetLimit(limit rate.Limit)
+}
+
+// newRateLimiter creates the rate limiter of the configured backend, a *rate.Limiter limiting
+// the sends of this replica or a redis limiter enforcing the limit across every replica
+func newRateLimiter(cfg config.RateLimitConfig, limit rate.Limit) (RateLimiter, error) {
+	switch cfg.Backend {
+	case "local":
+		return rate.NewLimiter(limit, 1), nil
+	case "redis":
+		return newRedisLimiter(cfg, limit)
+	}
+
+	return nil, fmt.Errorf("invalid rate limit backend: %q, expected local or redis", cfg.Backend)
+}
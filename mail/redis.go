@@ -0,0 +1,133 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mailer-ms/config"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+const redisTimeout = 2 * time.Second
+
+// redisLimiter enforces the send rate across every replica by counting the sends of each second on
+// a shared redis key, while redis is unreachable it limits the sends of this replica only, with a
+// local limiter
+type redisLimiter struct {
+	client redis.UniversalClient
+	key    string
+
+	mu       sync.Mutex
+	limit    rate.Limit
+	degraded bool
+
+	fallback *rate.Limiter
+}
+
+func newRedisLimiter(cfg config.RateLimitConfig, limit rate.Limit) (*redisLimiter, error) {
+	opts, err := redis.ParseURL(cfg.RedisUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.DialTimeout = redisTimeout
+	opts.ReadTimeout = redisTimeout
+	opts.WriteTimeout = redisTimeout
+
+	return newRedisLimiterWithClient(redis.NewClient(opts), cfg.RedisKey, limit), nil
+}
+
+func newRedisLimiterWithClient(client redis.UniversalClient, key string, limit rate.Limit) *redisLimiter {
+	return &redisLimiter{client: client, key: key, limit: limit, fallback: rate.NewLimiter(limit, 1)}
+}
+
+func (l *redisLimiter) Limit() rate.Limit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.limit
+}
+
+func (l *redisLimiter) SetLimit(limit rate.Limit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limit = limit
+	l.fallback.SetLimit(limit)
+}
+
+// budget returns how many sends the second allows, the fractional part of the limit
+// accumulates over the seconds, so a limit of 0.5 allows a send every other second
+// and a limit of 2.5 allows 2 and 3 sends on alternating seconds
+func budget(limit rate.Limit, second int64) int64 {
+	if limit <= 0 {
+		return 0
+	}
+
+	l := float64(limit)
+
+	return int64(math.Floor(float64(second+1)*l) - math.Floor(float64(second)*l))
+}
+
+// Wait counts the send on the key of the current second, waiting for the next seconds while
+// their budget is spent. the key does not depend on the limit, so replicas whose limits differ,
+// eg: while one of them is throttled, still share the same count
+func (l *redisLimiter) Wait(ctx context.Context) error {
+	for {
+		now := time.Now()
+		second := now.Unix()
+		key := fmt.Sprintf("%s:%d", l.key, second)
+
+		var incr *redis.IntCmd
+
+		_, err := l.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			incr = pipe.Incr(ctx, key)
+			pipe.Expire(ctx, key, 2*time.Second)
+			return nil
+		})
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			l.setDegraded(true, err)
+			return l.fallback.Wait(ctx)
+		}
+
+		l.setDegraded(false, nil)
+
+		if incr.Val() <= budget(l.Limit(), second) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Unix(second+1, 0).Sub(now)):
+		}
+	}
+}
+
+// setDegraded logs when the limiter starts or stops using the local fallback limiter
+func (l *redisLimiter) setDegraded(degraded bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.degraded == degraded {
+		return
+	}
+
+	l.degraded = degraded
+
+	if degraded {
+		log.Printf("[ MAIL ] redis rate limiter unavailable, limiting the sends of this replica only: %v", err)
+	} else {
+		log.Printf("[ MAIL ] redis rate limiter available again")
+	}
+}
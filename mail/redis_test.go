@@ -0,0 +1,126 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+func newTestRedisLimiter(t *testing.T, server *miniredis.Miniredis, limit rate.Limit) *redisLimiter {
+	t.Helper()
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return newRedisLimiterWithClient(client, "mail_sender:rate", limit)
+}
+
+// waitNextSecond sleeps until the start of the next second, so the sends of a test share the same window
+func waitNextSecond() {
+	now := time.Now()
+	time.Sleep(now.Truncate(time.Second).Add(time.Second).Sub(now) + 10*time.Millisecond)
+}
+
+func TestBudget(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit rate.Limit
+		want  []int64
+	}{
+		{name: "integer limit", limit: 3, want: []int64{3, 3, 3, 3}},
+		{name: "fractional limit", limit: 2.5, want: []int64{2, 3, 2, 3}},
+		{name: "limit below one per second", limit: 0.5, want: []int64{0, 1, 0, 1}},
+		{name: "zero limit", limit: 0, want: []int64{0, 0, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for second, want := range tt.want {
+				if got := budget(tt.limit, int64(second)); got != want {
+					t.Fatalf("expected a budget of %d on second %d, got %d", want, second, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRedisLimiterSharedBetweenReplicas(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	replicaA := newTestRedisLimiter(t, server, 2)
+	replicaB := newTestRedisLimiter(t, server, 2)
+
+	waitNextSecond()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	if err := replicaA.Wait(ctx); err != nil {
+		t.Fatalf("expected the first send to be allowed, got %v", err)
+	}
+
+	if err := replicaB.Wait(ctx); err != nil {
+		t.Fatalf("expected the second send to be allowed, got %v", err)
+	}
+
+	if err := replicaA.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the third send to wait for the next second, got %v", err)
+	}
+
+	if replicaA.degraded || replicaB.degraded {
+		t.Fatal("expected the limiters to use redis")
+	}
+}
+
+func TestRedisLimiterKeyDoesNotDependOnTheLimit(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	throttled := newTestRedisLimiter(t, server, 1)
+	replica := newTestRedisLimiter(t, server, 10)
+
+	waitNextSecond()
+
+	throttled.Wait(context.Background())
+	replica.Wait(context.Background())
+
+	if keys := server.Keys(); len(keys) != 1 {
+		t.Fatalf("expected the replicas to count the sends on the same key, got %v", keys)
+	}
+}
+
+func TestRedisLimiterFallsBackWhenRedisIsUnavailable(t *testing.T) {
+	server := miniredis.RunT(t)
+	limiter := newTestRedisLimiter(t, server, 100)
+
+	server.Close()
+
+	if err := limiter.Wait(context.Background()); err != nil {
+		t.Fatalf("expected the local limiter to be used, got %v", err)
+	}
+
+	if !limiter.degraded {
+		t.Fatal("expected the limiter to be degraded")
+	}
+
+	limiter.SetLimit(50)
+
+	if limiter.Limit() != 50 || limiter.fallback.Limit() != 50 {
+		t.Fatal("expected the limit to be set on the fallback limiter as well")
+	}
+}
+
+func TestRedisLimiterCanceledContext(t *testing.T) {
+	limiter := newTestRedisLimiter(t, miniredis.RunT(t), 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := limiter.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait to stop with the context, got %v", err)
+	}
+}
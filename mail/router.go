@@ -0,0 +1,217 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mailer-ms/config"
+	"mailer-ms/tracer"
+	"math/rand"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type provider struct {
+	name    string
+	kind    string
+	weight  int
+	sender  Sender
+	breaker *breaker
+}
+
+// supports returns if the provider can send the message, templates, list
+// management and tenants are only supported by the sesv2 api
+func (p *provider) supports(msg *Message) bool {
+	return !msg.needsSesV2() || p.kind == "sesv2"
+}
+
+type route struct {
+	senderDomain string
+	category     string
+	providers    []*provider
+}
+
+func (r *route) matches(msg *Message) bool {
+	if r.category != "" && r.category != msg.Category {
+		return false
+	}
+
+	return r.senderDomain == "" || strings.EqualFold(r.senderDomain, senderDomain(msg.Source))
+}
+
+// router sends messages through several providers, picked by weight among the providers of the first
+// matching route, failing over to the next provider when a send fails because of the provider
+type router struct {
+	providers []*provider
+	routes    []route
+}
+
+func newRouter(cfg *config.Config) (*router, error) {
+	if cfg.Routing.BreakerFailures < 1 || cfg.Routing.BreakerCooldown < 1 {
+		return nil, fmt.Errorf("routing breaker failures and cooldown must be positive, got: %d and %d", cfg.Routing.BreakerFailures, cfg.Routing.BreakerCooldown)
+	}
+
+	r := &router{}
+
+	byName := make(map[string]*provider, len(cfg.Routing.Providers))
+
+	for _, pc := range cfg.Routing.Providers {
+		if pc.Name == "" || byName[pc.Name] != nil {
+			return nil, fmt.Errorf("providers must have unique names, got: %q", pc.Name)
+		}
+
+		sender, err := newProviderSender(cfg, pc)
+		if err != nil {
+			return nil, err
+		}
+
+		weight := pc.Weight
+		if weight < 1 {
+			weight = 1
+		}
+
+		p := &provider{
+			name:    pc.Name,
+			kind:    pc.Type,
+			weight:  weight,
+			sender:  sender,
+			breaker: newBreaker(cfg.Routing.BreakerFailures, time.Duration(cfg.Routing.BreakerCooldown)*time.Second),
+		}
+
+		byName[p.name] = p
+		r.providers = append(r.providers, p)
+	}
+
+	for _, rule := range cfg.Routing.Rules {
+		rt := route{senderDomain: rule.SenderDomain, category: rule.Category}
+
+		for _, name := range rule.Providers {
+			p, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("routing rule references unknown provider: %q", name)
+			}
+
+			rt.providers = append(rt.providers, p)
+		}
+
+		if len(rt.providers) == 0 {
+			return nil, errors.New("routing rules must list at least one provider")
+		}
+
+		r.routes = append(r.routes, rt)
+	}
+
+	return r, nil
+}
+
+// Send sends the message with the first provider that succeeds, providers with a open circuit
+// breaker are skipped, errors caused by the message itself are returned without failing over
+func (r *router) Send(ctx context.Context, msg *Message) (*Receipt, error) {
+	span := tracer.SpanFromContext(ctx)
+
+	var errs []string
+
+	for _, p := range r.candidates(msg) {
+		if !p.breaker.allow() {
+			continue
+		}
+
+		receipt, err := p.sender.Send(ctx, msg)
+
+		if err == nil || !isProviderFailure(err) {
+			if p.breaker.success() {
+				log.Printf("[ MAIL ] provider %s recovered, circuit breaker closed", p.name)
+			}
+
+			return receipt, err
+		}
+
+		tracer.AddSpanEvent(span, "provider failed", map[string]string{"provider": p.name, "error": err.Error()})
+
+		if p.breaker.failure() {
+			log.Printf("[ MAIL ] provider %s circuit breaker open: %v", p.name, err)
+		}
+
+		errs = append(errs, fmt.Sprintf("%s: %v", p.name, err))
+	}
+
+	span.SetAttributes(attribute.Key("providers_failed").Int(len(errs)))
+
+	if len(errs) == 0 {
+		return nil, errors.New("no provider available to send the email")
+	}
+
+	return nil, fmt.Errorf("every provider failed: %s", strings.Join(errs, "; "))
+}
+
+// candidates returns the providers that can send the message, in a random order weighted by their weight
+func (r *router) candidates(msg *Message) []*provider {
+	providers := r.providers
+
+	for i := range r.routes {
+		if r.routes[i].matches(msg) {
+			providers = r.routes[i].providers
+			break
+		}
+	}
+
+	var pool []*provider
+	total := 0
+
+	for _, p := range providers {
+		if p.supports(msg) {
+			pool = append(pool, p)
+			total += p.weight
+		}
+	}
+
+	ordered := make([]*provider, 0, len(pool))
+
+	for len(pool) > 0 {
+		pick := rand.Intn(total)
+
+		for i, p := range pool {
+			if pick -= p.weight; pick < 0 {
+				ordered = append(ordered, p)
+				total -= p.weight
+				pool = append(pool[:i], pool[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return ordered
+}
+
+// isProviderFailure checks if a send error was caused by the provider, like outages, throttling
+// or network errors, rather than by the message, like rejected messages or invalid addresses
+func isProviderFailure(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorFault() != smithy.FaultClient || throttlingErrorCodes[apiErr.ErrorCode()]
+	}
+
+	// SMTP permanent failures (5xx) are caused by the message, transient ones (4xx) by the relay
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code < 500
+	}
+
+	return true
+}
+
+// senderDomain returns the domain of the source address
+func senderDomain(source string) string {
+	address, err := mail.ParseAddress(source)
+	if err != nil {
+		return ""
+	}
+
+	return address.Address[strings.LastIndex(address.Address, "@")+1:]
+}
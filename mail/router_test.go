@@ -0,0 +1,297 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"mailer-ms/config"
+	"net/textproto"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+// fakeSender returns the error set on it, recording how many messages it was asked to send
+type fakeSender struct {
+	name  string
+	err   error
+	calls int
+}
+
+func (f *fakeSender) Send(ctx context.Context, msg *Message) (*Receipt, error) {
+	f.calls++
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	return &Receipt{f.name, "message-id"}, nil
+}
+
+func newTestProvider(name, kind string, err error) *provider {
+	return &provider{name: name, kind: kind, weight: 1, sender: &fakeSender{name: name, err: err}, breaker: newBreaker(1, time.Hour)}
+}
+
+func TestRouterSend(t *testing.T) {
+	outage := &smithy.GenericAPIError{Code: "ServiceUnavailable", Fault: smithy.FaultServer}
+	rejected := &textproto.Error{Code: 554, Msg: "message rejected"}
+
+	tests := []struct {
+		name         string
+		providers    []*provider
+		openBreakers []string
+		msg          Message
+		wantProvider string
+		wantErr      string
+		wantCalls    map[string]int
+	}{
+		{
+			name:         "fails over to the next provider",
+			providers:    []*provider{newTestProvider("a", "ses", outage), newTestProvider("b", "ses", nil)},
+			wantProvider: "b",
+			wantCalls:    map[string]int{"a": -1, "b": 1},
+		},
+		{
+			name:      "every provider failing",
+			providers: []*provider{newTestProvider("a", "ses", outage), newTestProvider("b", "smtp", &textproto.Error{Code: 421, Msg: "busy"})},
+			wantErr:   "every provider failed",
+			wantCalls: map[string]int{"a": 1, "b": 1},
+		},
+		{
+			name:      "message errors are returned without failing over",
+			providers: []*provider{newTestProvider("a", "smtp", rejected)},
+			wantErr:   "message rejected",
+			wantCalls: map[string]int{"a": 1},
+		},
+		{
+			name:         "providers with an open breaker are skipped",
+			providers:    []*provider{newTestProvider("a", "ses", nil), newTestProvider("b", "ses", nil)},
+			openBreakers: []string{"a"},
+			wantProvider: "b",
+			wantCalls:    map[string]int{"a": 0, "b": 1},
+		},
+		{
+			name:         "no provider available",
+			providers:    []*provider{newTestProvider("a", "ses", nil)},
+			openBreakers: []string{"a"},
+			wantErr:      "no provider available",
+			wantCalls:    map[string]int{"a": 0},
+		},
+		{
+			name:         "tenants are only sent by sesv2 providers",
+			providers:    []*provider{newTestProvider("a", "ses", nil), newTestProvider("b", "smtp", nil), newTestProvider("c", "sesv2", nil)},
+			msg:          Message{SesTenant: "acme"},
+			wantProvider: "c",
+			wantCalls:    map[string]int{"a": 0, "b": 0, "c": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &router{providers: tt.providers}
+
+			for _, p := range tt.providers {
+				for _, name := range tt.openBreakers {
+					if p.name == name {
+						p.breaker.failure()
+					}
+				}
+			}
+
+			receipt, err := r.Send(context.Background(), &tt.msg)
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if receipt.Provider != tt.wantProvider {
+				t.Errorf("expected provider %s, got %s", tt.wantProvider, receipt.Provider)
+			}
+
+			for _, p := range tt.providers {
+				want, ok := tt.wantCalls[p.name]
+
+				// -1 is either called or not, depending on the random order of the providers
+				if !ok || want < 0 {
+					continue
+				}
+
+				if calls := p.sender.(*fakeSender).calls; calls != want {
+					t.Errorf("expected provider %s to be called %d times, got %d", p.name, want, calls)
+				}
+			}
+		})
+	}
+}
+
+func TestRouterSendOpensBreakers(t *testing.T) {
+	outage := errors.New("connection refused")
+
+	r := &router{providers: []*provider{newTestProvider("a", "ses", outage)}}
+
+	if _, err := r.Send(context.Background(), &Message{}); err == nil {
+		t.Fatal("expected the send to fail")
+	}
+
+	if state := r.providers[0].breaker.currentState(); state != breakerOpen {
+		t.Fatalf("expected the breaker to open, got %s", state)
+	}
+
+	if _, err := r.Send(context.Background(), &Message{}); err == nil || !strings.Contains(err.Error(), "no provider available") {
+		t.Fatalf("expected the provider to be skipped, got %v", err)
+	}
+
+	if calls := r.providers[0].sender.(*fakeSender).calls; calls != 1 {
+		t.Fatalf("expected a single send, got %d", calls)
+	}
+}
+
+func TestRouterCandidates(t *testing.T) {
+	a := newTestProvider("a", "ses", nil)
+	b := newTestProvider("b", "sesv2", nil)
+	c := newTestProvider("c", "smtp", nil)
+
+	r := &router{
+		providers: []*provider{a, b, c},
+		routes: []route{
+			{category: "marketing", providers: []*provider{c}},
+			{senderDomain: "billing.rastercar.com", providers: []*provider{a, b}},
+		},
+	}
+
+	tests := []struct {
+		name string
+		msg  Message
+		want []string
+	}{
+		{name: "no matching route", msg: Message{Source: "no-reply@rastercar.com"}, want: []string{"a", "b", "c"}},
+		{name: "category route", msg: Message{Category: "marketing", Source: "billing@billing.rastercar.com"}, want: []string{"c"}},
+		{name: "sender domain route", msg: Message{Source: "Billing <invoices@Billing.Rastercar.com>"}, want: []string{"a", "b"}},
+		{name: "unsupported providers are excluded", msg: Message{Source: "billing@billing.rastercar.com", SesTenant: "acme"}, want: []string{"b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+
+			for _, p := range r.candidates(&tt.msg) {
+				got = append(got, p.name)
+			}
+
+			sort.Strings(got)
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("candidates() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouterCandidatesWeights(t *testing.T) {
+	heavy := &provider{name: "heavy", weight: 9}
+	light := &provider{name: "light", weight: 1}
+
+	r := &router{providers: []*provider{heavy, light}}
+
+	first := 0
+	for i := 0; i < 1000; i++ {
+		if r.candidates(&Message{})[0] == heavy {
+			first++
+		}
+	}
+
+	// expected 900, the margin keeps the test from flaking
+	if first < 800 || first > 970 {
+		t.Fatalf("expected the heavy provider to come first about 90%% of the time, got %d/1000", first)
+	}
+}
+
+func TestNewRouter(t *testing.T) {
+	smtp := config.ProviderConfig{Name: "relay", Type: "smtp", Host: "localhost", Port: 25}
+
+	tests := []struct {
+		name    string
+		routing config.RoutingConfig
+		wantErr string
+	}{
+		{
+			name:    "valid",
+			routing: config.RoutingConfig{Providers: []config.ProviderConfig{smtp}, Rules: []config.RoutingRule{{Category: "marketing", Providers: []string{"relay"}}}, BreakerFailures: 5, BreakerCooldown: 30},
+		},
+		{
+			name:    "duplicated provider names",
+			routing: config.RoutingConfig{Providers: []config.ProviderConfig{smtp, smtp}, BreakerFailures: 5, BreakerCooldown: 30},
+			wantErr: "unique names",
+		},
+		{
+			name:    "unknown provider type",
+			routing: config.RoutingConfig{Providers: []config.ProviderConfig{{Name: "x", Type: "postmark"}}, BreakerFailures: 5, BreakerCooldown: 30},
+			wantErr: "invalid provider",
+		},
+		{
+			name:    "rule with an unknown provider",
+			routing: config.RoutingConfig{Providers: []config.ProviderConfig{smtp}, Rules: []config.RoutingRule{{Providers: []string{"ses"}}}, BreakerFailures: 5, BreakerCooldown: 30},
+			wantErr: "unknown provider",
+		},
+		{
+			name:    "rule without providers",
+			routing: config.RoutingConfig{Providers: []config.ProviderConfig{smtp}, Rules: []config.RoutingRule{{Category: "marketing"}}, BreakerFailures: 5, BreakerCooldown: 30},
+			wantErr: "at least one provider",
+		},
+		{
+			name:    "invalid breaker failures",
+			routing: config.RoutingConfig{Providers: []config.ProviderConfig{smtp}, BreakerFailures: 0, BreakerCooldown: 30},
+			wantErr: "routing breaker",
+		},
+		{
+			name:    "invalid breaker cooldown",
+			routing: config.RoutingConfig{Providers: []config.ProviderConfig{smtp}, BreakerFailures: 5, BreakerCooldown: -1},
+			wantErr: "routing breaker",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newRouter(&config.Config{Routing: tt.routing})
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestIsProviderFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "network error", err: errors.New("connection reset"), want: true},
+		{name: "ses server fault", err: &smithy.GenericAPIError{Code: "InternalFailure", Fault: smithy.FaultServer}, want: true},
+		{name: "ses throttling", err: &smithy.GenericAPIError{Code: "Throttling", Fault: smithy.FaultClient}, want: true},
+		{name: "ses rejected message", err: &smithy.GenericAPIError{Code: "MessageRejected", Fault: smithy.FaultClient}},
+		{name: "smtp transient failure", err: &textproto.Error{Code: 451, Msg: "try again later"}, want: true},
+		{name: "smtp permanent failure", err: &textproto.Error{Code: 550, Msg: "mailbox unavailable"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isProviderFailure(tt.err); got != tt.want {
+				t.Errorf("isProviderFailure() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
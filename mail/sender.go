@@ -0,0 +1,107 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"mailer-ms/config"
+
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+)
+
+// Sender sends messages through a mail provider
+type Sender interface {
+	// Send sends the message, returning the provider that sent it and the id it assigned to the message
+	Send(ctx context.Context, msg *Message) (*Receipt, error)
+}
+
+type Receipt struct {
+	// Name of the provider that sent the message
+	Provider string
+
+	// The id the provider assigned to the message
+	MessageId string
+}
+
+// newSender creates a router if there are providers configured, otherwise
+// the sender of the configured SES api version on the default region
+func newSender(cfg *config.Config) (Sender, error) {
+	if len(cfg.Routing.Providers) > 0 {
+		return newRouter(cfg)
+	}
+
+	switch cfg.Mail.SesApi {
+	case "v1":
+		return &sesSender{"ses", ses.NewFromConfig(cfg.Aws.Instance)}, nil
+	case "v2":
+		return &sesV2Sender{"sesv2", sesv2.NewFromConfig(cfg.Aws.Instance)}, nil
+	}
+
+	return nil, fmt.Errorf("invalid ses api version: %q, expected v1 or v2", cfg.Mail.SesApi)
+}
+
+// newProviderSender creates the sender of a routed provider
+func newProviderSender(cfg *config.Config, p config.ProviderConfig) (Sender, error) {
+	region := p.Region
+	if region == "" {
+		region = cfg.Aws.Region
+	}
+
+	switch p.Type {
+	case "ses":
+		return &sesSender{p.Name, ses.NewFromConfig(cfg.Aws.Instance, func(o *ses.Options) { o.Region = region })}, nil
+	case "sesv2":
+		return &sesV2Sender{p.Name, sesv2.NewFromConfig(cfg.Aws.Instance, func(o *sesv2.Options) { o.Region = region })}, nil
+	case "smtp":
+		return newSmtpSender(p)
+	}
+
+	return nil, fmt.Errorf("invalid provider %s type: %q, expected ses, sesv2 or smtp", p.Name, p.Type)
+}
+
+// sesContent is the content of a simple (not raw nor template) SES message, with the content type of a SES api version
+type sesContent[C any] struct {
+	Subject *C
+	Html    *C
+	Text    *C
+}
+
+// newSesContent builds the utf-8 subject, html and text of a simple SES message with the content constructor
+// of a SES api version, a empty text part is penalized by spam filters, so its omitted instead
+func newSesContent[C any](msg *Message, content func(data, charset *string) *C) sesContent[C] {
+	c := sesContent[C]{
+		Subject: content(&msg.Subject, &utf8),
+		Html:    content(&msg.Html, &utf8),
+	}
+
+	if msg.Text != "" {
+		c.Text = content(&msg.Text, &utf8)
+	}
+
+	return c
+}
+
+// sesTags converts the message tags with the tag constructor of a SES api version
+func sesTags[T any](msg *Message, tag func(name, value *string) T) []T {
+	tags := make([]T, len(msg.Tags))
+
+	for i := range msg.Tags {
+		tags[i] = tag(&msg.Tags[i].Name, &msg.Tags[i].Value)
+	}
+
+	return tags
+}
+
+// sesRaw builds the raw message of a SES api version, nil if the message does not need to be sent as raw
+func sesRaw[R any](msg *Message, raw func(data []byte) *R) (*R, error) {
+	if !msg.needsRaw() {
+		return nil, nil
+	}
+
+	data, err := msg.Raw()
+	if err != nil {
+		return nil, err
+	}
+
+	return raw(data), nil
+}
@@ -0,0 +1,70 @@
+package mail
+
+import (
+	"reflect"
+	"testing"
+)
+
+type testContent struct {
+	Data    string
+	Charset string
+}
+
+func TestNewSesContent(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+		want sesContent[testContent]
+	}{
+		{
+			name: "html and text",
+			msg:  Message{Subject: "Relatório", Html: "<p>Olá</p>", Text: "Olá"},
+			want: sesContent[testContent]{
+				Subject: &testContent{"Relatório", utf8},
+				Html:    &testContent{"<p>Olá</p>", utf8},
+				Text:    &testContent{"Olá", utf8},
+			},
+		},
+		{
+			name: "empty text is omitted",
+			msg:  Message{Subject: "Relatório", Html: "<p>Olá</p>"},
+			want: sesContent[testContent]{
+				Subject: &testContent{"Relatório", utf8},
+				Html:    &testContent{"<p>Olá</p>", utf8},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newSesContent(&tt.msg, func(data, charset *string) *testContent {
+				return &testContent{*data, *charset}
+			})
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected the content %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSesTags(t *testing.T) {
+	tests := []struct {
+		name string
+		tags []Tag
+		want []string
+	}{
+		{name: "no tags", want: []string{}},
+		{name: "tags", tags: []Tag{{"mail_uuid", "uuid"}, {"campaign", "black_friday"}}, want: []string{"mail_uuid=uuid", "campaign=black_friday"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sesTags(&Message{Tags: tt.tags}, func(name, value *string) string { return *name + "=" + *value })
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected the tags %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
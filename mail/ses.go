@@ -2,10 +2,99 @@ package mail
 
 import (
 	"context"
+	"errors"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
 )
 
 type SesApi interface {
 	SendEmail(ctx context.Context, params *ses.SendEmailInput, optFns ...func(*ses.Options)) (*ses.SendEmailOutput, error)
+	SendRawEmail(ctx context.Context, params *ses.SendRawEmailInput, optFns ...func(*ses.Options)) (*ses.SendRawEmailOutput, error)
+	GetSendQuota(ctx context.Context, params *ses.GetSendQuotaInput, optFns ...func(*ses.Options)) (*ses.GetSendQuotaOutput, error)
+}
+
+// sesSender sends messages with the legacy SES api
+type sesSender struct {
+	name   string
+	client SesApi
+}
+
+// Send sends the message with the SES SendEmail operation, or with SendRawEmail if the
+// message needs to be sent as raw or DKIM signed, returning the SES message id
+func (s *sesSender) Send(ctx context.Context, msg *Message) (*Receipt, error) {
+	if msg.needsSesV2() {
+		return nil, errors.New("templates, list management and tenants require the sesv2 api")
+	}
+
+	tags := sesTags(msg, func(name, value *string) types.MessageTag {
+		return types.MessageTag{Name: name, Value: value}
+	})
+
+	var configurationSet *string
+
+	if msg.ConfigurationSet != "" {
+		configurationSet = &msg.ConfigurationSet
+	}
+
+	raw, err := sesRaw(msg, func(data []byte) *types.RawMessage { return &types.RawMessage{Data: data} })
+	if err != nil {
+		return nil, err
+	}
+
+	if raw != nil {
+		out, err := s.client.SendRawEmail(ctx, &ses.SendRawEmailInput{
+			Source:       &msg.Source,
+			Destinations: msg.recipients(),
+			RawMessage:   raw,
+			Tags:         tags,
+
+			ConfigurationSetName: configurationSet,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return &Receipt{s.name, aws.ToString(out.MessageId)}, nil
+	}
+
+	content := newSesContent(msg, func(data, charset *string) *types.Content {
+		return &types.Content{Data: data, Charset: charset}
+	})
+
+	out, err := s.client.SendEmail(ctx, &ses.SendEmailInput{
+		Source:           &msg.Source,
+		ReplyToAddresses: msg.ReplyTo,
+		Destination: &types.Destination{
+			ToAddresses:  msg.To,
+			CcAddresses:  msg.Cc,
+			BccAddresses: msg.Bcc,
+		},
+		Message: &types.Message{
+			Subject: content.Subject,
+			Body:    &types.Body{Html: content.Html, Text: content.Text},
+		},
+		Tags:                 tags,
+		ConfigurationSetName: configurationSet,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Receipt{s.name, aws.ToString(out.MessageId)}, nil
+}
+
+// SendQuota fetches the account send quota with the SES GetSendQuota operation
+func (s *sesSender) SendQuota(ctx context.Context) (*SendQuota, error) {
+	out, err := s.client.GetSendQuota(ctx, &ses.GetSendQuotaInput{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &SendQuota{
+		MaxSendRate:     out.MaxSendRate,
+		Max24HourSend:   out.Max24HourSend,
+		SentLast24Hours: out.SentLast24Hours,
+	}, nil
 }
@@ -0,0 +1,177 @@
+package mail
+
+import (
+	"context"
+	"mailer-ms/config"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+)
+
+// fakeSesApi records the inputs of the SES operations
+type fakeSesApi struct {
+	sendEmail    *ses.SendEmailInput
+	sendRawEmail *ses.SendRawEmailInput
+}
+
+func (f *fakeSesApi) SendEmail(ctx context.Context, params *ses.SendEmailInput, optFns ...func(*ses.Options)) (*ses.SendEmailOutput, error) {
+	f.sendEmail = params
+	return &ses.SendEmailOutput{MessageId: aws.String("message-id")}, nil
+}
+
+func (f *fakeSesApi) SendRawEmail(ctx context.Context, params *ses.SendRawEmailInput, optFns ...func(*ses.Options)) (*ses.SendRawEmailOutput, error) {
+	f.sendRawEmail = params
+	return &ses.SendRawEmailOutput{MessageId: aws.String("raw-message-id")}, nil
+}
+
+func (f *fakeSesApi) GetSendQuota(ctx context.Context, params *ses.GetSendQuotaInput, optFns ...func(*ses.Options)) (*ses.GetSendQuotaOutput, error) {
+	return &ses.GetSendQuotaOutput{MaxSendRate: 14, Max24HourSend: 50000, SentLast24Hours: 10}, nil
+}
+
+func TestSendEmailDtoTagsValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		dto     SendEmailDto
+		wantErr bool
+	}{
+		{name: "valid tags and configuration set", dto: SendEmailDto{ConfigurationSet: "marketing-set_1", Tags: map[string]string{"category": "invoice", "tenant_id": "acme-1"}}},
+		{name: "tag name with invalid characters", dto: SendEmailDto{Tags: map[string]string{"tenant id": "acme"}}, wantErr: true},
+		{name: "tag value with invalid characters", dto: SendEmailDto{Tags: map[string]string{"tenant": "acme.com"}}, wantErr: true},
+		{name: "empty tag value", dto: SendEmailDto{Tags: map[string]string{"tenant": ""}}, wantErr: true},
+		{name: "tag value too long", dto: SendEmailDto{Tags: map[string]string{"tenant": strings.Repeat("a", 257)}}, wantErr: true},
+		{name: "configuration set with invalid characters", dto: SendEmailDto{ConfigurationSet: "marketing set"}, wantErr: true},
+		{name: "configuration set too long", dto: SendEmailDto{ConfigurationSet: strings.Repeat("a", 65)}, wantErr: true},
+	}
+
+	validate := newValidator()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.dto.Uuid = "uuid"
+			tt.dto.To = []Address{{Email: "bruce@wayne.com"}}
+			tt.dto.SubjectText = "Hi"
+			tt.dto.BodyHtml = "<p>Hi</p>"
+
+			err := validate.Struct(&tt.dto)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestMessageTags(t *testing.T) {
+	tags, err := messageTags(&SendEmailDto{Uuid: "uuid", Tags: map[string]string{"tenant": "acme", "category": "invoice"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Tag{{mailUuidTag, "uuid"}, {"category", "invoice"}, {"tenant", "acme"}}
+
+	if !reflect.DeepEqual(tags, want) {
+		t.Fatalf("expected %v, got %v", want, tags)
+	}
+
+	if _, err := messageTags(&SendEmailDto{Uuid: "uuid", Tags: map[string]string{mailUuidTag: "other"}}); err == nil {
+		t.Fatal("expected the mail uuid tag to be reserved")
+	}
+}
+
+func TestNewMessageConfigurationSet(t *testing.T) {
+	m := &Mailer{cfg: &config.Config{Mail: config.MailConfig{Sender: "noreply@rastercar.com", ConfigurationSet: "default-set"}}}
+
+	tests := []struct {
+		name             string
+		configurationSet string
+		want             string
+	}{
+		{name: "default configuration set", want: "default-set"},
+		{name: "overridden configuration set", configurationSet: "marketing-set", want: "marketing-set"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := m.newMessage(&SendEmailDto{Uuid: "uuid", To: []Address{{Email: "bruce@wayne.com"}}, BodyHtml: "<p>Hi</p>", ConfigurationSet: tt.configurationSet})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if msg.ConfigurationSet != tt.want {
+				t.Fatalf("expected configuration set %q, got %q", tt.want, msg.ConfigurationSet)
+			}
+		})
+	}
+}
+
+func TestSesSenderSend(t *testing.T) {
+	msg := &Message{
+		Uuid:             "uuid",
+		Source:           "noreply@rastercar.com",
+		To:               []string{"bruce@wayne.com"},
+		Bcc:              []string{"alfred@wayne.com"},
+		Subject:          "Hi",
+		Html:             "<p>Hi</p>",
+		ConfigurationSet: "marketing-set",
+		Tags:             []Tag{{mailUuidTag, "uuid"}, {"tenant", "acme"}},
+	}
+
+	wantTags := []types.MessageTag{
+		{Name: aws.String(mailUuidTag), Value: aws.String("uuid")},
+		{Name: aws.String("tenant"), Value: aws.String("acme")},
+	}
+
+	t.Run("simple message", func(t *testing.T) {
+		api := &fakeSesApi{}
+
+		receipt, err := (&sesSender{"ses", api}).Send(context.Background(), msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if *receipt != (Receipt{"ses", "message-id"}) {
+			t.Fatalf("unexpected receipt %+v", receipt)
+		}
+
+		if in := api.sendEmail; aws.ToString(in.ConfigurationSetName) != "marketing-set" || !reflect.DeepEqual(in.Tags, wantTags) {
+			t.Fatalf("expected the configuration set and tags to be sent, got %+v", in)
+		}
+
+		if api.sendEmail.Message.Body.Text != nil {
+			t.Fatal("expected a empty text body to be omitted")
+		}
+	})
+
+	t.Run("raw message", func(t *testing.T) {
+		api := &fakeSesApi{}
+		raw := *msg
+		raw.Headers = []Header{{"X-Priority", "1"}}
+
+		if _, err := (&sesSender{"ses", api}).Send(context.Background(), &raw); err != nil {
+			t.Fatal(err)
+		}
+
+		in := api.sendRawEmail
+
+		if in == nil || aws.ToString(in.ConfigurationSetName) != "marketing-set" || !reflect.DeepEqual(in.Tags, wantTags) {
+			t.Fatalf("expected a raw message with the configuration set and tags, got %+v", in)
+		}
+
+		if !reflect.DeepEqual(in.Destinations, []string{"bruce@wayne.com", "alfred@wayne.com"}) {
+			t.Fatalf("expected the bcc addresses to be destinations, got %v", in.Destinations)
+		}
+	})
+
+	t.Run("templates require the sesv2 api", func(t *testing.T) {
+		template := *msg
+		template.Template = &TemplateContent{Name: "welcome"}
+
+		if _, err := (&sesSender{"ses", &fakeSesApi{}}).Send(context.Background(), &template); err == nil {
+			t.Fatal("expected templates to be rejected")
+		}
+	})
+}
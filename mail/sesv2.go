@@ -0,0 +1,125 @@
+package mail
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+)
+
+type SesV2Api interface {
+	SendEmail(ctx context.Context, params *sesv2.SendEmailInput, optFns ...func(*sesv2.Options)) (*sesv2.SendEmailOutput, error)
+	GetAccount(ctx context.Context, params *sesv2.GetAccountInput, optFns ...func(*sesv2.Options)) (*sesv2.GetAccountOutput, error)
+}
+
+// sesV2Sender sends messages with the SESv2 api
+type sesV2Sender struct {
+	name   string
+	client SesV2Api
+}
+
+// Send sends the message with the SESv2 SendEmail operation, with template content if the message
+// has a template, raw content if it needs to be sent as raw or simple content otherwise
+func (s *sesV2Sender) Send(ctx context.Context, msg *Message) (*Receipt, error) {
+	content, err := sesV2Content(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &sesv2.SendEmailInput{
+		Content:          content,
+		FromEmailAddress: &msg.Source,
+		ReplyToAddresses: msg.ReplyTo,
+		Destination: &types.Destination{
+			ToAddresses:  msg.To,
+			CcAddresses:  msg.Cc,
+			BccAddresses: msg.Bcc,
+		},
+		EmailTags: sesTags(msg, func(name, value *string) types.MessageTag {
+			return types.MessageTag{Name: name, Value: value}
+		}),
+	}
+
+	if msg.ConfigurationSet != "" {
+		input.ConfigurationSetName = &msg.ConfigurationSet
+	}
+
+	if msg.SesTenant != "" {
+		input.TenantName = &msg.SesTenant
+	}
+
+	if lm := msg.ListManagement; lm != nil {
+		input.ListManagementOptions = &types.ListManagementOptions{ContactListName: &lm.ContactList}
+
+		if lm.Topic != "" {
+			input.ListManagementOptions.TopicName = &lm.Topic
+		}
+	}
+
+	out, err := s.client.SendEmail(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Receipt{s.name, aws.ToString(out.MessageId)}, nil
+}
+
+// SendQuota fetches the account send quota with the SESv2 GetAccount operation
+func (s *sesV2Sender) SendQuota(ctx context.Context) (*SendQuota, error) {
+	out, err := s.client.GetAccount(ctx, &sesv2.GetAccountInput{})
+	if err != nil {
+		return nil, err
+	}
+
+	if out.SendQuota == nil {
+		return nil, errors.New("account has no send quota")
+	}
+
+	return &SendQuota{
+		MaxSendRate:     out.SendQuota.MaxSendRate,
+		Max24HourSend:   out.SendQuota.Max24HourSend,
+		SentLast24Hours: out.SendQuota.SentLast24Hours,
+	}, nil
+}
+
+func sesV2Content(msg *Message) (*types.EmailContent, error) {
+	if t := msg.Template; t != nil {
+		template := &types.Template{}
+
+		if t.Name != "" {
+			template.TemplateName = &t.Name
+		}
+
+		if t.Arn != "" {
+			template.TemplateArn = &t.Arn
+		}
+
+		if len(t.Data) > 0 {
+			template.TemplateData = aws.String(string(t.Data))
+		}
+
+		return &types.EmailContent{Template: template}, nil
+	}
+
+	raw, err := sesRaw(msg, func(data []byte) *types.RawMessage { return &types.RawMessage{Data: data} })
+	if err != nil {
+		return nil, err
+	}
+
+	if raw != nil {
+		return &types.EmailContent{Raw: raw}, nil
+	}
+
+	content := newSesContent(msg, func(data, charset *string) *types.Content {
+		return &types.Content{Data: data, Charset: charset}
+	})
+
+	return &types.EmailContent{
+		Simple: &types.Message{
+			Subject: content.Subject,
+			Body:    &types.Body{Html: content.Html, Text: content.Text},
+		},
+	}, nil
+}
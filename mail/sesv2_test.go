@@ -0,0 +1,162 @@
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+)
+
+// fakeSesV2Api records the input of the SendEmail operation
+type fakeSesV2Api struct {
+	sendEmail *sesv2.SendEmailInput
+}
+
+func (f *fakeSesV2Api) SendEmail(ctx context.Context, params *sesv2.SendEmailInput, optFns ...func(*sesv2.Options)) (*sesv2.SendEmailOutput, error) {
+	f.sendEmail = params
+	return &sesv2.SendEmailOutput{MessageId: aws.String("message-id")}, nil
+}
+
+func (f *fakeSesV2Api) GetAccount(ctx context.Context, params *sesv2.GetAccountInput, optFns ...func(*sesv2.Options)) (*sesv2.GetAccountOutput, error) {
+	return &sesv2.GetAccountOutput{SendQuota: &types.SendQuota{MaxSendRate: 14, Max24HourSend: 50000, SentLast24Hours: 10}}, nil
+}
+
+func TestSesV2SenderSend(t *testing.T) {
+	base := Message{
+		Uuid:    "uuid",
+		Source:  "noreply@rastercar.com",
+		To:      []string{"bruce@wayne.com"},
+		Subject: "Hi",
+		Html:    "<p>Hi</p>",
+		Text:    "Hi",
+		Tags:    []Tag{{mailUuidTag, "uuid"}},
+	}
+
+	tests := []struct {
+		name   string
+		modify func(msg *Message)
+		check  func(t *testing.T, in *sesv2.SendEmailInput)
+	}{
+		{
+			name: "simple content",
+			check: func(t *testing.T, in *sesv2.SendEmailInput) {
+				if in.Content.Simple == nil || aws.ToString(in.Content.Simple.Body.Text.Data) != "Hi" {
+					t.Fatalf("expected simple content with a text body, got %+v", in.Content)
+				}
+
+				if in.TenantName != nil || in.ConfigurationSetName != nil || in.ListManagementOptions != nil {
+					t.Fatalf("expected no optional options to be set, got %+v", in)
+				}
+			},
+		},
+		{
+			name:   "raw content",
+			modify: func(msg *Message) { msg.Headers = []Header{{"X-Priority", "1"}} },
+			check: func(t *testing.T, in *sesv2.SendEmailInput) {
+				if in.Content.Raw == nil || len(in.Content.Raw.Data) == 0 {
+					t.Fatalf("expected raw content, got %+v", in.Content)
+				}
+			},
+		},
+		{
+			name: "template content",
+			modify: func(msg *Message) {
+				msg.Template = &TemplateContent{Name: "welcome", Data: json.RawMessage(`{"name":"Bruce"}`)}
+			},
+			check: func(t *testing.T, in *sesv2.SendEmailInput) {
+				template := in.Content.Template
+
+				if template == nil || aws.ToString(template.TemplateName) != "welcome" || aws.ToString(template.TemplateData) != `{"name":"Bruce"}` {
+					t.Fatalf("expected template content, got %+v", in.Content)
+				}
+			},
+		},
+		{
+			name: "per send options",
+			modify: func(msg *Message) {
+				msg.SesTenant = "wayne-enterprises"
+				msg.ConfigurationSet = "marketing-set"
+				msg.ListManagement = &ListManagement{ContactList: "customers", Topic: "invoices"}
+			},
+			check: func(t *testing.T, in *sesv2.SendEmailInput) {
+				if aws.ToString(in.TenantName) != "wayne-enterprises" {
+					t.Errorf("expected the tenant to be set, got %v", in.TenantName)
+				}
+
+				if aws.ToString(in.ConfigurationSetName) != "marketing-set" {
+					t.Errorf("expected the configuration set to be set, got %v", in.ConfigurationSetName)
+				}
+
+				if lm := in.ListManagementOptions; lm == nil || aws.ToString(lm.ContactListName) != "customers" || aws.ToString(lm.TopicName) != "invoices" {
+					t.Errorf("expected the list management options to be set, got %+v", lm)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := base
+
+			if tt.modify != nil {
+				tt.modify(&msg)
+			}
+
+			api := &fakeSesV2Api{}
+
+			receipt, err := (&sesV2Sender{"sesv2", api}).Send(context.Background(), &msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if *receipt != (Receipt{"sesv2", "message-id"}) {
+				t.Fatalf("unexpected receipt %+v", receipt)
+			}
+
+			if len(api.sendEmail.EmailTags) != 1 || aws.ToString(api.sendEmail.EmailTags[0].Value) != "uuid" {
+				t.Fatalf("expected the mail uuid tag, got %+v", api.sendEmail.EmailTags)
+			}
+
+			tt.check(t, api.sendEmail)
+		})
+	}
+}
+
+func TestSesV2OnlyOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+		want bool
+	}{
+		{name: "plain message", msg: Message{}},
+		{name: "template", msg: Message{Template: &TemplateContent{Name: "welcome"}}, want: true},
+		{name: "list management", msg: Message{ListManagement: &ListManagement{ContactList: "customers"}}, want: true},
+		{name: "tenant", msg: Message{SesTenant: "wayne-enterprises"}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.msg.needsSesV2(); got != tt.want {
+				t.Fatalf("expected needsSesV2 %v, got %v", tt.want, got)
+			}
+
+			if got := (&provider{kind: "ses"}).supports(&tt.msg); got == tt.want {
+				t.Fatalf("expected ses provider support to be %v", !tt.want)
+			}
+
+			if !(&provider{kind: "sesv2"}).supports(&tt.msg) {
+				t.Fatal("expected the sesv2 provider to support every message")
+			}
+
+			msg := tt.msg
+			msg.Source = "noreply@rastercar.com"
+
+			if _, err := (&sesSender{"ses", &fakeSesApi{}}).Send(context.Background(), &msg); (err != nil) != tt.want {
+				t.Fatalf("expected the v1 api rejection to be %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
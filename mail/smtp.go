@@ -0,0 +1,157 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"mailer-ms/config"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"time"
+)
+
+const smtpTimeout = 30 * time.Second
+
+// smtpSender sends raw messages through a SMTP relay
+type smtpSender struct {
+	name     string
+	addr     string
+	host     string
+	tls      bool
+	username string
+	password string
+}
+
+func newSmtpSender(p config.ProviderConfig) (*smtpSender, error) {
+	if p.Host == "" || p.Port == 0 {
+		return nil, fmt.Errorf("smtp provider %s requires a host and port", p.Name)
+	}
+
+	s := &smtpSender{
+		name:     p.Name,
+		addr:     net.JoinHostPort(p.Host, strconv.Itoa(p.Port)),
+		host:     p.Host,
+		tls:      p.Tls,
+		username: p.Username,
+	}
+
+	if p.PasswordEnv != "" {
+		s.password = os.Getenv(p.PasswordEnv)
+	}
+
+	return s, nil
+}
+
+// Send sends the raw message, the message id is the Message-Id header set on it
+func (s *smtpSender) Send(ctx context.Context, msg *Message) (*Receipt, error) {
+	if msg.needsSesV2() {
+		return nil, errors.New("templates, list management and tenants require the sesv2 api")
+	}
+
+	from, err := mail.ParseAddress(msg.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	recipients := make([]string, 0, len(msg.recipients()))
+
+	for _, r := range msg.recipients() {
+		address, err := mail.ParseAddress(r)
+		if err != nil {
+			return nil, err
+		}
+
+		recipients = append(recipients, address.Address)
+	}
+
+	data, err := msg.Raw()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	if err := client.Mail(from.Address); err != nil {
+		return nil, err
+	}
+
+	for _, r := range recipients {
+		if err := client.Rcpt(r); err != nil {
+			return nil, err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	// the relay accepted the message once DATA is closed, failing now would send it again
+	if err := client.Quit(); err != nil {
+		log.Printf("[ MAIL ] smtp provider %s quit failed after the message was accepted: %v", s.name, err)
+	}
+
+	return &Receipt{s.name, msg.messageId()}, nil
+}
+
+// dial connects to the relay, upgrading the connection with STARTTLS if not using
+// implicit TLS and authenticating if there are credentials
+func (s *smtpSender) dial(ctx context.Context) (*smtp.Client, error) {
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+
+	var conn net.Conn
+	var err error
+
+	if s.tls {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: s.host}}).DialContext(ctx, "tcp", s.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", s.addr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if !s.tls {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+				client.Close()
+				return nil, err
+			}
+		}
+	}
+
+	if s.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.username, s.password, s.host)); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
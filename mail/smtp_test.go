@@ -0,0 +1,224 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"mailer-ms/config"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// serveSmtp accepts a single SMTP session, replying to the MAIL, RCPT, DATA (once the message is
+// sent) and QUIT commands with the replies set on replies, 250 if unset. an empty QUIT reply
+// closes the connection instead. returns the server address and the messages it receives
+func serveSmtp(t *testing.T, replies map[string]string) (string, <-chan string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan string, 1)
+
+	reply := func(command string) string {
+		if r, ok := replies[command]; ok {
+			return r
+		}
+		return "250 ok"
+	}
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 localhost ESMTP")
+
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+
+			command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+			switch command {
+			case "EHLO", "HELO":
+				tp.PrintfLine("250 localhost")
+
+			case "DATA":
+				tp.PrintfLine("354 go ahead")
+
+				data, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+
+				received <- string(data)
+				tp.PrintfLine(reply("DATA"))
+
+			case "QUIT":
+				if r := reply("QUIT"); r != "" {
+					tp.PrintfLine(r)
+				}
+				return
+
+			default:
+				if r := reply(command); r != "" {
+					tp.PrintfLine(r)
+				}
+			}
+		}
+	}()
+
+	return listener.Addr().String(), received
+}
+
+func TestSmtpSenderSend(t *testing.T) {
+	tests := []struct {
+		name        string
+		replies     map[string]string
+		wantCode    int
+		wantMessage bool
+	}{
+		{
+			name:        "message accepted",
+			replies:     map[string]string{"QUIT": "221 bye"},
+			wantMessage: true,
+		},
+		{
+			name:        "quit failing after the message was accepted",
+			replies:     map[string]string{"QUIT": "421 closing"},
+			wantMessage: true,
+		},
+		{
+			name:        "connection closed on quit after the message was accepted",
+			replies:     map[string]string{"QUIT": ""},
+			wantMessage: true,
+		},
+		{
+			name:     "recipient rejected",
+			replies:  map[string]string{"RCPT": "550 mailbox unavailable"},
+			wantCode: 550,
+		},
+		{
+			name:        "message rejected",
+			replies:     map[string]string{"DATA": "554 message rejected"},
+			wantCode:    554,
+			wantMessage: true,
+		},
+		{
+			name:        "message deferred",
+			replies:     map[string]string{"DATA": "451 try again later"},
+			wantCode:    451,
+			wantMessage: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, received := serveSmtp(t, tt.replies)
+
+			host, port, _ := net.SplitHostPort(addr)
+			portNumber, _ := strconv.Atoi(port)
+
+			sender, err := newSmtpSender(config.ProviderConfig{Name: "relay", Type: "smtp", Host: host, Port: portNumber})
+			if err != nil {
+				t.Fatalf("failed to create the sender: %v", err)
+			}
+
+			msg := &Message{
+				Uuid:    "uuid",
+				Source:  "Rastercar <noreply@rastercar.com>",
+				To:      []string{"bruce@wayne.com"},
+				Subject: "hello",
+				Text:    "hello there",
+			}
+
+			receipt, err := sender.Send(context.Background(), msg)
+
+			if tt.wantCode != 0 {
+				var smtpErr *textproto.Error
+				if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode {
+					t.Fatalf("expected a smtp %d error, got %v", tt.wantCode, err)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				if receipt.Provider != "relay" || receipt.MessageId != msg.messageId() {
+					t.Errorf("unexpected receipt: %+v", receipt)
+				}
+			}
+
+			select {
+			case data := <-received:
+				if !tt.wantMessage {
+					t.Fatal("expected the message to not be sent")
+				}
+
+				if !strings.Contains(data, "hello there") {
+					t.Errorf("expected the message body to be sent, got %q", data)
+				}
+
+			default:
+				if tt.wantMessage {
+					t.Fatal("expected the message to be sent")
+				}
+			}
+		})
+	}
+}
+
+func TestSmtpSenderRejectsSesV2Messages(t *testing.T) {
+	sender := &smtpSender{name: "relay"}
+
+	if _, err := sender.Send(context.Background(), &Message{SesTenant: "acme"}); err == nil {
+		t.Fatal("expected messages with a tenant to be rejected")
+	}
+}
+
+func TestNewSmtpSender(t *testing.T) {
+	t.Setenv("SMTP_TEST_PASSWORD", "secret")
+
+	tests := []struct {
+		name     string
+		provider config.ProviderConfig
+		wantAddr string
+		wantErr  bool
+	}{
+		{name: "valid", provider: config.ProviderConfig{Name: "relay", Host: "smtp.rastercar.com", Port: 587, PasswordEnv: "SMTP_TEST_PASSWORD"}, wantAddr: "smtp.rastercar.com:587"},
+		{name: "missing host", provider: config.ProviderConfig{Name: "relay", Port: 587}, wantErr: true},
+		{name: "missing port", provider: config.ProviderConfig{Name: "relay", Host: "smtp.rastercar.com"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, err := newSmtpSender(tt.provider)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if sender.addr != tt.wantAddr || sender.password != "secret" {
+				t.Errorf("unexpected sender: %+v", sender)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package mail
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	whitespaceRegex = regexp.MustCompile(`\s+`)
+	blankLinesRegex = regexp.MustCompile(`\n{3,}`)
+)
+
+type list struct {
+	ordered bool
+	items   int
+}
+
+// textConverter renders a html document as readable plain text
+type textConverter struct {
+	buf   strings.Builder
+	links []string
+	lists []list
+
+	// if the current line has no text yet
+	lineStart bool
+
+	// depth of the <pre> elements the current node is in
+	pre int
+}
+
+// htmlToText derives a plain text version of a html email, links are kept as
+// footnotes, headings are underlined, list items are prefixed with a dash or
+// their number and table rows are flattened into lines
+func htmlToText(content string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+
+	c := &textConverter{lineStart: true}
+	c.walk(doc)
+
+	lines := strings.Split(c.buf.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+
+	text := strings.TrimSpace(blankLinesRegex.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+
+	if len(c.links) > 0 {
+		text += "\n\n"
+
+		for i, link := range c.links {
+			text += fmt.Sprintf("[%d] %s\n", i+1, link)
+		}
+	}
+
+	return strings.TrimSpace(text), nil
+}
+
+func (c *textConverter) walk(n *html.Node) {
+	if n.Type == html.TextNode {
+		c.text(n.Data)
+		return
+	}
+
+	if n.Type != html.ElementNode {
+		c.walkChildren(n)
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Noscript, atom.Template:
+		return
+
+	case atom.Br:
+		c.newline()
+
+	case atom.Hr:
+		c.block()
+		c.write("--------------------")
+		c.block()
+
+	case atom.Img:
+		if alt := attr(n, "alt"); alt != "" {
+			c.text(alt)
+		}
+
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		c.heading(n)
+
+	case atom.A:
+		c.link(n)
+
+	case atom.Ul, atom.Ol:
+		// nested lists are not separated from the item they are in
+		nested := len(c.lists) > 0
+
+		if nested {
+			c.newline()
+		} else {
+			c.block()
+		}
+
+		c.lists = append(c.lists, list{ordered: n.DataAtom == atom.Ol})
+		c.walkChildren(n)
+		c.lists = c.lists[:len(c.lists)-1]
+
+		if !nested {
+			c.block()
+		}
+
+	case atom.Li:
+		c.listItem(n)
+
+	case atom.Td, atom.Th:
+		if !c.lineStart {
+			c.write(" ")
+		}
+		c.walkChildren(n)
+
+	case atom.Pre:
+		c.block()
+		c.pre++
+		c.walkChildren(n)
+		c.pre--
+		c.block()
+
+	case atom.P, atom.Table, atom.Blockquote:
+		c.block()
+		c.walkChildren(n)
+		c.block()
+
+	case atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Main, atom.Nav,
+		atom.Aside, atom.Tr, atom.Dt, atom.Dd, atom.Address, atom.Figure, atom.Center, atom.Form:
+		c.newline()
+		c.walkChildren(n)
+		c.newline()
+
+	default:
+		c.walkChildren(n)
+	}
+}
+
+func (c *textConverter) walkChildren(n *html.Node) {
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		c.walk(child)
+	}
+}
+
+func (c *textConverter) heading(n *html.Node) {
+	c.block()
+
+	start := c.buf.Len()
+	c.walkChildren(n)
+	heading := strings.TrimSpace(c.buf.String()[start:])
+
+	underline := "-"
+	if n.DataAtom == atom.H1 {
+		underline = "="
+	}
+
+	if heading != "" {
+		c.newline()
+		c.write(strings.Repeat(underline, len([]rune(heading))))
+	}
+
+	c.block()
+}
+
+func (c *textConverter) link(n *html.Node) {
+	start := c.buf.Len()
+	c.walkChildren(n)
+	text := strings.TrimSpace(c.buf.String()[start:])
+
+	href := strings.TrimSpace(attr(n, "href"))
+
+	if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(href, "javascript:") || href == text {
+		return
+	}
+
+	c.links = append(c.links, href)
+	c.write(fmt.Sprintf(" [%d]", len(c.links)))
+}
+
+func (c *textConverter) listItem(n *html.Node) {
+	c.newline()
+
+	prefix := "- "
+
+	if len(c.lists) > 0 {
+		current := &c.lists[len(c.lists)-1]
+		current.items++
+
+		if current.ordered {
+			prefix = fmt.Sprintf("%d. ", current.items)
+		}
+
+		prefix = strings.Repeat("  ", len(c.lists)-1) + prefix
+	}
+
+	c.write(prefix)
+	c.lineStart = true
+
+	c.walkChildren(n)
+	c.newline()
+}
+
+// text writes a text node, collapsing its whitespace unless within a <pre> element
+func (c *textConverter) text(s string) {
+	if c.pre > 0 {
+		c.write(s)
+		return
+	}
+
+	s = whitespaceRegex.ReplaceAllString(s, " ")
+
+	if c.lineStart || strings.HasSuffix(c.buf.String(), " ") {
+		s = strings.TrimLeft(s, " ")
+	}
+
+	if s != "" {
+		c.write(s)
+	}
+}
+
+func (c *textConverter) write(s string) {
+	c.buf.WriteString(s)
+	c.lineStart = strings.HasSuffix(s, "\n")
+}
+
+// newline ends the current line, if it has any text
+func (c *textConverter) newline() {
+	if c.buf.Len() == 0 || c.lineStart {
+		return
+	}
+
+	c.write("\n")
+}
+
+// block ends the current line and separates the next text with a blank line
+func (c *textConverter) block() {
+	// nothing written yet or only a list item prefix
+	if c.buf.Len() == 0 || (c.lineStart && !strings.HasSuffix(c.buf.String(), "\n")) {
+		return
+	}
+
+	c.newline()
+
+	if !strings.HasSuffix(c.buf.String(), "\n\n") {
+		c.write("\n")
+	}
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+
+	return ""
+}
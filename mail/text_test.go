@@ -0,0 +1,65 @@
+package mail
+
+import "testing"
+
+func TestHtmlToText(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{
+			name: "paragraphs and whitespace",
+			html: "<p>Hello   Bruce,\n  welcome</p><p>Bye</p>",
+			want: "Hello Bruce, welcome\n\nBye",
+		},
+		{
+			name: "head, scripts and styles are skipped",
+			html: "<html><head><title>Title</title><style>p { color: red }</style></head><body><script>alert(1)</script><p>Body</p></body></html>",
+			want: "Body",
+		},
+		{
+			name: "headings are underlined",
+			html: "<h1>Invoice</h1><h2>Items</h2><p>None</p>",
+			want: "Invoice\n=======\n\nItems\n-----\n\nNone",
+		},
+		{
+			name: "links are kept as footnotes",
+			html: `<p>See <a href="https://rastercar.com/invoice">your invoice</a> or <a href="#top">top</a>, <a href="https://rastercar.com">https://rastercar.com</a></p>`,
+			want: "See your invoice [1] or top, https://rastercar.com\n\n[1] https://rastercar.com/invoice",
+		},
+		{
+			name: "lists",
+			html: "<ul><li>One</li><li>Two<ol><li>First</li><li>Second</li></ol></li></ul>",
+			want: "- One\n- Two\n  1. First\n  2. Second",
+		},
+		{
+			name: "tables are flattened into lines",
+			html: "<table><tr><th>Item</th><th>Price</th></tr><tr><td>Tracker</td><td>$10</td></tr></table>",
+			want: "Item Price\nTracker $10",
+		},
+		{
+			name: "preformatted text keeps its whitespace",
+			html: "<pre>a   b\n  c</pre>",
+			want: "a   b\n  c",
+		},
+		{
+			name: "line breaks, rules and images",
+			html: `Line one<br>Line two<hr><img src="logo.png" alt="Rastercar">`,
+			want: "Line one\nLine two\n\n--------------------\n\nRastercar",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := htmlToText(tt.html)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tt.want {
+				t.Fatalf("expected:\n%q\ngot:\n%q", tt.want, got)
+			}
+		})
+	}
+}
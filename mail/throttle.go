@@ -0,0 +1,153 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"log"
+	"mailer-ms/config"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"golang.org/x/time/rate"
+)
+
+// Error codes returned by the SES apis when the send rate is exceeded
+var throttlingErrorCodes = map[string]bool{
+	"Throttling":               true,
+	"ThrottlingException":      true,
+	"TooManyRequestsException": true,
+}
+
+// adaptiveLimiter limits the send rate with additive increase and multiplicative decrease (AIMD),
+// the rate is cut by the backoff factor when the provider throttles and is raised by the recovery
+// step, at most once per second, on successful sends until it reaches the ceiling again
+type adaptiveLimiter struct {
+	mu      sync.Mutex
+	limiter RateLimiter
+
+	// the maximum rate, configured or discovered from the send quota
+	ceiling rate.Limit
+
+	minRate       rate.Limit
+	backoffFactor float64
+	recoveryStep  rate.Limit
+
+	// when the rate was last changed, so a burst of throttling errors from concurrent
+	// sends cuts it once and it is not raised faster than the recovery step per second
+	lastChange time.Time
+}
+
+func newAdaptiveLimiter(cfg config.MailConfig, limiter RateLimiter) *adaptiveLimiter {
+	ceiling := limiter.Limit()
+
+	l := &adaptiveLimiter{
+		limiter:       limiter,
+		ceiling:       ceiling,
+		minRate:       rate.Limit(cfg.ThrottleMinRate),
+		backoffFactor: cfg.ThrottleBackoffFactor,
+		recoveryStep:  rate.Limit(cfg.ThrottleRecoveryStep),
+	}
+
+	if l.minRate <= 0 {
+		l.minRate = 0.1
+	}
+
+	if l.backoffFactor <= 0 || l.backoffFactor >= 1 {
+		l.backoffFactor = 0.5
+	}
+
+	if l.recoveryStep <= 0 {
+		l.recoveryStep = 1
+	}
+
+	return l
+}
+
+func (l *adaptiveLimiter) Wait(ctx context.Context) error {
+	return l.limiter.Wait(ctx)
+}
+
+// Limit returns the current effective send rate
+func (l *adaptiveLimiter) Limit() rate.Limit {
+	return l.limiter.Limit()
+}
+
+// Ceiling returns the maximum send rate
+func (l *adaptiveLimiter) Ceiling() rate.Limit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.ceiling
+}
+
+// SetCeiling changes the maximum send rate, lowering the current rate if above it
+func (l *adaptiveLimiter) SetCeiling(ceiling rate.Limit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.ceiling = ceiling
+
+	if l.limiter.Limit() > ceiling {
+		l.limiter.SetLimit(ceiling)
+	}
+}
+
+// OnThrottled cuts the send rate by the backoff factor
+func (l *adaptiveLimiter) OnThrottled() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if time.Since(l.lastChange) < time.Second {
+		return
+	}
+
+	current := l.limiter.Limit()
+
+	limit := current * rate.Limit(l.backoffFactor)
+	if limit < l.minRate {
+		limit = l.minRate
+	}
+
+	if limit == current {
+		return
+	}
+
+	l.set(limit)
+	log.Printf("[ MAIL ] provider throttled, send rate lowered from %.2f to %.2f emails per second", current, limit)
+}
+
+// OnSuccess raises the send rate by the recovery step, if below the ceiling
+func (l *adaptiveLimiter) OnSuccess() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	current := l.limiter.Limit()
+
+	if current >= l.ceiling || time.Since(l.lastChange) < time.Second {
+		return
+	}
+
+	limit := current + l.recoveryStep
+	if limit > l.ceiling {
+		limit = l.ceiling
+	}
+
+	l.set(limit)
+
+	if limit == l.ceiling {
+		log.Printf("[ MAIL ] send rate restored to %.2f emails per second", limit)
+	}
+}
+
+func (l *adaptiveLimiter) set(limit rate.Limit) {
+	l.limiter.SetLimit(limit)
+	l.lastChange = time.Now()
+}
+
+// isThrottlingError checks if a send error was caused by the provider throttling the requests
+func isThrottlingError(err error) bool {
+	var apiErr smithy.APIError
+
+	return errors.As(err, &apiErr) && throttlingErrorCodes[apiErr.ErrorCode()]
+}
@@ -0,0 +1,112 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"mailer-ms/config"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"golang.org/x/time/rate"
+)
+
+// step is a throttling or successful send, after the rate can be changed again
+type step struct {
+	throttled bool
+	want      rate.Limit
+}
+
+func TestAdaptiveLimiter(t *testing.T) {
+	cfg := config.MailConfig{ThrottleBackoffFactor: 0.5, ThrottleRecoveryStep: 2, ThrottleMinRate: 1}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name:  "throttling cuts the rate by the backoff factor",
+			steps: []step{{throttled: true, want: 5}, {throttled: true, want: 2.5}},
+		},
+		{
+			name:  "the rate is not cut below the min rate",
+			steps: []step{{throttled: true, want: 5}, {throttled: true, want: 2.5}, {throttled: true, want: 1.25}, {throttled: true, want: 1}},
+		},
+		{
+			name:  "successes raise the rate by the recovery step up to the ceiling",
+			steps: []step{{throttled: true, want: 5}, {want: 7}, {want: 9}, {want: 10}, {want: 10}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newAdaptiveLimiter(cfg, rate.NewLimiter(10, 1))
+
+			for i, s := range tt.steps {
+				// allows the rate to change again, as if a second had passed
+				l.lastChange = time.Now().Add(-2 * time.Second)
+
+				if s.throttled {
+					l.OnThrottled()
+				} else {
+					l.OnSuccess()
+				}
+
+				if got := l.Limit(); got != s.want {
+					t.Fatalf("expected rate %v after step %d, got %v", s.want, i, got)
+				}
+			}
+		})
+	}
+}
+
+func TestAdaptiveLimiterChangesOncePerSecond(t *testing.T) {
+	l := newAdaptiveLimiter(config.MailConfig{}, rate.NewLimiter(10, 1))
+
+	// a burst of throttling errors from concurrent sends cuts the rate once
+	l.OnThrottled()
+	l.OnThrottled()
+	l.OnSuccess()
+
+	if got := l.Limit(); got != 5 {
+		t.Fatalf("expected the rate to be cut once with the default backoff factor, got %v", got)
+	}
+}
+
+func TestAdaptiveLimiterSetCeiling(t *testing.T) {
+	l := newAdaptiveLimiter(config.MailConfig{}, rate.NewLimiter(10, 1))
+
+	l.SetCeiling(4)
+
+	if l.Limit() != 4 || l.Ceiling() != 4 {
+		t.Fatalf("expected a lower ceiling to lower the rate, got rate %v and ceiling %v", l.Limit(), l.Ceiling())
+	}
+
+	l.SetCeiling(20)
+
+	if l.Limit() != 4 || l.Ceiling() != 20 {
+		t.Fatalf("expected a higher ceiling to keep the rate, got rate %v and ceiling %v", l.Limit(), l.Ceiling())
+	}
+}
+
+func TestIsThrottlingError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "ses v1 throttling", err: &smithy.GenericAPIError{Code: "Throttling"}, want: true},
+		{name: "sesv2 too many requests", err: &smithy.GenericAPIError{Code: "TooManyRequestsException"}, want: true},
+		{name: "wrapped throttling", err: fmt.Errorf("send failed: %w", &smithy.GenericAPIError{Code: "ThrottlingException"}), want: true},
+		{name: "other api error", err: &smithy.GenericAPIError{Code: "MessageRejected"}},
+		{name: "non api error", err: errors.New("connection reset")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isThrottlingError(tt.err); got != tt.want {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
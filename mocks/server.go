@@ -102,6 +102,48 @@ func (m *MockAmqpChannel) EXPECT() *MockAmqpChannelMockRecorder {
 	return m.recorder
 }
 
+// Cancel mocks base method.
+func (m *MockAmqpChannel) Cancel(arg0 string, arg1 bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Cancel", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Cancel indicates an expected call of Cancel.
+func (mr *MockAmqpChannelMockRecorder) Cancel(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Cancel", reflect.TypeOf((*MockAmqpChannel)(nil).Cancel), arg0, arg1)
+}
+
+// Close mocks base method.
+func (m *MockAmqpChannel) Close() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Close")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Close indicates an expected call of Close.
+func (mr *MockAmqpChannelMockRecorder) Close() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockAmqpChannel)(nil).Close))
+}
+
+// Confirm mocks base method.
+func (m *MockAmqpChannel) Confirm(arg0 bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Confirm", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Confirm indicates an expected call of Confirm.
+func (mr *MockAmqpChannelMockRecorder) Confirm(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Confirm", reflect.TypeOf((*MockAmqpChannel)(nil).Confirm), arg0)
+}
+
 // Consume mocks base method.
 func (m *MockAmqpChannel) Consume(arg0, arg1 string, arg2, arg3, arg4, arg5 bool, arg6 amqp091.Table) (<-chan amqp091.Delivery, error) {
 	m.ctrl.T.Helper()
@@ -131,6 +173,22 @@ func (mr *MockAmqpChannelMockRecorder) ExchangeDeclare(arg0, arg1, arg2, arg3, a
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExchangeDeclare", reflect.TypeOf((*MockAmqpChannel)(nil).ExchangeDeclare), arg0, arg1, arg2, arg3, arg4, arg5, arg6)
 }
 
+// Get mocks base method.
+func (m *MockAmqpChannel) Get(arg0 string, arg1 bool) (amqp091.Delivery, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get", arg0, arg1)
+	ret0, _ := ret[0].(amqp091.Delivery)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockAmqpChannelMockRecorder) Get(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockAmqpChannel)(nil).Get), arg0, arg1)
+}
+
 // NotifyClose mocks base method.
 func (m *MockAmqpChannel) NotifyClose(arg0 chan *amqp091.Error) chan *amqp091.Error {
 	m.ctrl.T.Helper()
@@ -145,6 +203,34 @@ func (mr *MockAmqpChannelMockRecorder) NotifyClose(arg0 interface{}) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NotifyClose", reflect.TypeOf((*MockAmqpChannel)(nil).NotifyClose), arg0)
 }
 
+// NotifyPublish mocks base method.
+func (m *MockAmqpChannel) NotifyPublish(arg0 chan amqp091.Confirmation) chan amqp091.Confirmation {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NotifyPublish", arg0)
+	ret0, _ := ret[0].(chan amqp091.Confirmation)
+	return ret0
+}
+
+// NotifyPublish indicates an expected call of NotifyPublish.
+func (mr *MockAmqpChannelMockRecorder) NotifyPublish(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NotifyPublish", reflect.TypeOf((*MockAmqpChannel)(nil).NotifyPublish), arg0)
+}
+
+// NotifyReturn mocks base method.
+func (m *MockAmqpChannel) NotifyReturn(arg0 chan amqp091.Return) chan amqp091.Return {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NotifyReturn", arg0)
+	ret0, _ := ret[0].(chan amqp091.Return)
+	return ret0
+}
+
+// NotifyReturn indicates an expected call of NotifyReturn.
+func (mr *MockAmqpChannelMockRecorder) NotifyReturn(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NotifyReturn", reflect.TypeOf((*MockAmqpChannel)(nil).NotifyReturn), arg0)
+}
+
 // PublishWithContext mocks base method.
 func (m *MockAmqpChannel) PublishWithContext(arg0 context.Context, arg1, arg2 string, arg3, arg4 bool, arg5 amqp091.Publishing) error {
 	m.ctrl.T.Helper()
@@ -159,6 +245,34 @@ func (mr *MockAmqpChannelMockRecorder) PublishWithContext(arg0, arg1, arg2, arg3
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PublishWithContext", reflect.TypeOf((*MockAmqpChannel)(nil).PublishWithContext), arg0, arg1, arg2, arg3, arg4, arg5)
 }
 
+// Qos mocks base method.
+func (m *MockAmqpChannel) Qos(arg0, arg1 int, arg2 bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Qos", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Qos indicates an expected call of Qos.
+func (mr *MockAmqpChannelMockRecorder) Qos(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Qos", reflect.TypeOf((*MockAmqpChannel)(nil).Qos), arg0, arg1, arg2)
+}
+
+// QueueBind mocks base method.
+func (m *MockAmqpChannel) QueueBind(arg0, arg1, arg2 string, arg3 bool, arg4 amqp091.Table) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "QueueBind", arg0, arg1, arg2, arg3, arg4)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// QueueBind indicates an expected call of QueueBind.
+func (mr *MockAmqpChannelMockRecorder) QueueBind(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "QueueBind", reflect.TypeOf((*MockAmqpChannel)(nil).QueueBind), arg0, arg1, arg2, arg3, arg4)
+}
+
 // QueueDeclare mocks base method.
 func (m *MockAmqpChannel) QueueDeclare(arg0 string, arg1, arg2, arg3, arg4 bool, arg5 amqp091.Table) (amqp091.Queue, error) {
 	m.ctrl.T.Helper()
@@ -226,6 +340,20 @@ func (mr *MockAmqpConnectionMockRecorder) Close() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockAmqpConnection)(nil).Close))
 }
 
+// NotifyClose mocks base method.
+func (m *MockAmqpConnection) NotifyClose(arg0 chan *amqp091.Error) chan *amqp091.Error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NotifyClose", arg0)
+	ret0, _ := ret[0].(chan *amqp091.Error)
+	return ret0
+}
+
+// NotifyClose indicates an expected call of NotifyClose.
+func (mr *MockAmqpConnectionMockRecorder) NotifyClose(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NotifyClose", reflect.TypeOf((*MockAmqpConnection)(nil).NotifyClose), arg0)
+}
+
 // MockConnector is a mock of Connector interface.
 type MockConnector struct {
 	ctrl     *gomock.Controller
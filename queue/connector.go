@@ -1,8 +1,16 @@
 package queue
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"log"
+	"mailer-ms/config"
 	"mailer-ms/queue/interfaces"
+	"math/rand"
+	"os"
+	"strings"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -20,10 +28,88 @@ func (w AmqpConnectionWrapper) Channel() (interfaces.AmqpChannel, error) {
 	return w.conn.Channel()
 }
 
-type Connector struct{}
+func (w AmqpConnectionWrapper) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	return w.conn.NotifyClose(c)
+}
+
+// Connector dials rabbitmq with the tls, authentication and connection properties of the config
+type Connector struct {
+	Config amqp.Config
+}
+
+// NewConnector creates a connector from the rmq config, loading its tls certificates
+func NewConnector(cfg config.RmqConfig) (*Connector, error) {
+	properties := amqp.NewConnectionProperties()
+	properties.SetClientConnectionName(cfg.ConnectionName)
+
+	c := &Connector{
+		Config: amqp.Config{
+			Vhost:      cfg.Vhost,
+			Heartbeat:  time.Second * time.Duration(cfg.Heartbeat),
+			Locale:     "en_US",
+			Properties: properties,
+		},
+	}
+
+	tlsConfig, err := newTlsConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig != nil {
+		if !strings.HasPrefix(cfg.Url, "amqps://") {
+			return nil, errors.New("rmq tls requires a amqps:// url")
+		}
+
+		c.Config.TLSClientConfig = tlsConfig
+	}
+
+	if cfg.ExternalAuth {
+		if tlsConfig == nil || len(tlsConfig.Certificates) == 0 {
+			return nil, errors.New("rmq external auth requires a tls client certificate")
+		}
+
+		c.Config.SASL = []amqp.Authentication{&amqp.ExternalAuth{}}
+	}
+
+	return c, nil
+}
+
+// newTlsConfig creates the tls config of the rmq config, nil if no tls option is set
+func newTlsConfig(cfg config.RmqConfig) (*tls.Config, error) {
+	if cfg.TlsCaFile == "" && cfg.TlsCertFile == "" && cfg.TlsServerName == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{ServerName: cfg.TlsServerName, MinVersion: tls.VersionTLS12}
+
+	if cfg.TlsCaFile != "" {
+		ca, err := os.ReadFile(cfg.TlsCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rmq tls ca bundle: %w", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates found on the rmq tls ca bundle")
+		}
+	}
+
+	if cfg.TlsCertFile != "" || cfg.TlsKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TlsCertFile, cfg.TlsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load rmq tls client certificate: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
 
 func (c *Connector) Connect(url string) (interfaces.AmqpConnection, error) {
-	conn, err := amqp.Dial(url)
+	conn, err := amqp.DialConfig(url, c.Config)
 	if err != nil {
 		return nil, err
 	}
@@ -31,68 +117,387 @@ func (c *Connector) Connect(url string) (interfaces.AmqpConnection, error) {
 	return AmqpConnectionWrapper{conn}, nil
 }
 
-func (s *Server) connect() {
+// connect connects to rabbitmq, declaring and consuming the queues, retrying with exponential
+// backoff until it succeeds or the server is stopped, returns false if the server was stopped
+func (s *Server) connect() bool {
 	currentAttempt := 1
-	sleepTime := time.Second * time.Duration(s.cfg.ReconnectWaitTime)
+	wait := s.reconnectWait()
 
 	for {
+		if s.isStopping() {
+			return false
+		}
+
 		log.Printf("[ RMQ ] trying to connect, attempt: %d", currentAttempt)
 
-		con, err := s.Connector.Connect(s.cfg.Url)
+		err := s.setup()
+		if err == nil {
+			log.Printf("[ RMQ ] connected")
+			return true
+		}
+
+		log.Printf("[ RMQ ] connection failed: %v, retrying in %s", err, wait)
 
-		if err != nil || con == nil {
-			log.Printf("[ RMQ ] connection failed %v", err)
+		time.Sleep(wait)
 
-			currentAttempt++
-			time.Sleep(sleepTime)
+		currentAttempt++
+		wait = s.nextBackoff(wait)
+	}
+}
 
-			continue
+// reconnectWait returns the wait time of the first reconnection attempt, at least one second
+func (s *Server) reconnectWait() time.Duration {
+	wait := time.Second * time.Duration(s.cfg.ReconnectWaitTime)
+
+	if wait <= 0 {
+		wait = time.Second
+	}
+
+	return wait
+}
+
+// nextBackoff doubles the wait time up to the max wait time, with up to 20% of jitter so
+// replicas disconnected at the same time do not reconnect at the same time
+func (s *Server) nextBackoff(wait time.Duration) time.Duration {
+	maxWait := time.Second * time.Duration(s.cfg.ReconnectMaxWaitTime)
+
+	wait *= 2
+
+	if wait > maxWait {
+		wait = maxWait
+	}
+
+	if wait <= 0 {
+		wait = time.Second
+	}
+
+	return wait + time.Duration(rand.Int63n(int64(wait/5)+1))
+}
+
+// setup opens the connection and channel, declares the queues and starts the consumers,
+// on failure the connection is closed so the next attempt starts from scratch
+func (s *Server) setup() error {
+	con, err := s.Connector.Connect(s.cfg.Url)
+	if err != nil {
+		return err
+	}
+
+	channel, err := con.Channel()
+	if err != nil {
+		con.Close()
+		return err
+	}
+
+	if err := s.declare(channel); err != nil {
+		con.Close()
+		return err
+	}
+
+	if s.cfg.AdminQueue != "" && s.AdminConsumerFn != nil {
+		if err := s.startAdminConsumer(channel); err != nil {
+			con.Close()
+			return err
+		}
+	}
+
+	// a pause broadcasted while this replica was not connected is applied before consuming
+	fleetPaused := false
+
+	if s.cfg.AdminExchange != "" {
+		if err := s.startBroadcastConsumer(channel); err != nil {
+			con.Close()
+			return err
+		}
+
+		if fleetPaused, err = s.loadPauseState(channel); err != nil {
+			con.Close()
+			return err
 		}
+	}
+
+	publishers, err := s.openPublishers(con)
+	if err != nil {
+		con.Close()
+		return err
+	}
 
+	s.notifyConnClose = con.NotifyClose(make(chan *amqp.Error, 1))
+	s.notifyChanClose = channel.NotifyClose(make(chan *amqp.Error, 1))
+
+	if err := channel.Qos(s.cfg.Prefetch, 0, false); err != nil {
+		con.Close()
+		return err
+	}
+
+	// a single replica consumes a stream, since every consumer receives every message of it
+	standby := false
+
+	if s.offsets != nil {
+		locked, err := s.acquireStreamLock(con)
+		if err != nil {
+			con.Close()
+			return err
+		}
+
+		standby = !locked
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.standby = standby
+
+	if fleetPaused && !s.pauseReasons[OperatorPause] {
+		if s.pauseReasons == nil {
+			s.pauseReasons = make(map[string]bool)
+		}
+
+		s.pauseReasons[OperatorPause] = true
+		log.Printf("[ RMQ ] mail requests consumption paused, reason: %s", OperatorPause)
+	}
+
+	if err := s.startConsumer(channel); err != nil {
+		con.Close()
+		return err
+	}
+
+	s.conn = con
+	s.channel = channel
+	s.publishers = publishers
+	s.connected = true
+
+	if standby {
+		log.Printf("[ RMQ ] the stream lock is held by another replica, standing by")
+		go s.waitForStreamLock(con, s.reconnectWait())
+	} else if s.offsets != nil {
+		go s.storeStreamOffsets(con)
+	}
+
+	return nil
+}
+
+// openPublishers opens the confirm mode channels of the publish pool, a closed channel is replaced by
+// a new channel of the connection once taken from the pool, without closing the connection
+func (s *Server) openPublishers(con interfaces.AmqpConnection) (*publishPool, error) {
+	size := s.cfg.PublishChannels
+	if size < 1 {
+		size = 1
+	}
+
+	timeout := time.Second * time.Duration(s.cfg.PublishTimeout)
+
+	open := func() (*confirmChannel, error) {
 		channel, err := con.Channel()
 		if err != nil {
-			log.Printf("[ RMQ ] connection channel failed %v", err)
+			return nil, err
+		}
+
+		return newConfirmChannel(channel, timeout)
+	}
+
+	channels := make([]*confirmChannel, size)
+
+	for i := range channels {
+		var err error
+
+		if channels[i], err = open(); err != nil {
+			return nil, err
+		}
+	}
+
+	return newPublishPool(channels, open), nil
+}
 
-			currentAttempt++
-			time.Sleep(sleepTime)
+// queueArgs returns the declare args of the mail requests queue type
+func (s *Server) queueArgs() amqp.Table {
+	switch s.cfg.QueueType {
+	case QuorumQueue:
+		args := amqp.Table{"x-queue-type": QuorumQueue}
 
+		if s.cfg.DeliveryLimit > 0 {
+			args["x-delivery-limit"] = s.cfg.DeliveryLimit
+		}
+
+		return args
+	case StreamQueue:
+		return amqp.Table{"x-queue-type": StreamQueue}
+	default:
+		return nil
+	}
+}
+
+// declare declares the topology of the config and the service queues not listed on it
+func (s *Server) declare(channel interfaces.AmqpChannel) error {
+	if err := s.declareTopology(channel); err != nil {
+		return err
+	}
+
+	if !declaredByTopology(s.cfg.Topology, s.cfg.Queue) {
+		_, err := channel.QueueDeclare(
+			s.cfg.Queue,   // name
+			true,          // durable
+			false,         // autodelete
+			false,         // exclusive
+			false,         // nowait
+			s.queueArgs(), // args
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.offsets != nil && !declaredByTopology(s.cfg.Topology, StreamOffsetsName(s.cfg.Queue)) {
+		if err := s.declareStreamOffsets(channel); err != nil {
+			return err
+		}
+	}
+
+	// mail requests failing more than the poison threshold are parked for investigation
+	if s.cfg.PoisonThreshold > 0 && !declaredByTopology(s.cfg.Topology, s.cfg.ParkingQueue) {
+		_, err := channel.QueueDeclare(
+			s.cfg.ParkingQueue, // name
+			true,               // durable
+			false,              // autodelete
+			false,              // exclusive
+			false,              // nowait
+			nil,                // args
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	// requests over their send limits wait on the queue of their delay tier until the queue message
+	// ttl expires and are dead lettered back to the mail requests queue, since every message of a
+	// queue has the same ttl the messages expire in order and none waits behind a longer delay
+	for _, tier := range s.cfg.DelayTiers {
+		name := DelayQueueName(s.cfg.DelayQueue, time.Duration(tier)*time.Second)
+
+		if declaredByTopology(s.cfg.Topology, name) {
 			continue
 		}
 
-		_, err = channel.QueueDeclare(
-			s.cfg.Queue, // name
-			true,        // durable
-			false,       // autodelete
-			false,       // exclusive
-			false,       // nowait
-			nil,         // args
+		_, err := channel.QueueDeclare(
+			name,  // name
+			true,  // durable
+			false, // autodelete
+			false, // exclusive
+			false, // nowait
+			amqp.Table{
+				"x-message-ttl":             tier * 1000,
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": s.cfg.Queue,
+			},
 		)
 		if err != nil {
-			log.Fatalf("[ RMQ ] failed to declare exchange: %v ", err)
+			return err
+		}
+	}
+
+	for _, name := range s.Queues {
+		if declaredByTopology(s.cfg.Topology, name) {
+			continue
 		}
 
-		s.deliveries, err = channel.Consume(
-			s.cfg.Queue, // queue
-			"",          // consumer
-			false,       // autoack
-			false,       // exclusive
-			false,       // nolocal
-			false,       // nowait
-			nil,         // args
+		_, err := channel.QueueDeclare(
+			name,  // name
+			true,  // durable
+			false, // autodelete
+			false, // exclusive
+			false, // nowait
+			nil,   // args
 		)
 		if err != nil {
-			log.Fatalf("[ RMQ ] failed to consume mail requests queue: %v ", err)
+			return err
 		}
+	}
 
-		s.conn = con
-		s.channel = channel
+	return nil
+}
 
-		s.notifyClose = make(chan *amqp.Error, 1024)
-		s.channel.NotifyClose(s.notifyClose)
+func (s *Server) startAdminConsumer(channel interfaces.AmqpChannel) error {
+	if !declaredByTopology(s.cfg.Topology, s.cfg.AdminQueue) {
+		_, err := channel.QueueDeclare(
+			s.cfg.AdminQueue, // name
+			true,             // durable
+			false,            // autodelete
+			false,            // exclusive
+			false,            // nowait
+			nil,              // args
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	deliveries, err := channel.Consume(
+		s.cfg.AdminQueue, // queue
+		"",               // consumer
+		false,            // autoack
+		false,            // exclusive
+		false,            // nolocal
+		false,            // nowait
+		nil,              // args
+	)
+	if err != nil {
+		return err
+	}
+
+	go consume(deliveries, s.AdminConsumerFn)
 
-		s.startConsumer()
+	return nil
+}
 
-		log.Printf("[ RMQ ] connected")
-		return
+// startBroadcastConsumer consumes the pause and resume requests broadcasted on the admin exchange with
+// a exclusive queue, deleted once the connection closes, so every replica receives every request
+func (s *Server) startBroadcastConsumer(channel interfaces.AmqpChannel) error {
+	err := channel.ExchangeDeclare(
+		s.cfg.AdminExchange, // name
+		amqp.ExchangeFanout, // kind
+		true,                // durable
+		false,               // autodelete
+		false,               // internal
+		false,               // nowait
+		nil,                 // args
+	)
+	if err != nil {
+		return err
 	}
+
+	if err := s.declarePauseState(channel); err != nil {
+		return err
+	}
+
+	queue, err := channel.QueueDeclare(
+		"",    // name, generated by the server
+		false, // durable
+		true,  // autodelete
+		true,  // exclusive
+		false, // nowait
+		nil,   // args
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := channel.QueueBind(queue.Name, "", s.cfg.AdminExchange, false, nil); err != nil {
+		return err
+	}
+
+	deliveries, err := channel.Consume(
+		queue.Name, // queue
+		"",         // consumer
+		true,       // autoack
+		true,       // exclusive
+		false,      // nolocal
+		false,      // nowait
+		nil,        // args
+	)
+	if err != nil {
+		return err
+	}
+
+	go s.handleBroadcasts(deliveries)
+
+	return nil
 }
@@ -0,0 +1,553 @@
+package queue
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"mailer-ms/config"
+	"mailer-ms/mocks"
+	"mailer-ms/queue/interfaces"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// mockConnection is a connection whose channels accept every declaration, but the stream lock while
+// lockHeld is set, its close notification channels are kept so the tests can close the connection or
+// channel as the broker would
+type mockConnection struct {
+	conn    *mocks.MockAmqpConnection
+	channel *mocks.MockAmqpChannel
+
+	mu           sync.Mutex
+	connClose    chan *amqp.Error
+	channelClose []chan *amqp.Error
+	lockHeld     bool
+
+	// type of the broadcast retained on the pause state queue, none if empty
+	pauseState string
+}
+
+func newMockConnection(ctrl *gomock.Controller) *mockConnection {
+	m := &mockConnection{conn: mocks.NewMockAmqpConnection(ctrl), channel: mocks.NewMockAmqpChannel(ctrl)}
+
+	m.conn.EXPECT().Channel().Return(m.channel, nil).AnyTimes()
+	m.conn.EXPECT().Close().Return(nil).AnyTimes()
+	m.conn.EXPECT().NotifyClose(gomock.Any()).DoAndReturn(func(c chan *amqp.Error) chan *amqp.Error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		m.connClose = c
+		return c
+	}).AnyTimes()
+
+	m.channel.EXPECT().NotifyClose(gomock.Any()).DoAndReturn(func(c chan *amqp.Error) chan *amqp.Error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		m.channelClose = append(m.channelClose, c)
+		return c
+	}).AnyTimes()
+
+	m.channel.EXPECT().QueueDeclare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+
+			if exclusive && strings.HasSuffix(name, ".lock") && m.lockHeld {
+				return amqp.Queue{}, &amqp.Error{Code: amqp.ResourceLocked, Reason: "RESOURCE_LOCKED"}
+			}
+
+			return amqp.Queue{Name: name}, nil
+		}).
+		AnyTimes()
+
+	m.channel.EXPECT().Close().AnyTimes()
+	m.channel.EXPECT().ExchangeDeclare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+	m.channel.EXPECT().QueueBind(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+	m.channel.EXPECT().Qos(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+	m.channel.EXPECT().Confirm(false).AnyTimes()
+	m.channel.EXPECT().NotifyPublish(gomock.Any()).DoAndReturn(func(c chan amqp.Confirmation) chan amqp.Confirmation { return c }).AnyTimes()
+	m.channel.EXPECT().NotifyReturn(gomock.Any()).DoAndReturn(func(c chan amqp.Return) chan amqp.Return { return c }).AnyTimes()
+	m.channel.EXPECT().Consume(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(make(<-chan amqp.Delivery), nil).
+		AnyTimes()
+	m.channel.EXPECT().Get(gomock.Any(), false).DoAndReturn(func(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if !strings.HasSuffix(queue, pauseStateSuffix) || m.pauseState == "" {
+			return amqp.Delivery{}, false, nil
+		}
+
+		return amqp.Delivery{Acknowledger: &fakeAcknowledger{}, DeliveryTag: 1, Type: m.pauseState}, true, nil
+	}).AnyTimes()
+
+	return m
+}
+
+// closeConnection closes the connection as the broker would, with a close error
+func (m *mockConnection) closeConnection() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.connClose <- &amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED"}
+}
+
+func newTestServer(connector *mocks.MockConnector) *Server {
+	return &Server{
+		Connector: connector,
+		Publisher: &Publisher{},
+		cfg: config.RmqConfig{
+			Url:             "amqp://localhost",
+			Queue:           "mail_requests",
+			DelayQueue:      "mail_requests_delayed",
+			DelayTiers:      []int{1},
+			QueueType:       ClassicQueue,
+			Prefetch:        20,
+			PublishChannels: 2,
+			PublishTimeout:  1,
+		},
+		ConsumerFn: func(*amqp.Delivery) {},
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxWait int
+		wait    time.Duration
+		want    time.Duration
+	}{
+		{name: "doubles the wait", maxWait: 60, wait: time.Second, want: 2 * time.Second},
+		{name: "is capped by the max wait", maxWait: 60, wait: 40 * time.Second, want: 60 * time.Second},
+		{name: "waits at least a second", maxWait: 0, wait: 0, want: time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{cfg: config.RmqConfig{ReconnectMaxWaitTime: tt.maxWait}}
+
+			for i := 0; i < 100; i++ {
+				got := s.nextBackoff(tt.wait)
+
+				// up to 20% of jitter is added
+				if got < tt.want || got > tt.want+tt.want/5 {
+					t.Fatalf("nextBackoff(%s) = %s, want between %s and %s", tt.wait, got, tt.want, tt.want+tt.want/5)
+				}
+			}
+		})
+	}
+}
+
+func TestConnect(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		stopped      bool
+		wantOk       bool
+		wantAttempts int
+	}{
+		{name: "connects on the first attempt", wantOk: true, wantAttempts: 1},
+		{name: "retries failed attempts", failures: 1, wantOk: true, wantAttempts: 2},
+		{name: "stopped server does not connect", stopped: true, wantAttempts: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			connector := mocks.NewMockConnector(ctrl)
+			conn := newMockConnection(ctrl)
+
+			attempts := 0
+
+			connector.EXPECT().Connect("amqp://localhost").DoAndReturn(func(url string) (interfaces.AmqpConnection, error) {
+				attempts++
+
+				if attempts <= tt.failures {
+					return nil, errors.New("connection refused")
+				}
+
+				return conn.conn, nil
+			}).AnyTimes()
+
+			s := newTestServer(connector)
+			s.stopping = tt.stopped
+
+			if ok := s.connect(); ok != tt.wantOk {
+				t.Fatalf("connect() = %v, want %v", ok, tt.wantOk)
+			}
+
+			if attempts != tt.wantAttempts {
+				t.Errorf("expected %d attempts, got %d", tt.wantAttempts, attempts)
+			}
+
+			if s.Connected() != tt.wantOk {
+				t.Errorf("Connected() = %v, want %v", s.Connected(), tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestSetupClosesTheConnectionOnFailure(t *testing.T) {
+	failure := errors.New("channel closed")
+
+	tests := []struct {
+		name   string
+		expect func(channel *mocks.MockAmqpChannel)
+	}{
+		{
+			name: "declare fails",
+			expect: func(channel *mocks.MockAmqpChannel) {
+				channel.EXPECT().QueueDeclare("mail_requests", true, false, false, false, nil).Return(amqp.Queue{}, failure)
+			},
+		},
+		{
+			name: "confirm mode fails",
+			expect: func(channel *mocks.MockAmqpChannel) {
+				channel.EXPECT().QueueDeclare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(amqp.Queue{}, nil).AnyTimes()
+				channel.EXPECT().Confirm(false).Return(failure)
+			},
+		},
+		{
+			name: "qos fails",
+			expect: func(channel *mocks.MockAmqpChannel) {
+				channel.EXPECT().QueueDeclare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(amqp.Queue{}, nil).AnyTimes()
+				channel.EXPECT().Confirm(false).AnyTimes()
+				channel.EXPECT().NotifyPublish(gomock.Any()).AnyTimes()
+				channel.EXPECT().NotifyReturn(gomock.Any()).AnyTimes()
+				channel.EXPECT().NotifyClose(gomock.Any()).AnyTimes()
+				channel.EXPECT().Qos(20, 0, false).Return(failure)
+			},
+		},
+		{
+			name: "consume fails",
+			expect: func(channel *mocks.MockAmqpChannel) {
+				channel.EXPECT().QueueDeclare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(amqp.Queue{}, nil).AnyTimes()
+				channel.EXPECT().Confirm(false).AnyTimes()
+				channel.EXPECT().NotifyPublish(gomock.Any()).AnyTimes()
+				channel.EXPECT().NotifyReturn(gomock.Any()).AnyTimes()
+				channel.EXPECT().NotifyClose(gomock.Any()).AnyTimes()
+				channel.EXPECT().Qos(20, 0, false)
+				channel.EXPECT().Consume("mail_requests", gomock.Any(), false, false, false, false, nil).Return(nil, failure)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			connector := mocks.NewMockConnector(ctrl)
+			conn := mocks.NewMockAmqpConnection(ctrl)
+			channel := mocks.NewMockAmqpChannel(ctrl)
+
+			connector.EXPECT().Connect("amqp://localhost").Return(conn, nil)
+			conn.EXPECT().Channel().Return(channel, nil).AnyTimes()
+			conn.EXPECT().NotifyClose(gomock.Any()).AnyTimes()
+			conn.EXPECT().Close()
+
+			tt.expect(channel)
+
+			s := newTestServer(connector)
+
+			if err := s.setup(); !errors.Is(err, failure) {
+				t.Fatalf("expected the setup to fail with %v, got %v", failure, err)
+			}
+
+			if s.Connected() {
+				t.Fatal("expected the server to not be connected")
+			}
+		})
+	}
+}
+
+func TestStartReconnects(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	connector := mocks.NewMockConnector(ctrl)
+
+	first := newMockConnection(ctrl)
+	second := newMockConnection(ctrl)
+
+	gomock.InOrder(
+		connector.EXPECT().Connect("amqp://localhost").Return(first.conn, nil),
+		connector.EXPECT().Connect("amqp://localhost").Return(second.conn, nil),
+	)
+
+	s := newTestServer(connector)
+
+	s.Start()
+
+	waitUntil(t, func() bool { return s.currentConn() == first.conn }, "the first connection")
+
+	first.closeConnection()
+
+	waitUntil(t, func() bool { return s.currentConn() == second.conn && s.Connected() }, "the reconnection")
+
+	s.Stop()
+}
+
+// currentConn returns the connection of the server, nil if it never connected
+func (s *Server) currentConn() interfaces.AmqpConnection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conn
+}
+
+// waitUntil polls the condition, failing the test if it is not met within a few seconds
+func waitUntil(t *testing.T, condition func() bool, what string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStartKeepsTheConnectionWhenAPublishChannelCloses(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	connector := mocks.NewMockConnector(ctrl)
+	conn := newMockConnection(ctrl)
+
+	// a second connection would fail the test
+	connector.EXPECT().Connect("amqp://localhost").Return(conn.conn, nil)
+
+	s := newTestServer(connector)
+
+	s.Start()
+
+	waitUntil(t, s.Connected, "the connection")
+
+	// the publish channels are opened before the consume channel
+	conn.mu.Lock()
+	conn.channelClose[0] <- &amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED"}
+	conn.mu.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+
+	if !s.Connected() || s.currentConn() != conn.conn {
+		t.Fatal("expected the server to stay connected with the same connection")
+	}
+}
+
+// writeTestCertificate writes a self signed certificate and its key as pem files, returning their paths
+func writeTestCertificate(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mail-sender"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return certFile, keyFile
+}
+
+func TestNewTlsConfig(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+
+	notPem := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(notPem, []byte("not a certificate"), 0600)
+
+	tests := []struct {
+		name      string
+		cfg       config.RmqConfig
+		wantNil   bool
+		wantCAs   bool
+		wantCerts int
+		wantErr   string
+	}{
+		{
+			name:    "no tls options",
+			wantNil: true,
+		},
+		{
+			name: "server name only verifies against the system roots",
+			cfg:  config.RmqConfig{TlsServerName: "rabbitmq.rastercar.com"},
+		},
+		{
+			name:    "ca bundle",
+			cfg:     config.RmqConfig{TlsCaFile: certFile},
+			wantCAs: true,
+		},
+		{
+			name:      "client certificate",
+			cfg:       config.RmqConfig{TlsCaFile: certFile, TlsCertFile: certFile, TlsKeyFile: keyFile},
+			wantCAs:   true,
+			wantCerts: 1,
+		},
+		{
+			name:    "missing ca bundle",
+			cfg:     config.RmqConfig{TlsCaFile: filepath.Join(t.TempDir(), "missing.pem")},
+			wantErr: "failed to read rmq tls ca bundle",
+		},
+		{
+			name:    "ca bundle without certificates",
+			cfg:     config.RmqConfig{TlsCaFile: notPem},
+			wantErr: "no certificates found",
+		},
+		{
+			name:    "client certificate without key",
+			cfg:     config.RmqConfig{TlsCertFile: certFile},
+			wantErr: "failed to load rmq tls client certificate",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := newTlsConfig(tt.cfg)
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tt.wantNil {
+				if tlsConfig != nil {
+					t.Fatal("expected no tls config")
+				}
+				return
+			}
+
+			if tlsConfig.ServerName != tt.cfg.TlsServerName || tlsConfig.MinVersion != tls.VersionTLS12 {
+				t.Errorf("unexpected server name %q or min version %d", tlsConfig.ServerName, tlsConfig.MinVersion)
+			}
+
+			if (tlsConfig.RootCAs != nil) != tt.wantCAs {
+				t.Errorf("expected the ca bundle to be loaded: %v", tt.wantCAs)
+			}
+
+			if len(tlsConfig.Certificates) != tt.wantCerts {
+				t.Errorf("expected %d client certificates, got %d", tt.wantCerts, len(tlsConfig.Certificates))
+			}
+		})
+	}
+}
+
+func TestNewConnector(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+
+	tests := []struct {
+		name         string
+		cfg          config.RmqConfig
+		wantTls      bool
+		wantExternal bool
+		wantErr      string
+	}{
+		{
+			name: "plain connection",
+			cfg:  config.RmqConfig{Url: "amqp://localhost", ConnectionName: "mail-sender", Vhost: "mail", Heartbeat: 10},
+		},
+		{
+			name:    "tls connection",
+			cfg:     config.RmqConfig{Url: "amqps://localhost", TlsCaFile: certFile},
+			wantTls: true,
+		},
+		{
+			name:    "tls options without a amqps url",
+			cfg:     config.RmqConfig{Url: "amqp://localhost", TlsCaFile: certFile},
+			wantErr: "requires a amqps:// url",
+		},
+		{
+			name:         "external auth with a client certificate",
+			cfg:          config.RmqConfig{Url: "amqps://localhost", TlsCertFile: certFile, TlsKeyFile: keyFile, ExternalAuth: true},
+			wantTls:      true,
+			wantExternal: true,
+		},
+		{
+			name:    "external auth without a client certificate",
+			cfg:     config.RmqConfig{Url: "amqps://localhost", TlsCaFile: certFile, ExternalAuth: true},
+			wantErr: "requires a tls client certificate",
+		},
+		{
+			name:    "external auth without tls",
+			cfg:     config.RmqConfig{Url: "amqp://localhost", ExternalAuth: true},
+			wantErr: "requires a tls client certificate",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connector, err := NewConnector(tt.cfg)
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if (connector.Config.TLSClientConfig != nil) != tt.wantTls {
+				t.Errorf("expected tls to be configured: %v", tt.wantTls)
+			}
+
+			external := len(connector.Config.SASL) == 1 && connector.Config.SASL[0].Mechanism() == (&amqp.ExternalAuth{}).Mechanism()
+
+			if external != tt.wantExternal {
+				t.Errorf("expected external auth: %v, got SASL %v", tt.wantExternal, connector.Config.SASL)
+			}
+
+			if connector.Config.Vhost != tt.cfg.Vhost || connector.Config.Heartbeat != time.Duration(tt.cfg.Heartbeat)*time.Second {
+				t.Errorf("unexpected vhost %q or heartbeat %s", connector.Config.Vhost, connector.Config.Heartbeat)
+			}
+
+			if name := connector.Config.Properties["connection_name"]; name != tt.cfg.ConnectionName {
+				t.Errorf("expected the connection name %q, got %v", tt.cfg.ConnectionName, name)
+			}
+		})
+	}
+}
@@ -1,7 +1,248 @@
 package queue
 
-func (s *Server) startConsumer() {
-	for d := range s.deliveries {
-		go s.ConsumerFn(&d)
+import (
+	"context"
+	"log"
+	"mailer-ms/queue/interfaces"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Pause reason of the pauses requested by operators, with the admin endpoints, queue or signal
+const OperatorPause = "operator"
+
+// Types of the messages broadcasted on the admin exchange
+const (
+	broadcastPause  = "pause"
+	broadcastResume = "resume"
+)
+
+// Suffix of the queue bound to the admin exchange that retains its last broadcast, so
+// the replicas started after a pause was broadcasted are paused before consuming
+const pauseStateSuffix = ".state"
+
+// startConsumer consumes the mail requests queue on the channel, unless paused or standing by for
+// the stream lock, must be called with s.mu locked
+func (s *Server) startConsumer(channel interfaces.AmqpChannel) error {
+	if len(s.pauseReasons) > 0 || s.standby {
+		return nil
+	}
+
+	tag := "mail-sender-" + uuid.NewString()
+
+	var args amqp.Table
+
+	if s.offsets != nil {
+		args = s.offsets.consumeArgs()
+	}
+
+	deliveries, err := channel.Consume(
+		s.cfg.Queue, // queue
+		tag,         // consumer
+		false,       // autoack
+		false,       // exclusive
+		false,       // nolocal
+		false,       // nowait
+		args,        // args
+	)
+	if err != nil {
+		return err
+	}
+
+	s.consumerTag = tag
+
+	if s.offsets != nil {
+		deliveries = s.offsets.trackDeliveries(deliveries)
+	}
+
+	go consume(deliveries, s.handleMailRequest)
+
+	return nil
+}
+
+func consume(deliveries <-chan amqp.Delivery, consumerFn func(deliver *amqp.Delivery)) {
+	for d := range deliveries {
+		d := d
+		go consumerFn(&d)
+	}
+}
+
+// Pause stops consuming the mail requests queue until Resume is called with the same reason and
+// no other pause reason remains, the pause is kept across reconnections. deliveries already consumed
+// (up to the prefetch) are still handled, so handlers should requeue them while Paused returns true
+func (s *Server) Pause(reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pauseReasons[reason] {
+		return nil
+	}
+
+	if s.pauseReasons == nil {
+		s.pauseReasons = make(map[string]bool)
+	}
+
+	s.pauseReasons[reason] = true
+	log.Printf("[ RMQ ] mail requests consumption paused, reason: %s", reason)
+
+	// the consumer is gone once disconnected
+	if !s.connected || s.channel == nil || s.consumerTag == "" {
+		return nil
+	}
+
+	tag := s.consumerTag
+	s.consumerTag = ""
+
+	return s.channel.Cancel(tag, false)
+}
+
+// Resume removes a pause reason, consuming the mail requests queue again if no other reason remains
+func (s *Server) Resume(reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.pauseReasons[reason] {
+		return nil
+	}
+
+	delete(s.pauseReasons, reason)
+
+	if len(s.pauseReasons) > 0 {
+		log.Printf("[ RMQ ] mail requests consumption still paused, reasons: %s", strings.Join(s.sortedPauseReasons(), ", "))
+		return nil
+	}
+
+	log.Printf("[ RMQ ] mail requests consumption resumed")
+
+	// consumption starts once connected
+	if !s.connected || s.channel == nil {
+		return nil
+	}
+
+	return s.startConsumer(s.channel)
+}
+
+// PauseAll pauses the mail requests consumption of this replica and broadcasts the pause to every
+// other replica with the admin exchange, this replica is paused even if the broadcast fails
+func (s *Server) PauseAll(ctx context.Context) error {
+	if err := s.Pause(OperatorPause); err != nil {
+		return err
+	}
+
+	return s.broadcast(ctx, broadcastPause)
+}
+
+// ResumeAll resumes the mail requests consumption of this replica and broadcasts the resume to
+// every other replica with the admin exchange, this replica is resumed even if the broadcast fails
+func (s *Server) ResumeAll(ctx context.Context) error {
+	if err := s.Resume(OperatorPause); err != nil {
+		return err
+	}
+
+	return s.broadcast(ctx, broadcastResume)
+}
+
+func (s *Server) broadcast(ctx context.Context, action string) error {
+	if s.cfg.AdminExchange == "" {
+		return nil
+	}
+
+	return s.Publish(ctx, s.cfg.AdminExchange, "", amqp.Publishing{Type: action})
+}
+
+// declarePauseState declares the queue retaining the last broadcast of the admin exchange, older
+// broadcasts are dropped from its head so it only holds the current pause state of the replicas
+func (s *Server) declarePauseState(channel interfaces.AmqpChannel) error {
+	name := s.cfg.AdminExchange + pauseStateSuffix
+
+	_, err := channel.QueueDeclare(
+		name,  // name
+		true,  // durable
+		false, // autodelete
+		false, // exclusive
+		false, // nowait
+		amqp.Table{
+			"x-max-length": 1,
+			"x-overflow":   "drop-head",
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	return channel.QueueBind(name, "", s.cfg.AdminExchange, false, nil)
+}
+
+// loadPauseState returns if the last broadcast of the admin exchange was a pause, the broadcast is
+// requeued so it is retained for the replicas connecting next
+func (s *Server) loadPauseState(channel interfaces.AmqpChannel) (bool, error) {
+	d, ok, err := channel.Get(s.cfg.AdminExchange+pauseStateSuffix, false)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if err := d.Nack(false, true); err != nil {
+		return false, err
 	}
+
+	return d.Type == broadcastPause, nil
+}
+
+// handleBroadcasts applies the pause and resume requests broadcasted by any replica, including this one
+func (s *Server) handleBroadcasts(deliveries <-chan amqp.Delivery) {
+	for d := range deliveries {
+		var err error
+
+		switch d.Type {
+		case broadcastPause:
+			err = s.Pause(OperatorPause)
+		case broadcastResume:
+			err = s.Resume(OperatorPause)
+		default:
+			log.Printf("[ RMQ ] ignoring unknown admin broadcast: %q", d.Type)
+		}
+
+		if err != nil {
+			log.Printf("[ RMQ ] failed to apply the admin broadcast %s: %v", d.Type, err)
+		}
+	}
+}
+
+// Paused returns if the mail requests consumption is paused
+func (s *Server) Paused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.pauseReasons) > 0
+}
+
+// PauseReasons returns why the mail requests consumption is paused, empty if not paused
+func (s *Server) PauseReasons() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sortedPauseReasons()
+}
+
+func (s *Server) sortedPauseReasons() []string {
+	reasons := make([]string, 0, len(s.pauseReasons))
+
+	for reason := range s.pauseReasons {
+		reasons = append(reasons, reason)
+	}
+
+	sort.Strings(reasons)
+
+	return reasons
+}
+
+// Connected returns if the server is connected and consuming, unless paused
+func (s *Server) Connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.connected
 }
@@ -0,0 +1,279 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"mailer-ms/config"
+	"mailer-ms/mocks"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestPauseResume(t *testing.T) {
+	tests := []struct {
+		name      string
+		connected bool
+
+		// pause reasons set before the calls
+		reasons []string
+
+		pause       []string
+		resume      []string
+		expect      func(channel *mocks.MockAmqpChannel)
+		wantReasons []string
+	}{
+		{
+			name:        "pause cancels the consumer",
+			connected:   true,
+			pause:       []string{OperatorPause},
+			expect:      func(channel *mocks.MockAmqpChannel) { channel.EXPECT().Cancel("consumer", false) },
+			wantReasons: []string{OperatorPause},
+		},
+		{
+			name:        "pausing twice cancels the consumer once",
+			connected:   true,
+			pause:       []string{OperatorPause, "circuit breaker open", OperatorPause},
+			expect:      func(channel *mocks.MockAmqpChannel) { channel.EXPECT().Cancel("consumer", false) },
+			wantReasons: []string{"circuit breaker open", OperatorPause},
+		},
+		{
+			name:      "resume consumes again once every reason is removed",
+			connected: true,
+			reasons:   []string{OperatorPause},
+			resume:    []string{OperatorPause},
+			expect: func(channel *mocks.MockAmqpChannel) {
+				channel.EXPECT().Consume("mail_requests", gomock.Any(), false, false, false, false, nil).Return(make(chan amqp.Delivery), nil)
+			},
+			wantReasons: []string{},
+		},
+		{
+			name:        "resume keeps the consumption paused while other reasons remain",
+			connected:   true,
+			reasons:     []string{OperatorPause, "circuit breaker open"},
+			resume:      []string{OperatorPause},
+			wantReasons: []string{"circuit breaker open"},
+		},
+		{
+			name:        "pause while disconnected is kept for the reconnection",
+			pause:       []string{OperatorPause},
+			wantReasons: []string{OperatorPause},
+		},
+		{
+			name:        "resume while disconnected does not use the closed channel",
+			reasons:     []string{OperatorPause},
+			resume:      []string{OperatorPause},
+			wantReasons: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			channel := mocks.NewMockAmqpChannel(ctrl)
+
+			if tt.expect != nil {
+				tt.expect(channel)
+			}
+
+			s := &Server{cfg: config.RmqConfig{Queue: "mail_requests"}, pauseReasons: map[string]bool{}, ConsumerFn: func(*amqp.Delivery) {}}
+
+			for _, reason := range tt.reasons {
+				s.pauseReasons[reason] = true
+			}
+
+			// a disconnected server keeps no channel nor consumer
+			if tt.connected {
+				s.connected = true
+				s.channel = channel
+
+				if len(tt.reasons) == 0 {
+					s.consumerTag = "consumer"
+				}
+			}
+
+			for _, reason := range tt.pause {
+				if err := s.Pause(reason); err != nil {
+					t.Fatalf("failed to pause: %v", err)
+				}
+			}
+
+			for _, reason := range tt.resume {
+				if err := s.Resume(reason); err != nil {
+					t.Fatalf("failed to resume: %v", err)
+				}
+			}
+
+			if reasons := s.PauseReasons(); !reflect.DeepEqual(reasons, tt.wantReasons) {
+				t.Errorf("expected the pause reasons %v, got %v", tt.wantReasons, reasons)
+			}
+
+			if paused := s.Paused(); paused != (len(tt.wantReasons) > 0) {
+				t.Errorf("Paused() = %v, want %v", paused, len(tt.wantReasons) > 0)
+			}
+		})
+	}
+}
+
+func TestHandleBroadcasts(t *testing.T) {
+	tests := []struct {
+		name        string
+		types       []string
+		wantReasons []string
+	}{
+		{name: "pause", types: []string{broadcastPause}, wantReasons: []string{OperatorPause}},
+		{name: "pause then resume", types: []string{broadcastPause, broadcastResume}, wantReasons: []string{}},
+		{name: "unknown broadcasts are ignored", types: []string{"restart"}, wantReasons: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+
+			deliveries := make(chan amqp.Delivery, len(tt.types))
+
+			for _, kind := range tt.types {
+				deliveries <- amqp.Delivery{Type: kind}
+			}
+
+			close(deliveries)
+
+			s.handleBroadcasts(deliveries)
+
+			if reasons := s.PauseReasons(); !reflect.DeepEqual(reasons, tt.wantReasons) {
+				t.Errorf("expected the pause reasons %v, got %v", tt.wantReasons, reasons)
+			}
+		})
+	}
+}
+
+func TestStartBroadcastConsumer(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	channel := mocks.NewMockAmqpChannel(ctrl)
+
+	deliveries := make(chan amqp.Delivery, 1)
+
+	gomock.InOrder(
+		channel.EXPECT().ExchangeDeclare("mail_sender_admin_broadcast", amqp.ExchangeFanout, true, false, false, false, nil),
+		channel.EXPECT().QueueDeclare("mail_sender_admin_broadcast.state", true, false, false, false, amqp.Table{"x-max-length": 1, "x-overflow": "drop-head"}),
+		channel.EXPECT().QueueBind("mail_sender_admin_broadcast.state", "", "mail_sender_admin_broadcast", false, nil),
+		channel.EXPECT().QueueDeclare("", false, true, true, false, nil).Return(amqp.Queue{Name: "amq.gen-1"}, nil),
+		channel.EXPECT().QueueBind("amq.gen-1", "", "mail_sender_admin_broadcast", false, nil),
+		channel.EXPECT().Consume("amq.gen-1", "", true, true, false, false, nil).Return((<-chan amqp.Delivery)(deliveries), nil),
+	)
+
+	s := &Server{cfg: config.RmqConfig{AdminExchange: "mail_sender_admin_broadcast"}}
+
+	if err := s.startBroadcastConsumer(channel); err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries <- amqp.Delivery{Type: broadcastPause}
+
+	deadline := time.Now().Add(time.Second)
+
+	for !s.Paused() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the broadcasted pause to be applied")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	close(deliveries)
+}
+
+func TestLoadPauseState(t *testing.T) {
+	failure := errors.New("channel closed")
+
+	tests := []struct {
+		name         string
+		retained     string
+		err          error
+		wantPaused   bool
+		wantRequeued []uint64
+	}{
+		{name: "nothing broadcasted"},
+		{name: "pause broadcasted", retained: broadcastPause, wantPaused: true, wantRequeued: []uint64{1}},
+		{name: "resume broadcasted", retained: broadcastResume, wantRequeued: []uint64{1}},
+		{name: "get fails", err: failure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			channel := mocks.NewMockAmqpChannel(ctrl)
+
+			ack := &fakeAcknowledger{}
+
+			channel.EXPECT().Get("mail_sender_admin_broadcast.state", false).
+				Return(amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, Type: tt.retained}, tt.retained != "", tt.err)
+
+			s := &Server{cfg: config.RmqConfig{AdminExchange: "mail_sender_admin_broadcast"}}
+
+			paused, err := s.loadPauseState(channel)
+
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected the error %v, got %v", tt.err, err)
+			}
+
+			if paused != tt.wantPaused {
+				t.Errorf("expected paused %v, got %v", tt.wantPaused, paused)
+			}
+
+			// the broadcast is retained for the next replicas
+			if !reflect.DeepEqual(ack.requeued, tt.wantRequeued) {
+				t.Errorf("expected the requeued tags %v, got %v", tt.wantRequeued, ack.requeued)
+			}
+		})
+	}
+}
+
+func TestSetupAppliesTheBroadcastedPause(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	connector := mocks.NewMockConnector(ctrl)
+
+	conn := newMockConnection(ctrl)
+	conn.pauseState = broadcastPause
+
+	connector.EXPECT().Connect("amqp://localhost").Return(conn.conn, nil)
+
+	s := newTestServer(connector)
+	s.cfg.AdminExchange = "mail_sender_admin_broadcast"
+
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	if reasons := s.PauseReasons(); !reflect.DeepEqual(reasons, []string{OperatorPause}) {
+		t.Fatalf("expected the replica to be paused by the operator, got %v", reasons)
+	}
+
+	if s.consumerTag != "" {
+		t.Fatal("expected the mail requests queue to not be consumed")
+	}
+}
+
+func TestPauseAllWithoutConnection(t *testing.T) {
+	s := &Server{cfg: config.RmqConfig{AdminExchange: "mail_sender_admin_broadcast"}}
+
+	// the replica is paused even though the broadcast fails
+	if err := s.PauseAll(context.Background()); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+
+	if !s.Paused() {
+		t.Fatal("expected the replica to be paused")
+	}
+
+	if err := s.ResumeAll(context.Background()); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+
+	if s.Paused() {
+		t.Fatal("expected the replica to be resumed")
+	}
+}
@@ -0,0 +1,59 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DelayQueueName returns the name of the delay queue of the tier, eg: mail_requests_delayed.30s
+func DelayQueueName(prefix string, tier time.Duration) string {
+	return fmt.Sprintf("%s.%ds", prefix, int64(tier/time.Second))
+}
+
+// DelayTier rounds the delay up to the shortest tier, in seconds, that is not shorter than it, delays
+// longer than every tier use the longest one and are delayed again once consumed if still needed
+func DelayTier(tiers []int, delay time.Duration) time.Duration {
+	var shortest, longest time.Duration
+
+	for _, t := range tiers {
+		tier := time.Duration(t) * time.Second
+
+		if tier >= delay && (shortest == 0 || tier < shortest) {
+			shortest = tier
+		}
+
+		if tier > longest {
+			longest = tier
+		}
+	}
+
+	if shortest == 0 {
+		return longest
+	}
+
+	return shortest
+}
+
+// validateDelayTiers checks the tiers are positive and unique
+func validateDelayTiers(tiers []int) error {
+	if len(tiers) == 0 {
+		return errors.New("at least one delay tier is required")
+	}
+
+	seen := make(map[int]bool, len(tiers))
+
+	for _, tier := range tiers {
+		if tier <= 0 {
+			return fmt.Errorf("invalid delay tier %d, expected a positive number of seconds", tier)
+		}
+
+		if seen[tier] {
+			return fmt.Errorf("duplicated delay tier %d", tier)
+		}
+
+		seen[tier] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package queue
+
+import (
+	"mailer-ms/config"
+	"mailer-ms/mocks"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestDelayTier(t *testing.T) {
+	tiers := []int{30, 1, 300, 5}
+
+	tests := []struct {
+		delay time.Duration
+		want  time.Duration
+	}{
+		{delay: 0, want: time.Second},
+		{delay: 200 * time.Millisecond, want: time.Second},
+		{delay: time.Second, want: time.Second},
+		{delay: 1500 * time.Millisecond, want: 5 * time.Second},
+		{delay: 31 * time.Second, want: 300 * time.Second},
+		{delay: time.Hour, want: 300 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.delay.String(), func(t *testing.T) {
+			if got := DelayTier(tiers, tt.delay); got != tt.want {
+				t.Fatalf("expected tier %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestValidateDelayTiers(t *testing.T) {
+	tests := []struct {
+		name    string
+		tiers   []int
+		wantErr bool
+	}{
+		{name: "valid tiers", tiers: []int{1, 5, 30}},
+		{name: "no tiers", wantErr: true},
+		{name: "zero tier", tiers: []int{0, 5}, wantErr: true},
+		{name: "duplicated tier", tiers: []int{5, 5}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateDelayTiers(tt.tiers); (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestDeclareQueues(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	channel := mocks.NewMockAmqpChannel(ctrl)
+
+	s := &Server{
+		cfg: config.RmqConfig{
+			Queue:    "mail_requests",
+			Topology: config.TopologyConfig{Queues: []config.QueueConfig{{Name: "mail_bounces", Durable: true}}},
+		},
+		Queues: []string{"mail_tracking_events", "mail_bounces"},
+	}
+
+	declared := map[string]bool{}
+
+	channel.EXPECT().QueueDeclare(gomock.Any(), true, false, false, false, gomock.Any()).
+		DoAndReturn(func(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+			declared[name] = args == nil
+			return amqp.Queue{Name: name}, nil
+		}).
+		AnyTimes()
+
+	if err := s.declare(channel); err != nil {
+		t.Fatal(err)
+	}
+
+	if !declared["mail_tracking_events"] {
+		t.Fatal("expected the tracking events queue to be declared without args")
+	}
+
+	if len(declared) != 3 {
+		t.Fatalf("expected the mail requests, topology and tracking events queues to be declared, got %v", declared)
+	}
+}
+
+func TestDeclareDelayQueues(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	channel := mocks.NewMockAmqpChannel(ctrl)
+
+	s := &Server{cfg: config.RmqConfig{
+		Queue:      "mail_requests",
+		DelayQueue: "mail_requests_delayed",
+		DelayTiers: []int{1, 30},
+		Topology:   config.TopologyConfig{Queues: []config.QueueConfig{{Name: "mail_requests_delayed.30s", Durable: true}}},
+	}}
+
+	declared := map[string]amqp.Table{}
+
+	channel.EXPECT().QueueDeclare(gomock.Any(), true, false, false, false, gomock.Any()).
+		DoAndReturn(func(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+			declared[name] = args
+			return amqp.Queue{Name: name}, nil
+		}).
+		AnyTimes()
+
+	if err := s.declare(channel); err != nil {
+		t.Fatal(err)
+	}
+
+	want := amqp.Table{"x-message-ttl": 1000, "x-dead-letter-exchange": "", "x-dead-letter-routing-key": "mail_requests"}
+
+	if args, ok := declared["mail_requests_delayed.1s"]; !ok || !reflect.DeepEqual(args, want) {
+		t.Fatalf("expected the 1s tier to be declared with %v, got %v", want, args)
+	}
+
+	if args := declared["mail_requests_delayed.30s"]; args != nil {
+		t.Fatalf("expected the 30s tier to be declared with the topology args only, got %v", args)
+	}
+}
@@ -10,10 +10,18 @@ import (
 
 type AmqpChannel interface {
 	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	Close() error
+	Cancel(consumer string, noWait bool) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
 	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
 	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
 	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
 	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
 }
 
 type AmqpDialer func(url string) (AmqpConnection, error)
@@ -21,6 +29,7 @@ type AmqpDialer func(url string) (AmqpConnection, error)
 type AmqpConnection interface {
 	Close() error
 	Channel() (AmqpChannel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
 }
 
 type Connector interface {
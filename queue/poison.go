@@ -0,0 +1,249 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mailer-ms/tracer"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// failuresHeader counts the times processing a message failed (the consumer function panicked or the message
+// was redelivered, eg: after crashing the service), the failed messages are republished to the end of the queue
+// with the header incremented. the service requeues messages (eg: paused or over quota) by republishing them
+// as well, so they are not redelivered
+const failuresHeader = "x-mail-failures"
+
+// deliveryCountHeader counts the previous deliveries of a quorum queue message, set by the broker
+const deliveryCountHeader = "x-delivery-count"
+
+// handleMailRequest recovers the panics of the consumer function, counting the failures of the message and
+// parking it once they exceed the poison threshold instead of processing it again. redelivered messages are
+// counted before being processed, since they were not acknowledged when delivered before
+func (s *Server) handleMailRequest(d *amqp.Delivery) {
+	if s.cfg.PoisonThreshold <= 0 {
+		s.ConsumerFn(d)
+		return
+	}
+
+	if redeliveries := s.redeliveries(d); redeliveries > 0 {
+		failures, _ := headerInt(d.Headers, failuresHeader)
+		failures += redeliveries
+
+		if failures > int64(s.cfg.PoisonThreshold) {
+			s.park(d, failures, "redelivered without being acknowledged")
+			return
+		}
+
+		s.countFailure(d, failures)
+		return
+	}
+
+	ack := &acknowledgement{Acknowledger: d.Acknowledger}
+	d.Acknowledger = ack
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		log.Printf("[ RMQ ] processing message %s panicked: %v\n%s", d.MessageId, r, debug.Stack())
+
+		// the message was answered before the panic, processing it again could send it twice
+		if ack.done() {
+			return
+		}
+
+		failures, _ := headerInt(d.Headers, failuresHeader)
+		failures++
+
+		reason := fmt.Sprint(r)
+
+		if failures > int64(s.cfg.PoisonThreshold) {
+			s.park(d, failures, reason)
+			return
+		}
+
+		s.countFailure(d, failures)
+	}()
+
+	s.ConsumerFn(d)
+}
+
+// redeliveries returns how many times the message was redelivered, the broker counts them on quorum
+// queues while classic queues only flag the redelivered messages
+func (s *Server) redeliveries(d *amqp.Delivery) int64 {
+	if s.cfg.QueueType == QuorumQueue {
+		count, _ := headerInt(d.Headers, deliveryCountHeader)
+		return count
+	}
+
+	if d.Redelivered {
+		return 1
+	}
+
+	return 0
+}
+
+// Requeue republishes a consumed mail request to the end of the mail requests queue, instead of
+// nacking it, so the requeue is not counted as a failure once the message is consumed again. the
+// message is nacked back to the queue if it cannot be republished, and on streams, since they keep
+// every message and the offset tracker consumes the nacked ones again
+func (s *Server) Requeue(ctx context.Context, d *amqp.Delivery) error {
+	if s.offsets != nil {
+		return d.Nack(false, true)
+	}
+
+	if err := s.Publish(ctx, "", s.cfg.Queue, toPublishing(d)); err != nil {
+		tracer.AddSpanError(tracer.SpanFromContext(ctx), fmt.Errorf("failed to republish requeued message: %w", err))
+		return d.Nack(false, true)
+	}
+
+	return d.Ack(false)
+}
+
+// countFailure republishes a failed message to the mail requests queue with its failures counted on the
+// failures header, if the message cannot be republished it is rejected back to the queue without the count
+func (s *Server) countFailure(d *amqp.Delivery, failures int64) {
+	ctx, span := tracer.NewSpan(context.Background(), "queue", "CountFailure")
+	defer span.End()
+
+	span.SetAttributes(attribute.Key("failures").Int64(failures))
+
+	publishing := toPublishing(d)
+	publishing.Headers[failuresHeader] = failures
+
+	if err := s.Publish(ctx, "", s.cfg.Queue, publishing); err != nil {
+		tracer.AddSpanError(span, fmt.Errorf("failed to republish failed message: %w", err))
+
+		if err := d.Reject(true); err != nil {
+			tracer.AddSpanError(span, fmt.Errorf("failed to reject message: %w", err))
+		}
+
+		return
+	}
+
+	if err := d.Ack(false); err != nil {
+		tracer.AddSpanError(span, fmt.Errorf("failed to ack failed message: %w", err))
+	}
+}
+
+// park publishes the message to the parking queue with headers describing why it was parked, the message
+// is rejected back to the queue if it cannot be parked so it is not lost
+func (s *Server) park(d *amqp.Delivery, failures int64, reason string) {
+	ctx, span := tracer.NewSpan(context.Background(), "queue", "ParkMessage")
+	defer span.End()
+
+	span.SetAttributes(attribute.Key("failures").Int64(failures))
+	span.SetAttributes(attribute.Key("message_id").String(d.MessageId))
+
+	hostname, _ := os.Hostname()
+
+	publishing := toPublishing(d)
+	publishing.Headers["x-parked-reason"] = fmt.Sprintf("failed %d times, over the poison threshold of %d, last failure: %s", failures, s.cfg.PoisonThreshold, reason)
+	publishing.Headers["x-parked-at"] = time.Now().UTC().Format(time.RFC3339)
+	publishing.Headers["x-parked-by"] = hostname
+	publishing.Headers["x-original-queue"] = s.cfg.Queue
+	publishing.Headers[failuresHeader] = failures
+
+	if err := s.Publish(ctx, "", s.cfg.ParkingQueue, publishing); err != nil {
+		tracer.AddSpanErrorAndFail(span, err, "failed to park message")
+
+		if err := d.Reject(true); err != nil {
+			tracer.AddSpanError(span, fmt.Errorf("failed to reject message: %w", err))
+		}
+
+		return
+	}
+
+	log.Printf("[ RMQ ] parked message %s on %s after %d failures", d.MessageId, s.cfg.ParkingQueue, failures)
+
+	if err := d.Ack(false); err != nil {
+		tracer.AddSpanError(span, fmt.Errorf("failed to ack parked message: %w", err))
+	}
+}
+
+// toPublishing copies a delivery to a persistent publishing, copying its headers as well except for
+// the delivery count, which the broker counts for each message
+func toPublishing(d *amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+
+	delete(headers, deliveryCountHeader)
+
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
+
+// acknowledgement records if a delivery was acknowledged (acked, nacked or rejected)
+type acknowledgement struct {
+	amqp.Acknowledger
+
+	mu           sync.Mutex
+	acknowledged bool
+}
+
+func (a *acknowledgement) Ack(tag uint64, multiple bool) error {
+	a.acknowledge()
+	return a.Acknowledger.Ack(tag, multiple)
+}
+
+func (a *acknowledgement) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.acknowledge()
+	return a.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (a *acknowledgement) Reject(tag uint64, requeue bool) error {
+	a.acknowledge()
+	return a.Acknowledger.Reject(tag, requeue)
+}
+
+func (a *acknowledgement) acknowledge() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.acknowledged = true
+}
+
+func (a *acknowledgement) done() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.acknowledged
+}
+
+func headerInt(headers amqp.Table, key string) (int64, bool) {
+	switch v := headers[key].(type) {
+	case int64:
+		return v, true
+	case int32:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int:
+		return int64(v), true
+	default:
+		return 0, false
+	}
+}
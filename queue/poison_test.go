@@ -0,0 +1,334 @@
+package queue
+
+import (
+	"context"
+	"mailer-ms/config"
+	"mailer-ms/mocks"
+	"mailer-ms/queue/interfaces"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type publishedMessage struct {
+	key        string
+	publishing amqp.Publishing
+}
+
+// confirmingPublisher records the publishings, confirming them on the confirm channel as the broker would
+type confirmingPublisher struct {
+	channel   *confirmChannel
+	published []publishedMessage
+}
+
+func (p *confirmingPublisher) PublishWithContext(ctx context.Context, channel interfaces.AmqpChannel, exchange, key string, msg amqp.Publishing) error {
+	p.published = append(p.published, publishedMessage{key, msg})
+	p.channel.confirms <- amqp.Confirmation{DeliveryTag: p.channel.deliveryTag + 1, Ack: true}
+
+	return nil
+}
+
+func TestHandleMailRequest(t *testing.T) {
+	panics := func(d *amqp.Delivery) { panic("nil pointer dereference") }
+
+	tests := []struct {
+		name         string
+		threshold    int
+		queueType    string
+		headers      amqp.Table
+		redelivered  bool
+		consumer     func(d *amqp.Delivery)
+		notConnected bool
+
+		wantConsumed bool
+		wantKey      string
+		wantFailures int64
+		wantReason   string
+		wantAcked    []uint64
+		wantRequeued []uint64
+	}{
+		{
+			name:         "disabled",
+			consumer:     func(d *amqp.Delivery) { d.Ack(false) },
+			wantConsumed: true,
+			wantAcked:    []uint64{1},
+		},
+		{
+			name:         "processed",
+			threshold:    3,
+			consumer:     func(d *amqp.Delivery) { d.Ack(false) },
+			wantConsumed: true,
+			wantAcked:    []uint64{1},
+		},
+		{
+			name:         "requeued when paused or over quota is not a failure",
+			threshold:    3,
+			headers:      amqp.Table{failuresHeader: int64(3)},
+			consumer:     func(d *amqp.Delivery) { d.Nack(false, true) },
+			wantConsumed: true,
+			wantRequeued: []uint64{1},
+		},
+		{
+			name:         "first failure is counted",
+			threshold:    3,
+			consumer:     panics,
+			wantKey:      "mail_requests",
+			wantFailures: 1,
+			wantAcked:    []uint64{1},
+		},
+		{
+			name:         "failures up to the threshold are counted",
+			threshold:    3,
+			headers:      amqp.Table{failuresHeader: int32(2)},
+			consumer:     panics,
+			wantKey:      "mail_requests",
+			wantFailures: 3,
+			wantAcked:    []uint64{1},
+		},
+		{
+			name:         "failures over the threshold are parked",
+			threshold:    3,
+			headers:      amqp.Table{failuresHeader: int64(3)},
+			consumer:     panics,
+			wantKey:      "mail_requests_parked",
+			wantFailures: 4,
+			wantReason:   "nil pointer dereference",
+			wantAcked:    []uint64{1},
+		},
+		{
+			name:      "answered before failing is not processed again",
+			threshold: 3,
+			consumer: func(d *amqp.Delivery) {
+				d.Ack(false)
+				panic("failed to reply")
+			},
+			wantAcked: []uint64{1},
+		},
+		{
+			name:         "redelivered is counted without being processed",
+			threshold:    3,
+			redelivered:  true,
+			consumer:     panics,
+			wantKey:      "mail_requests",
+			wantFailures: 1,
+			wantAcked:    []uint64{1},
+		},
+		{
+			name:         "redelivered over the threshold is parked",
+			threshold:    3,
+			headers:      amqp.Table{failuresHeader: int64(3)},
+			redelivered:  true,
+			consumer:     panics,
+			wantKey:      "mail_requests_parked",
+			wantFailures: 4,
+			wantReason:   "redelivered",
+			wantAcked:    []uint64{1},
+		},
+		{
+			name:         "quorum deliveries over the threshold are parked",
+			threshold:    3,
+			queueType:    QuorumQueue,
+			headers:      amqp.Table{deliveryCountHeader: int64(4)},
+			redelivered:  true,
+			consumer:     panics,
+			wantKey:      "mail_requests_parked",
+			wantFailures: 4,
+			wantReason:   "redelivered",
+			wantAcked:    []uint64{1},
+		},
+		{
+			name:         "quorum deliveries are added to the counted failures",
+			threshold:    3,
+			queueType:    QuorumQueue,
+			headers:      amqp.Table{failuresHeader: int32(1), deliveryCountHeader: int64(1)},
+			redelivered:  true,
+			consumer:     panics,
+			wantKey:      "mail_requests",
+			wantFailures: 2,
+			wantAcked:    []uint64{1},
+		},
+		{
+			name:         "quorum first delivery is processed",
+			threshold:    3,
+			queueType:    QuorumQueue,
+			consumer:     func(d *amqp.Delivery) { d.Ack(false) },
+			wantConsumed: true,
+			wantAcked:    []uint64{1},
+		},
+		{
+			name:         "failure that cannot be republished is requeued",
+			threshold:    3,
+			consumer:     panics,
+			notConnected: true,
+			wantRequeued: []uint64{1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+
+			channel := newTestConfirmChannel(mocks.NewMockAmqpChannel(ctrl))
+			publisher := &confirmingPublisher{channel: channel}
+
+			consumed := false
+
+			s := &Server{
+				Publisher: publisher,
+				cfg:       config.RmqConfig{Queue: "mail_requests", QueueType: tt.queueType, PoisonThreshold: tt.threshold, ParkingQueue: "mail_requests_parked"},
+				ConsumerFn: func(d *amqp.Delivery) {
+					tt.consumer(d)
+					consumed = true
+				},
+			}
+
+			if !tt.notConnected {
+				s.publishers = newPublishPool([]*confirmChannel{channel}, nil)
+			}
+
+			ack := &fakeAcknowledger{}
+
+			s.handleMailRequest(&amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, Redelivered: tt.redelivered, MessageId: "1", Headers: tt.headers})
+
+			if consumed != tt.wantConsumed {
+				t.Errorf("expected consumed to be %v, got %v", tt.wantConsumed, consumed)
+			}
+
+			if !reflect.DeepEqual(ack.acked, tt.wantAcked) {
+				t.Errorf("expected the acked tags %v, got %v", tt.wantAcked, ack.acked)
+			}
+
+			if !reflect.DeepEqual(ack.requeued, tt.wantRequeued) {
+				t.Errorf("expected the requeued tags %v, got %v", tt.wantRequeued, ack.requeued)
+			}
+
+			if tt.wantKey == "" {
+				if len(publisher.published) > 0 {
+					t.Fatalf("expected nothing to be published, got %v", publisher.published)
+				}
+				return
+			}
+
+			if len(publisher.published) != 1 {
+				t.Fatalf("expected a single publishing, got %v", publisher.published)
+			}
+
+			published := publisher.published[0]
+
+			if published.key != tt.wantKey {
+				t.Errorf("expected the message to be published to %s, got %s", tt.wantKey, published.key)
+			}
+
+			if failures := published.publishing.Headers[failuresHeader]; failures != tt.wantFailures {
+				t.Errorf("expected %d failures, got %v", tt.wantFailures, failures)
+			}
+
+			if tt.wantKey == "mail_requests_parked" {
+				reason, _ := published.publishing.Headers["x-parked-reason"].(string)
+
+				if !strings.Contains(reason, tt.wantReason) {
+					t.Errorf("expected the parked reason to include %q, got %q", tt.wantReason, reason)
+				}
+			}
+		})
+	}
+}
+
+func TestMessageCrashingTheServiceIsParked(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	channel := newTestConfirmChannel(mocks.NewMockAmqpChannel(ctrl))
+	publisher := &confirmingPublisher{channel: channel}
+
+	s := &Server{
+		Publisher:  publisher,
+		publishers: newPublishPool([]*confirmChannel{channel}, nil),
+		cfg:        config.RmqConfig{Queue: "mail_requests", QueueType: ClassicQueue, PoisonThreshold: 3, ParkingQueue: "mail_requests_parked"},
+		ConsumerFn: func(d *amqp.Delivery) {
+			t.Fatal("expected the redelivered message to not be processed again")
+		},
+	}
+
+	// the message killed the process before it could be acknowledged, so it is redelivered without a failures header
+	headers := amqp.Table{}
+
+	for delivery := 1; delivery <= 4; delivery++ {
+		s.handleMailRequest(&amqp.Delivery{Acknowledger: &fakeAcknowledger{}, DeliveryTag: 1, Redelivered: true, MessageId: "1", Headers: headers})
+
+		if len(publisher.published) != delivery {
+			t.Fatalf("expected the delivery %d to be republished, got %v", delivery, publisher.published)
+		}
+
+		// the republished message crashes the process again
+		headers = publisher.published[delivery-1].publishing.Headers
+	}
+
+	if last := publisher.published[3]; last.key != "mail_requests_parked" || last.publishing.Headers[failuresHeader] != int64(4) {
+		t.Fatalf("expected the message to be parked after 4 failures, got %v", last)
+	}
+}
+
+func TestRequeue(t *testing.T) {
+	tests := []struct {
+		name         string
+		stream       bool
+		notConnected bool
+		wantKey      string
+		wantAcked    []uint64
+		wantRequeued []uint64
+	}{
+		{name: "republished", wantKey: "mail_requests", wantAcked: []uint64{1}},
+		{name: "nacked when it cannot be republished", notConnected: true, wantRequeued: []uint64{1}},
+		{name: "nacked on streams", stream: true, wantRequeued: []uint64{1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+
+			channel := newTestConfirmChannel(mocks.NewMockAmqpChannel(ctrl))
+			publisher := &confirmingPublisher{channel: channel}
+
+			s := &Server{Publisher: publisher, cfg: config.RmqConfig{Queue: "mail_requests"}}
+
+			if !tt.notConnected {
+				s.publishers = newPublishPool([]*confirmChannel{channel}, nil)
+			}
+
+			if tt.stream {
+				s.offsets, _ = newOffsetTracker("first")
+			}
+
+			ack := &fakeAcknowledger{}
+
+			s.Requeue(context.Background(), &amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, Headers: amqp.Table{deliveryCountHeader: int64(2)}})
+
+			if !reflect.DeepEqual(ack.acked, tt.wantAcked) {
+				t.Errorf("expected the acked tags %v, got %v", tt.wantAcked, ack.acked)
+			}
+
+			if !reflect.DeepEqual(ack.requeued, tt.wantRequeued) {
+				t.Errorf("expected the requeued tags %v, got %v", tt.wantRequeued, ack.requeued)
+			}
+
+			if tt.wantKey == "" {
+				if len(publisher.published) > 0 {
+					t.Fatalf("expected nothing to be published, got %v", publisher.published)
+				}
+				return
+			}
+
+			if len(publisher.published) != 1 || publisher.published[0].key != tt.wantKey {
+				t.Fatalf("expected a single publishing to %s, got %v", tt.wantKey, publisher.published)
+			}
+
+			// the broker counts the deliveries of the republished message from scratch
+			if _, ok := publisher.published[0].publishing.Headers[deliveryCountHeader]; ok {
+				t.Error("expected the delivery count to not be republished")
+			}
+		})
+	}
+}
@@ -2,20 +2,219 @@ package queue
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
 	"mailer-ms/queue/interfaces"
+	"sync"
+	"time"
 
+	"github.com/google/uuid"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+var (
+	// ErrNotConnected is returned by publishes while the server is not connected, eg: during a reconnection
+	ErrNotConnected = errors.New("not connected to rabbitmq")
+
+	ErrNacked         = errors.New("publishing was nacked by the broker")
+	ErrConfirmTimeout = errors.New("timed out waiting for the broker to confirm the publishing")
+)
+
+// ReturnedError is returned when a mandatory publishing could not be routed to any queue,
+// eg: a rpc reply to a deleted reply to queue
+type ReturnedError struct {
+	Exchange  string
+	Key       string
+	ReplyCode uint16
+	Reason    string
+}
+
+func (e *ReturnedError) Error() string {
+	return fmt.Sprintf("publishing to exchange %q with key %q was returned: %d %s", e.Exchange, e.Key, e.ReplyCode, e.Reason)
+}
+
+const confirmBufferSize = 128
+
 type Publisher struct{}
 
+// PublishWithContext publishes a mandatory message, so the broker returns it if unroutable
 func (p *Publisher) PublishWithContext(ctx context.Context, channel interfaces.AmqpChannel, exchange, key string, msg amqp.Publishing) error {
 	return channel.PublishWithContext(
 		ctx,      // context
 		exchange, // exchange
 		key,      // key
-		false,    // mandatory
+		true,     // mandatory
 		false,    // immediate
 		msg,      // msg
 	)
 }
+
+// confirmChannel is a channel in confirm mode, it publishes one message at a time and waits for its
+// confirmation, so the confirmations and returns received from the broker belong to the last publishing
+type confirmChannel struct {
+	mu       sync.Mutex
+	channel  interfaces.AmqpChannel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	timeout  time.Duration
+
+	// receives the close error of the channel, once closed it must be replaced
+	closed chan *amqp.Error
+
+	// delivery tag of the last publishing, the broker numbers the publishings of a channel from 1
+	deliveryTag uint64
+}
+
+func newConfirmChannel(channel interfaces.AmqpChannel, timeout time.Duration) (*confirmChannel, error) {
+	if err := channel.Confirm(false); err != nil {
+		return nil, err
+	}
+
+	// the broker sends the return of a publishing before its confirmation and both are dispatched to these
+	// buffered channels in order, so once the confirmation is received the return, if any, is buffered.
+	// the buffers hold the confirmations and returns of publishings that timed out until the next publish
+	// discards them, since a full buffer blocks the connection
+	return &confirmChannel{
+		channel:  channel,
+		confirms: channel.NotifyPublish(make(chan amqp.Confirmation, confirmBufferSize)),
+		returns:  channel.NotifyReturn(make(chan amqp.Return, confirmBufferSize)),
+		timeout:  timeout,
+		closed:   channel.NotifyClose(make(chan *amqp.Error, 1)),
+	}, nil
+}
+
+// isClosed returns if the channel was closed, eg: by a channel exception of a publishing
+func (c *confirmChannel) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// publish publishes the message and waits for the broker to confirm it, returning a
+// *ReturnedError if the message was unroutable, ErrNacked or ErrConfirmTimeout
+func (c *confirmChannel) publish(ctx context.Context, publisher interfaces.Publisher, exchange, key string, msg amqp.Publishing) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// identifies the return of this publishing, since returns have no delivery tag
+	if msg.MessageId == "" {
+		msg.MessageId = uuid.NewString()
+	}
+
+	c.drainReturns()
+
+	if err := publisher.PublishWithContext(ctx, c.channel, exchange, key, msg); err != nil {
+		return err
+	}
+
+	c.deliveryTag++
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-timer.C:
+			return ErrConfirmTimeout
+
+		case confirmation, ok := <-c.confirms:
+			if !ok {
+				return amqp.ErrClosed
+			}
+
+			// confirmation of a previous publishing that timed out
+			if confirmation.DeliveryTag < c.deliveryTag {
+				continue
+			}
+
+			if !confirmation.Ack {
+				return ErrNacked
+			}
+
+			return c.returned(msg.MessageId)
+		}
+	}
+}
+
+// returned checks if the publishing with the message id was returned
+func (c *confirmChannel) returned(messageId string) error {
+	for {
+		select {
+		case r := <-c.returns:
+			if r.MessageId == messageId {
+				return &ReturnedError{Exchange: r.Exchange, Key: r.RoutingKey, ReplyCode: r.ReplyCode, Reason: r.ReplyText}
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// drainReturns discards the returns of previous publishings that timed out
+func (c *confirmChannel) drainReturns() {
+	for {
+		select {
+		case <-c.returns:
+		default:
+			return
+		}
+	}
+}
+
+// publishPool is a fixed set of confirm mode channels, each publish takes a idle channel from the
+// pool, waiting if every channel is in use, so the publishes of several goroutines run in parallel
+type publishPool struct {
+	idle chan *confirmChannel
+
+	// opens a channel to replace a closed one
+	open func() (*confirmChannel, error)
+}
+
+func newPublishPool(channels []*confirmChannel, open func() (*confirmChannel, error)) *publishPool {
+	p := &publishPool{idle: make(chan *confirmChannel, len(channels)), open: open}
+
+	for _, c := range channels {
+		p.idle <- c
+	}
+
+	return p
+}
+
+func (p *publishPool) publish(ctx context.Context, publisher interfaces.Publisher, exchange, key string, msg amqp.Publishing) error {
+	var c *confirmChannel
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case c = <-p.idle:
+	}
+
+	defer func() { p.idle <- c }()
+
+	// the closed channel is kept on the pool if it can not be reopened, eg: while the connection is
+	// closed, so the next publish tries again
+	if c.isClosed() {
+		reopened, err := p.open()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrNotConnected, err)
+		}
+
+		log.Printf("[ RMQ ] publish channel closed, replaced by a new channel")
+		c = reopened
+	}
+
+	err := c.publish(ctx, publisher, exchange, key, msg)
+
+	if errors.Is(err, amqp.ErrClosed) {
+		return fmt.Errorf("%w: %v", ErrNotConnected, err)
+	}
+
+	return err
+}
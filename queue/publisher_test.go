@@ -0,0 +1,358 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"mailer-ms/mocks"
+	"mailer-ms/queue/interfaces"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func newTestConfirmChannel(channel interfaces.AmqpChannel) *confirmChannel {
+	return &confirmChannel{
+		channel:  channel,
+		confirms: make(chan amqp.Confirmation, confirmBufferSize),
+		returns:  make(chan amqp.Return, confirmBufferSize),
+		timeout:  50 * time.Millisecond,
+	}
+}
+
+func TestConfirmChannelPublish(t *testing.T) {
+	publishErr := errors.New("channel closed")
+
+	tests := []struct {
+		name string
+
+		// delivery tag of the last publishing, eg: of a previous publishing that timed out
+		deliveryTag uint64
+
+		// how the broker responds to the publishing, with its message id and delivery tag
+		broker func(c *confirmChannel, messageId string, tag uint64)
+
+		publishErr error
+		cancel     bool
+		wantErr    error
+		wantReturn bool
+	}{
+		{
+			name: "confirmed",
+			broker: func(c *confirmChannel, messageId string, tag uint64) {
+				c.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+			},
+		},
+		{
+			name: "nacked",
+			broker: func(c *confirmChannel, messageId string, tag uint64) {
+				c.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: false}
+			},
+			wantErr: ErrNacked,
+		},
+		{
+			name: "returned",
+			broker: func(c *confirmChannel, messageId string, tag uint64) {
+				c.returns <- amqp.Return{MessageId: messageId, Exchange: "", RoutingKey: "reply_to", ReplyCode: 312, ReplyText: "NO_ROUTE"}
+				c.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+			},
+			wantReturn: true,
+		},
+		{
+			name:        "confirmation of a previous publishing is skipped",
+			deliveryTag: 1,
+			broker: func(c *confirmChannel, messageId string, tag uint64) {
+				c.confirms <- amqp.Confirmation{DeliveryTag: tag - 1, Ack: false}
+				c.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+			},
+		},
+		{
+			name: "return of another publishing is ignored",
+			broker: func(c *confirmChannel, messageId string, tag uint64) {
+				c.returns <- amqp.Return{MessageId: "another", ReplyCode: 312, ReplyText: "NO_ROUTE"}
+				c.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+			},
+		},
+		{
+			name:    "not confirmed",
+			broker:  func(c *confirmChannel, messageId string, tag uint64) {},
+			wantErr: ErrConfirmTimeout,
+		},
+		{
+			name: "channel closed while waiting",
+			broker: func(c *confirmChannel, messageId string, tag uint64) {
+				close(c.confirms)
+			},
+			wantErr: amqp.ErrClosed,
+		},
+		{
+			name:       "publish failed",
+			publishErr: publishErr,
+			wantErr:    publishErr,
+		},
+		{
+			name:    "context canceled",
+			broker:  func(c *confirmChannel, messageId string, tag uint64) {},
+			cancel:  true,
+			wantErr: context.Canceled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			channel := mocks.NewMockAmqpChannel(ctrl)
+			publisher := mocks.NewMockPublisher(ctrl)
+
+			c := newTestConfirmChannel(channel)
+			c.deliveryTag = tt.deliveryTag
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			if tt.cancel {
+				cancel()
+			}
+
+			publisher.EXPECT().PublishWithContext(gomock.Any(), channel, "", "reply_to", gomock.Any()).
+				DoAndReturn(func(ctx context.Context, ch interfaces.AmqpChannel, exchange, key string, msg amqp.Publishing) error {
+					if msg.MessageId == "" {
+						t.Error("expected the publishing to have a message id")
+					}
+
+					if tt.publishErr == nil {
+						tt.broker(c, msg.MessageId, tt.deliveryTag+1)
+					}
+
+					return tt.publishErr
+				})
+
+			err := c.publish(ctx, publisher, "", "reply_to", amqp.Publishing{Body: []byte("{}")})
+
+			var returned *ReturnedError
+
+			switch {
+			case tt.wantReturn:
+				if !errors.As(err, &returned) || returned.ReplyCode != 312 || returned.Key != "reply_to" {
+					t.Fatalf("expected a *ReturnedError, got %v", err)
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestConfirmChannelDiscardsReturnsOfTimedOutPublishings(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	channel := mocks.NewMockAmqpChannel(ctrl)
+	publisher := mocks.NewMockPublisher(ctrl)
+
+	c := newTestConfirmChannel(channel)
+
+	// the return and confirmation of a timed out publishing arrive after it gave up
+	c.returns <- amqp.Return{MessageId: "timed-out", ReplyCode: 312}
+	c.confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	c.deliveryTag = 1
+
+	publisher.EXPECT().PublishWithContext(gomock.Any(), channel, "", "reply_to", gomock.Any()).
+		DoAndReturn(func(ctx context.Context, ch interfaces.AmqpChannel, exchange, key string, msg amqp.Publishing) error {
+			c.confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: true}
+			return nil
+		})
+
+	if err := c.publish(context.Background(), publisher, "", "reply_to", amqp.Publishing{MessageId: "timed-out"}); err != nil {
+		t.Fatalf("expected the stale return to be discarded, got %v", err)
+	}
+}
+
+func TestNewConfirmChannel(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	channel := mocks.NewMockAmqpChannel(ctrl)
+
+	failure := errors.New("confirm mode not supported")
+	channel.EXPECT().Confirm(false).Return(failure)
+
+	if _, err := newConfirmChannel(channel, time.Second); !errors.Is(err, failure) {
+		t.Fatalf("expected %v, got %v", failure, err)
+	}
+}
+
+func TestPublishPool(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	publisher := mocks.NewMockPublisher(ctrl)
+
+	channels := []*confirmChannel{newTestConfirmChannel(mocks.NewMockAmqpChannel(ctrl)), newTestConfirmChannel(mocks.NewMockAmqpChannel(ctrl))}
+	byChannel := map[interfaces.AmqpChannel]*confirmChannel{}
+
+	for _, c := range channels {
+		c.timeout = time.Second
+		byChannel[c.channel] = c
+	}
+
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+
+	publisher.EXPECT().PublishWithContext(gomock.Any(), gomock.Any(), "", "reply_to", gomock.Any()).
+		DoAndReturn(func(ctx context.Context, ch interfaces.AmqpChannel, exchange, key string, msg amqp.Publishing) error {
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+
+			c := byChannel[ch]
+
+			go func(tag uint64) {
+				time.Sleep(10 * time.Millisecond)
+
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+
+				c.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+			}(c.deliveryTag + 1)
+
+			return nil
+		}).
+		Times(6)
+
+	pool := newPublishPool(channels, nil)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 6)
+
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			errs <- pool.publish(context.Background(), publisher, "", "reply_to", amqp.Publishing{})
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if maxInFlight > len(channels) {
+		t.Fatalf("expected at most %d publishings at once, got %d", len(channels), maxInFlight)
+	}
+}
+
+func TestPublishPoolClosedChannel(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	publisher := mocks.NewMockPublisher(ctrl)
+
+	c := newTestConfirmChannel(mocks.NewMockAmqpChannel(ctrl))
+	pool := newPublishPool([]*confirmChannel{c}, nil)
+
+	publisher.EXPECT().PublishWithContext(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(amqp.ErrClosed)
+
+	if err := pool.publish(context.Background(), publisher, "", "reply_to", amqp.Publishing{}); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+
+	// the channel is returned to the pool
+	if len(pool.idle) != 1 {
+		t.Fatalf("expected the channel to be idle again, got %d idle channels", len(pool.idle))
+	}
+}
+
+func TestPublishPoolReopensClosedChannels(t *testing.T) {
+	failure := errors.New("connection closed")
+
+	tests := []struct {
+		name       string
+		openErr    error
+		wantErr    error
+		wantReopen bool
+	}{
+		{name: "closed channel is replaced", wantReopen: true},
+		{name: "closed channel is kept if it can not be replaced", openErr: failure, wantErr: ErrNotConnected},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			publisher := mocks.NewMockPublisher(ctrl)
+
+			closed := newTestConfirmChannel(mocks.NewMockAmqpChannel(ctrl))
+			closed.closed = make(chan *amqp.Error, 1)
+			closed.closed <- &amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED"}
+			close(closed.closed)
+
+			reopened := newTestConfirmChannel(mocks.NewMockAmqpChannel(ctrl))
+
+			pool := newPublishPool([]*confirmChannel{closed}, func() (*confirmChannel, error) {
+				if tt.openErr != nil {
+					return nil, tt.openErr
+				}
+
+				return reopened, nil
+			})
+
+			if tt.wantReopen {
+				publisher.EXPECT().PublishWithContext(gomock.Any(), reopened.channel, "", "reply_to", gomock.Any()).
+					DoAndReturn(func(ctx context.Context, ch interfaces.AmqpChannel, exchange, key string, msg amqp.Publishing) error {
+						reopened.confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+						return nil
+					})
+			}
+
+			err := pool.publish(context.Background(), publisher, "", "reply_to", amqp.Publishing{})
+
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			want := closed
+			if tt.wantReopen {
+				want = reopened
+			}
+
+			if idle := <-pool.idle; idle != want {
+				t.Fatal("expected the pool to keep the replacement channel, or the closed one to try again")
+			}
+		})
+	}
+}
+
+func TestPublishPoolContextCanceled(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	// every channel of the pool is in use
+	pool := newPublishPool([]*confirmChannel{newTestConfirmChannel(mocks.NewMockAmqpChannel(ctrl))}, nil)
+	<-pool.idle
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := pool.publish(ctx, mocks.NewMockPublisher(ctrl), "", "reply_to", amqp.Publishing{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the publish to give up waiting for a channel, got %v", err)
+	}
+}
+
+func TestPublishNotConnected(t *testing.T) {
+	s := &Server{}
+
+	if err := s.Publish(context.Background(), "", "reply_to", amqp.Publishing{}); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+}
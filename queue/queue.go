@@ -2,12 +2,16 @@ package queue
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"mailer-ms/config"
 	"mailer-ms/queue/interfaces"
 	"mailer-ms/tracer"
+	"sync"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 //go:generate mockgen -destination=../mocks/amqp.go -package=mocks github.com/rabbitmq/amqp091-go Acknowledger
@@ -16,40 +20,118 @@ type Server struct {
 	interfaces.Connector
 	interfaces.Publisher
 
-	cfg         config.RmqConfig
-	conn        interfaces.AmqpConnection
-	channel     interfaces.AmqpChannel
-	deliveries  <-chan amqp.Delivery
-	notifyClose chan *amqp.Error
+	cfg     config.RmqConfig
+	conn    interfaces.AmqpConnection
+	channel interfaces.AmqpChannel
+
+	// dedicated channels to publish rpc replies and events in confirm mode
+	publishers *publishPool
+
+	// closed or receive the close error of the connection and of the consume channel, closed publish
+	// channels are reopened by the publish pool instead
+	notifyConnClose chan *amqp.Error
+	notifyChanClose chan *amqp.Error
+
+	// guards the connection, the channel and the consumption state of the mail requests queue
+	mu           sync.Mutex
+	connected    bool
+	stopping     bool
+	pauseReasons map[string]bool
+	consumerTag  string
+
+	// set while another replica holds the stream lock, the stream is not consumed until acquired
+	standby bool
+
+	// tracks the processed offsets when the mail requests queue is a stream
+	offsets *offsetTracker
+
+	// Durable queues published to by the service, declared along with its own queues unless declared
+	// by the topology, eg: the tracking events queue
+	Queues []string
 
 	// The function to invoke on a new goroutine whenever a new delivery is consumed on the mail requests queue
 	ConsumerFn func(deliver *amqp.Delivery)
+
+	// The function to invoke on a new goroutine whenever a new delivery is consumed on the admin queue
+	AdminConsumerFn func(deliver *amqp.Delivery)
 }
 
-func New(cfg config.RmqConfig) Server {
+func New(cfg config.RmqConfig) (Server, error) {
+	connector, err := NewConnector(cfg)
+	if err != nil {
+		return Server{}, err
+	}
+
+	var offsets *offsetTracker
+
+	switch cfg.QueueType {
+	case ClassicQueue, QuorumQueue:
+	case StreamQueue:
+		if offsets, err = newOffsetTracker(cfg.StreamOffset); err != nil {
+			return Server{}, err
+		}
+	default:
+		return Server{}, fmt.Errorf("invalid queue type: %s", cfg.QueueType)
+	}
+
+	if cfg.Prefetch <= 0 {
+		return Server{}, errors.New("the prefetch must be positive")
+	}
+
+	if err := validateDelayTiers(cfg.DelayTiers); err != nil {
+		return Server{}, err
+	}
+
+	if cfg.DeliveryLimit > 0 && cfg.QueueType != QuorumQueue {
+		return Server{}, errors.New("the delivery limit requires a quorum queue")
+	}
+
+	// failed messages would be appended to the stream again, which keeps every message
+	if cfg.PoisonThreshold > 0 && cfg.QueueType == StreamQueue {
+		log.Printf("[ RMQ ] poison message detection is not supported on streams, ignoring the poison threshold")
+		cfg.PoisonThreshold = 0
+	}
+
+	if cfg.PoisonThreshold > 0 && cfg.ParkingQueue == "" {
+		return Server{}, errors.New("poison message detection requires a parking queue")
+	}
+
 	return Server{
 		cfg:       cfg,
-		Connector: &Connector{},
+		Connector: connector,
 		Publisher: &Publisher{},
-	}
+		offsets:   offsets,
+	}, nil
 }
 
+// Start connects to rabbitmq on a new goroutine, reconnecting whenever the connection or the channel is closed
 func (s *Server) Start() {
 	go func() {
-		for {
-			s.connect()
+		for s.connect() {
+			var closeErr *amqp.Error
 
-			connectionError, chanClosed := <-s.notifyClose
-
-			// connection error is nil and chanClosed is false when
-			// the connection was closed manually with client code
-			if connectionError != nil {
-				log.Printf("[ RMQ ] connection error: %v \n", connectionError)
+			select {
+			case closeErr = <-s.notifyConnClose:
+			case closeErr = <-s.notifyChanClose:
 			}
 
-			if !chanClosed {
+			s.mu.Lock()
+			conn := s.conn
+			s.connected = false
+			s.channel = nil
+			s.consumerTag = ""
+			s.publishers = nil
+			s.mu.Unlock()
+
+			// the close error is nil when the connection was closed manually with client code
+			if s.isStopping() {
 				return
 			}
+
+			log.Printf("[ RMQ ] disconnected: %v", closeErr)
+
+			// a closed channel leaves the connection open, which is replaced as well
+			conn.Close()
 		}
 	}()
 }
@@ -57,16 +139,55 @@ func (s *Server) Start() {
 func (s *Server) Stop() error {
 	log.Printf("[ RMQ ] closing connections")
 
-	if s.conn != nil {
-		return s.conn.Close()
+	s.mu.Lock()
+	s.stopping = true
+	conn := s.conn
+	storeOffset := s.offsets != nil && s.connected && !s.standby
+	s.mu.Unlock()
+
+	// the next replica resumes after the last offset processed by this one
+	if storeOffset {
+		s.storeStreamOffset()
+	}
+
+	if conn != nil {
+		return conn.Close()
 	}
 
 	return nil
 }
 
+func (s *Server) isStopping() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stopping
+}
+
+// Publish publishes a mandatory message on a confirm mode channel of the publish pool, waiting for the broker
+// to confirm it, it is safe for concurrent use. a *ReturnedError is returned if the message could not be routed,
+// ErrNacked if the broker rejected it, ErrConfirmTimeout if the broker did not confirm it within the publish
+// timeout and ErrNotConnected if the server is not connected, publishes fail fast instead of waiting a reconnection
 func (s *Server) Publish(ctx context.Context, exchange, key string, publishing amqp.Publishing) error {
 	ctx, span := tracer.NewSpan(ctx, "queue", "Publish")
 	defer span.End()
 
-	return s.Publisher.PublishWithContext(ctx, s.channel, exchange, key, publishing)
+	span.SetAttributes(attribute.Key("exchange").String(exchange))
+	span.SetAttributes(attribute.Key("routing_key").String(key))
+
+	s.mu.Lock()
+	publishers := s.publishers
+	s.mu.Unlock()
+
+	if publishers == nil {
+		tracer.AddSpanErrorAndFail(span, ErrNotConnected, "failed to publish")
+		return ErrNotConnected
+	}
+
+	if err := publishers.publish(ctx, s.Publisher, exchange, key, publishing); err != nil {
+		tracer.AddSpanErrorAndFail(span, err, "failed to publish")
+		return err
+	}
+
+	return nil
 }
@@ -0,0 +1,401 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mailer-ms/queue/interfaces"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Types of the mail requests queue
+const (
+	ClassicQueue = "classic"
+	QuorumQueue  = "quorum"
+	StreamQueue  = "stream"
+)
+
+// How often the replica consuming the stream stores its last processed offset on the broker
+const offsetStoreInterval = time.Second
+
+// offsetTracker tracks the offset of the stream deliveries processed (acked, nacked or rejected), so
+// consumption resumes after the last processed offset when reconnecting, resuming or restarting. the
+// deliveries after it that were already delivered are skipped, unless they were requeued, since they
+// are either still being processed or were processed out of order
+type offsetTracker struct {
+	mu sync.Mutex
+
+	// where the consumption starts when no offset was processed: first, last, next, a offset or a timestamp
+	start interface{}
+
+	// offsets of the deliveries being processed and the highest offset delivered
+	pending map[int64]bool
+	highest int64
+
+	// offsets of the deliveries nacked or rejected with requeue, a stream does not redeliver them
+	// until consumed again, so they are not committed and delivered again once consumed
+	requeued map[int64]bool
+
+	// every offset up to committed was processed, -1 if none
+	committed int64
+
+	// the committed offset last stored on the broker, -1 if none
+	stored int64
+}
+
+func newOffsetTracker(start string) (*offsetTracker, error) {
+	t := &offsetTracker{pending: make(map[int64]bool), requeued: make(map[int64]bool), highest: -1, committed: -1, stored: -1}
+
+	var err error
+
+	if t.start, err = parseStreamOffset(start); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// restore keeps the offset stored by the replica that consumed the stream if it is after the committed
+// offset, so a replica taking over the stream consumption resumes where the previous one stopped
+func (t *offsetTracker) restore(committed int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if committed > t.committed {
+		t.committed = committed
+	}
+
+	if committed > t.highest {
+		t.highest = committed
+	}
+
+	if committed > t.stored {
+		t.stored = committed
+	}
+}
+
+// unstored returns the committed offset if it was not stored on the broker yet
+func (t *offsetTracker) unstored() (int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.committed, t.committed > t.stored
+}
+
+func (t *offsetTracker) markStored(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if offset > t.stored {
+		t.stored = offset
+	}
+}
+
+// parseStreamOffset parses where a stream is consumed from when no offset was processed, from the first
+// message by default, since the requests already processed are answered with their stored status
+func parseStreamOffset(offset string) (interface{}, error) {
+	switch offset {
+	case "", "first":
+		return "first", nil
+	case "next", "last":
+		return offset, nil
+	}
+
+	if n, err := strconv.ParseInt(offset, 10, 64); err == nil {
+		return n, nil
+	}
+
+	if timestamp, err := time.Parse(time.RFC3339, offset); err == nil {
+		return timestamp, nil
+	}
+
+	return nil, fmt.Errorf("invalid stream offset: %s, expected first, last, next, a offset or a RFC3339 timestamp", offset)
+}
+
+// consumeArgs returns the consume args that start the consumption after the last processed offset
+func (t *offsetTracker) consumeArgs() amqp.Table {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.committed >= 0 {
+		return amqp.Table{"x-stream-offset": t.committed + 1}
+	}
+
+	return amqp.Table{"x-stream-offset": t.start}
+}
+
+// trackDeliveries tracks the deliveries in the order they arrive, marking their offset as processed
+// once they are acked, nacked or rejected, deliveries already delivered are acked and skipped
+func (t *offsetTracker) trackDeliveries(deliveries <-chan amqp.Delivery) <-chan amqp.Delivery {
+	tracked := make(chan amqp.Delivery)
+
+	go func() {
+		defer close(tracked)
+
+		for d := range deliveries {
+			offset, ok := d.Headers["x-stream-offset"].(int64)
+			if ok {
+				// acked so it does not count towards the prefetch
+				if !t.delivered(offset) {
+					d.Ack(false)
+					continue
+				}
+
+				d.Acknowledger = &trackedAcknowledger{d.Acknowledger, t, offset}
+			}
+
+			tracked <- d
+		}
+	}()
+
+	return tracked
+}
+
+// delivered tracks the offset as being processed, returns false if it was already delivered
+// and not requeued, in which case it should be skipped
+func (t *offsetTracker) delivered(offset int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if offset <= t.highest && !t.requeued[offset] {
+		return false
+	}
+
+	delete(t.requeued, offset)
+	t.pending[offset] = true
+
+	if offset > t.highest {
+		t.highest = offset
+	}
+
+	return true
+}
+
+// processed removes the offset from the pending ones, committing every offset before the lowest
+// offset still being processed or requeued
+func (t *offsetTracker) processed(offset int64, requeue bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.pending, offset)
+
+	if requeue {
+		t.requeued[offset] = true
+	}
+
+	committed := t.highest
+
+	for _, offsets := range []map[int64]bool{t.pending, t.requeued} {
+		for o := range offsets {
+			if o-1 < committed {
+				committed = o - 1
+			}
+		}
+	}
+
+	if committed > t.committed {
+		t.committed = committed
+	}
+}
+
+// trackedAcknowledger marks the offset of a stream delivery as processed when it is acknowledged
+type trackedAcknowledger struct {
+	amqp.Acknowledger
+
+	tracker *offsetTracker
+	offset  int64
+}
+
+func (a *trackedAcknowledger) Ack(tag uint64, multiple bool) error {
+	defer a.tracker.processed(a.offset, false)
+	return a.Acknowledger.Ack(tag, multiple)
+}
+
+func (a *trackedAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	defer a.tracker.processed(a.offset, requeue)
+	return a.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (a *trackedAcknowledger) Reject(tag uint64, requeue bool) error {
+	defer a.tracker.processed(a.offset, requeue)
+	return a.Acknowledger.Reject(tag, requeue)
+}
+
+// StreamLockName returns the name of the exclusive queue held by the replica consuming the stream
+func StreamLockName(queue string) string {
+	return queue + ".lock"
+}
+
+// StreamOffsetsName returns the name of the queue retaining the last offset of the stream processed
+func StreamOffsetsName(queue string) string {
+	return queue + ".offsets"
+}
+
+// declareStreamOffsets declares the queue the last processed offset of the stream is stored on, older
+// offsets are dropped from its head so it only holds the offset the next consuming replica resumes after
+func (s *Server) declareStreamOffsets(channel interfaces.AmqpChannel) error {
+	_, err := channel.QueueDeclare(
+		StreamOffsetsName(s.cfg.Queue), // name
+		true,                           // durable
+		false,                          // autodelete
+		false,                          // exclusive
+		false,                          // nowait
+		amqp.Table{
+			"x-max-length": 1,
+			"x-overflow":   "drop-head",
+		},
+	)
+
+	return err
+}
+
+// loadStreamOffset restores the last offset stored on the broker, the offset is requeued so it is retained
+func (s *Server) loadStreamOffset(channel interfaces.AmqpChannel) error {
+	d, ok, err := channel.Get(StreamOffsetsName(s.cfg.Queue), false)
+	if err != nil || !ok {
+		return err
+	}
+
+	if err := d.Nack(false, true); err != nil {
+		return err
+	}
+
+	committed, err := strconv.ParseInt(strings.TrimSpace(string(d.Body)), 10, 64)
+	if err != nil {
+		log.Printf("[ RMQ ] ignoring invalid stream offset %q stored on the broker", d.Body)
+		return nil
+	}
+
+	s.offsets.restore(committed)
+
+	return nil
+}
+
+// storeStreamOffset stores the committed offset on the broker if it changed since last stored
+func (s *Server) storeStreamOffset() {
+	offset, ok := s.offsets.unstored()
+	if !ok {
+		return
+	}
+
+	err := s.Publish(context.Background(), "", StreamOffsetsName(s.cfg.Queue), amqp.Publishing{
+		Body:         []byte(strconv.FormatInt(offset, 10)),
+		DeliveryMode: amqp.Persistent,
+	})
+
+	if err != nil {
+		log.Printf("[ RMQ ] failed to store stream offset: %v", err)
+		return
+	}
+
+	s.offsets.markStored(offset)
+}
+
+// storeStreamOffsets stores the committed offset on the broker every offsetStoreInterval while the
+// connection holding the stream lock is open
+func (s *Server) storeStreamOffsets(con interfaces.AmqpConnection) {
+	for {
+		time.Sleep(offsetStoreInterval)
+
+		s.mu.Lock()
+		current := s.conn == con && s.connected
+		s.mu.Unlock()
+
+		if !current {
+			return
+		}
+
+		s.storeStreamOffset()
+	}
+}
+
+// acquireStreamLock declares the exclusive stream lock queue, deleted once the connection closes, on a
+// channel of its own since the broker closes the channel if another connection holds the lock queue.
+// returns false if another replica holds it
+func (s *Server) acquireStreamLock(con interfaces.AmqpConnection) (bool, error) {
+	channel, err := con.Channel()
+	if err != nil {
+		return false, err
+	}
+
+	defer channel.Close()
+
+	_, err = channel.QueueDeclare(
+		StreamLockName(s.cfg.Queue), // name
+		false,                       // durable
+		true,                        // autodelete
+		true,                        // exclusive
+		false,                       // nowait
+		nil,                         // args
+	)
+
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.ResourceLocked {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	// another replica may have processed the stream while this one stood by or was stopped
+	if err := s.loadStreamOffset(channel); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// waitForStreamLock tries to acquire the stream lock every wait while the connection is open,
+// consuming the stream once acquired, so a standby replica takes over once the consuming one stops
+func (s *Server) waitForStreamLock(con interfaces.AmqpConnection, wait time.Duration) {
+	for {
+		time.Sleep(wait)
+
+		s.mu.Lock()
+		current := s.conn == con && s.connected
+		s.mu.Unlock()
+
+		if !current {
+			return
+		}
+
+		locked, err := s.acquireStreamLock(con)
+		if err != nil {
+			log.Printf("[ RMQ ] failed to acquire the stream lock: %v", err)
+			continue
+		}
+
+		if !locked {
+			continue
+		}
+
+		s.mu.Lock()
+
+		if s.conn != con || !s.connected {
+			s.mu.Unlock()
+			return
+		}
+
+		log.Printf("[ RMQ ] stream lock acquired, consuming the stream")
+
+		s.standby = false
+		err = s.startConsumer(s.channel)
+
+		s.mu.Unlock()
+
+		if err != nil {
+			log.Printf("[ RMQ ] failed to consume the stream: %v", err)
+		}
+
+		go s.storeStreamOffsets(con)
+
+		return
+	}
+}
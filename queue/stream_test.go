@@ -0,0 +1,422 @@
+package queue
+
+import (
+	"errors"
+	"mailer-ms/config"
+	"mailer-ms/mocks"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeAcknowledger records the acknowledgements of the deliveries by their tag
+type fakeAcknowledger struct {
+	mu       sync.Mutex
+	acked    []uint64
+	requeued []uint64
+}
+
+func (f *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.acked = append(f.acked, tag)
+	return nil
+}
+
+func (f *fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if requeue {
+		f.requeued = append(f.requeued, tag)
+	}
+
+	return nil
+}
+
+func (f *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return f.Nack(tag, false, requeue)
+}
+
+func (f *fakeAcknowledger) ackedTags() []uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]uint64{}, f.acked...)
+}
+
+func streamDelivery(ack amqp.Acknowledger, offset int64) amqp.Delivery {
+	return amqp.Delivery{Acknowledger: ack, DeliveryTag: uint64(offset), Headers: amqp.Table{"x-stream-offset": offset}}
+}
+
+func TestParseStreamOffset(t *testing.T) {
+	timestamp := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		offset  string
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "empty is first", offset: "", want: "first"},
+		{name: "next", offset: "next", want: "next"},
+		{name: "first", offset: "first", want: "first"},
+		{name: "last", offset: "last", want: "last"},
+		{name: "offset", offset: "42", want: int64(42)},
+		{name: "timestamp", offset: "2023-05-01T12:00:00Z", want: timestamp},
+		{name: "invalid", offset: "yesterday", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseStreamOffset(tt.offset)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseStreamOffset(%q) error = %v, wantErr %v", tt.offset, err, tt.wantErr)
+			}
+
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseStreamOffset(%q) = %v, want %v", tt.offset, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewOffsetTracker(t *testing.T) {
+	tests := []struct {
+		name     string
+		start    string
+		wantArgs amqp.Table
+		wantErr  bool
+	}{
+		{name: "default start", wantArgs: amqp.Table{"x-stream-offset": "first"}},
+		{name: "start", start: "next", wantArgs: amqp.Table{"x-stream-offset": "next"}},
+		{name: "invalid start", start: "yesterday", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker, err := newOffsetTracker(tt.start)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newOffsetTracker() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if args := tracker.consumeArgs(); !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("expected the consume args %v, got %v", tt.wantArgs, args)
+			}
+		})
+	}
+}
+
+func TestOffsetTrackerCommits(t *testing.T) {
+	type processed struct {
+		offset  int64
+		requeue bool
+	}
+
+	tests := []struct {
+		name          string
+		delivered     []int64
+		processed     []processed
+		wantCommitted int64
+	}{
+		{
+			name:          "nothing processed",
+			delivered:     []int64{0, 1},
+			wantCommitted: -1,
+		},
+		{
+			name:          "processed in order",
+			delivered:     []int64{0, 1, 2},
+			processed:     []processed{{offset: 0}, {offset: 1}, {offset: 2}},
+			wantCommitted: 2,
+		},
+		{
+			name:          "processed out of order waits for the lowest pending offset",
+			delivered:     []int64{0, 1, 2},
+			processed:     []processed{{offset: 0}, {offset: 2}},
+			wantCommitted: 0,
+		},
+		{
+			name:          "requeued offsets are not committed",
+			delivered:     []int64{0, 1, 2},
+			processed:     []processed{{offset: 0}, {offset: 1, requeue: true}, {offset: 2}},
+			wantCommitted: 0,
+		},
+		{
+			name:          "dropped offsets are committed",
+			delivered:     []int64{0, 1, 2},
+			processed:     []processed{{offset: 0}, {offset: 1, requeue: false}, {offset: 2}},
+			wantCommitted: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker, err := newOffsetTracker("first")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, offset := range tt.delivered {
+				if !tracker.delivered(offset) {
+					t.Fatalf("expected the offset %d to be delivered", offset)
+				}
+			}
+
+			for _, p := range tt.processed {
+				tracker.processed(p.offset, p.requeue)
+			}
+
+			if tracker.committed != tt.wantCommitted {
+				t.Errorf("expected the committed offset %d, got %d", tt.wantCommitted, tracker.committed)
+			}
+
+			// the committed offset is the one stored on the broker, so a restart resumes after it
+			if offset, unstored := tracker.unstored(); unstored != (tt.wantCommitted >= 0) || offset != tt.wantCommitted {
+				t.Errorf("expected the offset %d to be stored, got %d (unstored: %v)", tt.wantCommitted, offset, unstored)
+			}
+		})
+	}
+}
+
+func TestTrackDeliveriesAfterResuming(t *testing.T) {
+	tracker, err := newOffsetTracker("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ack := &fakeAcknowledger{}
+
+	// offset 0 is acked, 1 is still being processed, 2 is requeued and 3 is acked out of order
+	first := make(chan amqp.Delivery, 4)
+
+	for offset := int64(0); offset < 4; offset++ {
+		first <- streamDelivery(ack, offset)
+	}
+
+	close(first)
+
+	var consumed []amqp.Delivery
+
+	for d := range tracker.trackDeliveries(first) {
+		consumed = append(consumed, d)
+	}
+
+	consumed[0].Ack(false)
+	consumed[2].Nack(false, true)
+	consumed[3].Ack(false)
+
+	args := tracker.consumeArgs()
+	if want := (amqp.Table{"x-stream-offset": int64(1)}); !reflect.DeepEqual(args, want) {
+		t.Fatalf("expected the consume args %v, got %v", want, args)
+	}
+
+	// the stream redelivers every offset after the committed one once resumed
+	resumed := make(chan amqp.Delivery, 4)
+
+	for offset := int64(1); offset < 5; offset++ {
+		resumed <- streamDelivery(ack, offset)
+	}
+
+	close(resumed)
+
+	var offsets []int64
+
+	for d := range tracker.trackDeliveries(resumed) {
+		offsets = append(offsets, d.Headers["x-stream-offset"].(int64))
+	}
+
+	if want := []int64{2, 4}; !reflect.DeepEqual(offsets, want) {
+		t.Errorf("expected only the requeued and new offsets %v to be consumed again, got %v", want, offsets)
+	}
+
+	// the skipped deliveries are acked so they do not take the prefetch
+	if want := []uint64{0, 3, 1, 3}; !reflect.DeepEqual(ack.ackedTags(), want) {
+		t.Errorf("expected the acked tags %v, got %v", want, ack.ackedTags())
+	}
+}
+
+func TestAcquireStreamLock(t *testing.T) {
+	failure := errors.New("channel closed")
+
+	tests := []struct {
+		name       string
+		declareErr error
+		getErr     error
+		stored     string
+		want       bool
+		wantErr    bool
+
+		// committed offset once acquired, the offset is stored on the broker by the replica that held the lock
+		wantCommitted int64
+	}{
+		{name: "acquired", want: true, wantCommitted: -1},
+		{name: "acquired resumes from the stored offset", stored: "7", want: true, wantCommitted: 7},
+		{name: "invalid stored offset is ignored", stored: "seven", want: true, wantCommitted: -1},
+		{name: "held by another replica", declareErr: &amqp.Error{Code: amqp.ResourceLocked}, wantCommitted: -1},
+		{name: "declare failure", declareErr: failure, wantErr: true, wantCommitted: -1},
+		{name: "stored offset failure", getErr: failure, wantErr: true, wantCommitted: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			conn := mocks.NewMockAmqpConnection(ctrl)
+			channel := mocks.NewMockAmqpChannel(ctrl)
+
+			ack := &fakeAcknowledger{}
+
+			calls := []*gomock.Call{
+				conn.EXPECT().Channel().Return(channel, nil),
+				channel.EXPECT().QueueDeclare("mail_requests.lock", false, true, true, false, nil).Return(amqp.Queue{}, tt.declareErr),
+			}
+
+			if tt.declareErr == nil {
+				calls = append(calls, channel.EXPECT().Get("mail_requests.offsets", false).
+					Return(amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, Body: []byte(tt.stored)}, tt.stored != "", tt.getErr))
+			}
+
+			gomock.InOrder(append(calls, channel.EXPECT().Close())...)
+
+			tracker, err := newOffsetTracker("first")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s := &Server{cfg: config.RmqConfig{Queue: "mail_requests"}, offsets: tracker}
+
+			locked, err := s.acquireStreamLock(conn)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("acquireStreamLock() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if locked != tt.want {
+				t.Errorf("acquireStreamLock() = %v, want %v", locked, tt.want)
+			}
+
+			if tracker.committed != tt.wantCommitted {
+				t.Errorf("expected the committed offset %d, got %d", tt.wantCommitted, tracker.committed)
+			}
+
+			// the stored offset is retained for the next replicas
+			if tt.stored != "" && !reflect.DeepEqual(ack.requeued, []uint64{1}) {
+				t.Errorf("expected the stored offset to be requeued, got %v", ack.requeued)
+			}
+		})
+	}
+}
+
+func TestStoreStreamOffset(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	channel := newTestConfirmChannel(mocks.NewMockAmqpChannel(ctrl))
+	publisher := &confirmingPublisher{channel: channel}
+
+	tracker, err := newOffsetTracker("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		Publisher:  publisher,
+		cfg:        config.RmqConfig{Queue: "mail_requests"},
+		offsets:    tracker,
+		publishers: newPublishPool([]*confirmChannel{channel}, nil),
+	}
+
+	// nothing processed yet
+	s.storeStreamOffset()
+
+	for offset := int64(0); offset < 3; offset++ {
+		tracker.delivered(offset)
+		tracker.processed(offset, false)
+	}
+
+	s.storeStreamOffset()
+
+	// the offset is not stored again until another one is committed
+	s.storeStreamOffset()
+
+	if len(publisher.published) != 1 {
+		t.Fatalf("expected a single publishing, got %v", publisher.published)
+	}
+
+	published := publisher.published[0]
+
+	if published.key != "mail_requests.offsets" || string(published.publishing.Body) != "2" {
+		t.Fatalf("expected the offset 2 to be stored on mail_requests.offsets, got %q on %s", published.publishing.Body, published.key)
+	}
+
+	if published.publishing.DeliveryMode != amqp.Persistent {
+		t.Error("expected the stored offset to be persistent")
+	}
+}
+
+func TestStreamReplicaStandsByUntilTheLockIsReleased(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	connector := mocks.NewMockConnector(ctrl)
+	conn := newMockConnection(ctrl)
+	conn.lockHeld = true
+
+	connector.EXPECT().Connect("amqp://localhost").Return(conn.conn, nil)
+
+	tracker, err := newOffsetTracker("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer(connector)
+	s.cfg.QueueType = StreamQueue
+	s.offsets = tracker
+
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	standby, tag := s.standby, s.consumerTag
+	s.mu.Unlock()
+
+	if !standby || tag != "" {
+		t.Fatalf("expected the replica to stand by without consuming the stream, standby: %v, consumer: %q", standby, tag)
+	}
+
+	// a standby replica is still connected, so it can publish
+	if !s.Connected() {
+		t.Fatal("expected the standby replica to be connected")
+	}
+
+	conn.mu.Lock()
+	conn.lockHeld = false
+	conn.mu.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		s.mu.Lock()
+		standby, tag = s.standby, s.consumerTag
+		s.mu.Unlock()
+
+		if !standby && tag != "" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("expected the replica to consume the stream once the lock is released")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
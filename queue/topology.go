@@ -0,0 +1,84 @@
+package queue
+
+import (
+	"fmt"
+	"mailer-ms/config"
+	"mailer-ms/queue/interfaces"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// declareTopology declares the exchanges, queues and bindings of the topology config, redeclaring
+// them on every connection is a no op as long as their options and args are not changed
+func (s *Server) declareTopology(channel interfaces.AmqpChannel) error {
+	topology := s.cfg.Topology
+
+	for _, e := range topology.Exchanges {
+		kind := e.Type
+		if kind == "" {
+			kind = amqp.ExchangeDirect
+		}
+
+		if err := channel.ExchangeDeclare(e.Name, kind, e.Durable, e.AutoDelete, e.Internal, false, toTable(e.Args)); err != nil {
+			return fmt.Errorf("failed to declare exchange %s: %w", e.Name, err)
+		}
+	}
+
+	for _, q := range topology.Queues {
+		if _, err := channel.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, toTable(q.Args)); err != nil {
+			return fmt.Errorf("failed to declare queue %s: %w", q.Name, err)
+		}
+	}
+
+	for _, b := range topology.Bindings {
+		if err := channel.QueueBind(b.Queue, b.RoutingKey, b.Exchange, false, toTable(b.Args)); err != nil {
+			return fmt.Errorf("failed to bind queue %s to exchange %s: %w", b.Queue, b.Exchange, err)
+		}
+	}
+
+	return nil
+}
+
+// declaredByTopology checks if the queue is declared by the topology config
+func declaredByTopology(topology config.TopologyConfig, queue string) bool {
+	for _, q := range topology.Queues {
+		if q.Name == queue {
+			return true
+		}
+	}
+
+	return false
+}
+
+// toTable converts the args parsed from the yaml config to a amqp table, nested
+// maps are converted to tables as well
+func toTable(args map[string]interface{}) amqp.Table {
+	if len(args) == 0 {
+		return nil
+	}
+
+	table := amqp.Table{}
+
+	for k, v := range args {
+		table[k] = toField(v)
+	}
+
+	return table
+}
+
+func toField(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		return toTable(value)
+	case []interface{}:
+		fields := make([]interface{}, len(value))
+
+		for i := range value {
+			fields[i] = toField(value[i])
+		}
+
+		return fields
+	default:
+		return v
+	}
+}
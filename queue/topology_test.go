@@ -0,0 +1,230 @@
+package queue
+
+import (
+	"errors"
+	"mailer-ms/config"
+	"mailer-ms/mocks"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var testTopology = config.TopologyConfig{
+	Exchanges: []config.ExchangeConfig{
+		{Name: "mail", Type: amqp.ExchangeTopic, Durable: true},
+		{Name: "mail.dlx", Durable: true, Args: map[string]interface{}{"alternate-exchange": "mail.unrouted"}},
+	},
+	Queues: []config.QueueConfig{
+		{Name: "mail_requests", Durable: true, Args: map[string]interface{}{"x-queue-type": "quorum", "x-dead-letter-exchange": "mail.dlx"}},
+		{Name: "mail_requests.dead", Durable: true},
+	},
+	Bindings: []config.BindingConfig{
+		{Exchange: "mail", Queue: "mail_requests", RoutingKey: "mail.requests.#"},
+		{Exchange: "mail.dlx", Queue: "mail_requests.dead", Args: map[string]interface{}{"x-match": "any"}},
+	},
+}
+
+func TestDeclareTopology(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	channel := mocks.NewMockAmqpChannel(ctrl)
+
+	gomock.InOrder(
+		channel.EXPECT().ExchangeDeclare("mail", amqp.ExchangeTopic, true, false, false, false, nil),
+		channel.EXPECT().ExchangeDeclare("mail.dlx", amqp.ExchangeDirect, true, false, false, false, amqp.Table{"alternate-exchange": "mail.unrouted"}),
+		channel.EXPECT().QueueDeclare("mail_requests", true, false, false, false, amqp.Table{"x-queue-type": "quorum", "x-dead-letter-exchange": "mail.dlx"}),
+		channel.EXPECT().QueueDeclare("mail_requests.dead", true, false, false, false, nil),
+		channel.EXPECT().QueueBind("mail_requests", "mail.requests.#", "mail", false, nil),
+		channel.EXPECT().QueueBind("mail_requests.dead", "", "mail.dlx", false, amqp.Table{"x-match": "any"}),
+	)
+
+	s := &Server{cfg: config.RmqConfig{Topology: testTopology}}
+
+	if err := s.declareTopology(channel); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeclareTopologyFailure(t *testing.T) {
+	failure := errors.New("PRECONDITION_FAILED")
+
+	tests := []struct {
+		name    string
+		expect  func(channel *mocks.MockAmqpChannel)
+		wantErr string
+	}{
+		{
+			name: "exchange",
+			expect: func(channel *mocks.MockAmqpChannel) {
+				channel.EXPECT().ExchangeDeclare("mail", gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(failure)
+			},
+			wantErr: "failed to declare exchange mail",
+		},
+		{
+			name: "queue",
+			expect: func(channel *mocks.MockAmqpChannel) {
+				channel.EXPECT().ExchangeDeclare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(2)
+				channel.EXPECT().QueueDeclare("mail_requests", gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(amqp.Queue{}, failure)
+			},
+			wantErr: "failed to declare queue mail_requests",
+		},
+		{
+			name: "binding",
+			expect: func(channel *mocks.MockAmqpChannel) {
+				channel.EXPECT().ExchangeDeclare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(2)
+				channel.EXPECT().QueueDeclare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(2)
+				channel.EXPECT().QueueBind("mail_requests", gomock.Any(), "mail", gomock.Any(), gomock.Any()).Return(failure)
+			},
+			wantErr: "failed to bind queue mail_requests to exchange mail",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			channel := mocks.NewMockAmqpChannel(ctrl)
+
+			tt.expect(channel)
+
+			s := &Server{cfg: config.RmqConfig{Topology: testTopology}}
+
+			err := s.declareTopology(channel)
+
+			if !errors.Is(err, failure) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q wrapping %v, got %v", tt.wantErr, failure, err)
+			}
+		})
+	}
+}
+
+func TestDeclareSkipsTopologyQueues(t *testing.T) {
+	tests := []struct {
+		name     string
+		topology config.TopologyConfig
+		want     map[string]amqp.Table
+	}{
+		{
+			name: "service queues are declared",
+			want: map[string]amqp.Table{
+				"mail_requests":             {"x-queue-type": QuorumQueue},
+				"mail_requests_parked":      nil,
+				"mail_requests_delayed.30s": {"x-message-ttl": 30000, "x-dead-letter-exchange": "", "x-dead-letter-routing-key": "mail_requests"},
+			},
+		},
+		{
+			name:     "queues of the topology are declared with its options only",
+			topology: config.TopologyConfig{Queues: []config.QueueConfig{{Name: "mail_requests", Durable: true}, {Name: "mail_requests_parked", Durable: true}}},
+			want: map[string]amqp.Table{
+				"mail_requests":             nil,
+				"mail_requests_parked":      nil,
+				"mail_requests_delayed.30s": {"x-message-ttl": 30000, "x-dead-letter-exchange": "", "x-dead-letter-routing-key": "mail_requests"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			channel := mocks.NewMockAmqpChannel(ctrl)
+
+			declared := map[string]amqp.Table{}
+
+			channel.EXPECT().QueueDeclare(gomock.Any(), true, false, false, false, gomock.Any()).
+				DoAndReturn(func(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+					if _, ok := declared[name]; ok {
+						t.Errorf("queue %s declared twice", name)
+					}
+
+					declared[name] = args
+					return amqp.Queue{Name: name}, nil
+				}).
+				AnyTimes()
+
+			s := &Server{cfg: config.RmqConfig{
+				Queue:           "mail_requests",
+				QueueType:       QuorumQueue,
+				DelayQueue:      "mail_requests_delayed",
+				DelayTiers:      []int{30},
+				PoisonThreshold: 5,
+				ParkingQueue:    "mail_requests_parked",
+				Topology:        tt.topology,
+			}}
+
+			if err := s.declare(channel); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(declared, tt.want) {
+				t.Errorf("expected the declared queues %v, got %v", tt.want, declared)
+			}
+		})
+	}
+}
+
+func TestDeclaredByTopology(t *testing.T) {
+	tests := []struct {
+		name  string
+		queue string
+		want  bool
+	}{
+		{name: "listed queue", queue: "mail_requests", want: true},
+		{name: "unlisted queue", queue: "mail_sender_admin"},
+		{name: "bound but not listed queue", queue: "mail_requests.retry"},
+	}
+
+	topology := testTopology
+	topology.Bindings = append(topology.Bindings, config.BindingConfig{Exchange: "mail", Queue: "mail_requests.retry"})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := declaredByTopology(topology, tt.queue); got != tt.want {
+				t.Errorf("declaredByTopology(%q) = %v, want %v", tt.queue, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToTable(t *testing.T) {
+	tests := []struct {
+		name string
+		args map[string]interface{}
+		want amqp.Table
+	}{
+		{name: "no args", args: nil, want: nil},
+		{name: "empty args", args: map[string]interface{}{}, want: nil},
+		{
+			name: "scalar args",
+			args: map[string]interface{}{"x-message-ttl": 60000, "x-queue-type": "quorum", "x-single-active-consumer": true},
+			want: amqp.Table{"x-message-ttl": 60000, "x-queue-type": "quorum", "x-single-active-consumer": true},
+		},
+		{
+			name: "nested maps and lists",
+			args: map[string]interface{}{
+				"policy": map[string]interface{}{"limits": map[string]interface{}{"max": 10}},
+				"hosts":  []interface{}{"a", map[string]interface{}{"b": 1}},
+			},
+			want: amqp.Table{
+				"policy": amqp.Table{"limits": amqp.Table{"max": 10}},
+				"hosts":  []interface{}{"a", amqp.Table{"b": 1}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := toTable(tt.args)
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("toTable() = %#v, want %#v", got, tt.want)
+			}
+
+			if got != nil {
+				if err := got.Validate(); err != nil {
+					t.Fatalf("expected a valid amqp table, got %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package status
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var statusBucket = []byte("mail_status")
+
+// BoltStore is a Store persisted on a local bolt database file
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(statusBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db}, nil
+}
+
+func (s *BoltStore) Get(uuid string) (*Record, error) {
+	var record *Record
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(statusBucket).Get([]byte(uuid))
+		if data == nil {
+			return ErrNotFound
+		}
+
+		record = &Record{}
+		return json.Unmarshal(data, record)
+	})
+
+	return record, err
+}
+
+func (s *BoltStore) Update(uuid string, fn func(r *Record) error) (*Record, error) {
+	record := &Record{Uuid: uuid}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(statusBucket)
+
+		if data := bucket.Get([]byte(uuid)); data != nil {
+			if err := json.Unmarshal(data, record); err != nil {
+				return err
+			}
+		}
+
+		if err := fn(record); err != nil {
+			return err
+		}
+
+		record.UpdatedAt = time.Now()
+
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(uuid), data)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func (s *BoltStore) Purge(before time.Time) (int, error) {
+	removed := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(statusBucket)
+
+		// deleting while iterating a bolt cursor skips keys, so they are collected first
+		var expired [][]byte
+
+		err := bucket.ForEach(func(key, data []byte) error {
+			var record Record
+
+			// unreadable records are purged as well, they can never be used
+			if err := json.Unmarshal(data, &record); err != nil || record.UpdatedAt.Before(before) {
+				expired = append(expired, append([]byte(nil), key...))
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		removed = len(expired)
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return removed, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
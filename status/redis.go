@@ -0,0 +1,126 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Prefix of the redis keys of the status records
+const redisKeyPrefix = "mail_sender:status:"
+
+// Attempts to update a record modified concurrently by another replica before giving up
+const redisUpdateAttempts = 10
+
+// RedisStore is a Store persisted on a redis server, shared by every replica so any of
+// them can answer the status queries and cancel the requests consumed by the others
+type RedisStore struct {
+	client redis.UniversalClient
+
+	// records expire once not updated for this long, they are kept forever if zero
+	retention time.Duration
+}
+
+// NewRedisStore connects to the redis server at the url, eg: redis://:password@localhost:6379/0
+func NewRedisStore(url string, retention time.Duration) (*RedisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	client := redis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &RedisStore{client, retention}, nil
+}
+
+func (s *RedisStore) Get(uuid string) (*Record, error) {
+	data, err := s.client.Get(context.Background(), redisKeyPrefix+uuid).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	record := &Record{}
+
+	return record, json.Unmarshal(data, record)
+}
+
+// Update applies fn within a optimistic transaction, retried if the record is changed
+// by another replica before the update is committed
+func (s *RedisStore) Update(uuid string, fn func(r *Record) error) (*Record, error) {
+	ctx := context.Background()
+	key := redisKeyPrefix + uuid
+
+	var record *Record
+
+	txFn := func(tx *redis.Tx) error {
+		record = &Record{Uuid: uuid}
+
+		data, err := tx.Get(ctx, key).Bytes()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+
+		if err == nil {
+			if err := json.Unmarshal(data, record); err != nil {
+				return err
+			}
+		}
+
+		if err := fn(record); err != nil {
+			return err
+		}
+
+		record.UpdatedAt = time.Now()
+
+		if data, err = json.Marshal(record); err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, s.retention)
+			return nil
+		})
+
+		return err
+	}
+
+	for i := 0; i < redisUpdateAttempts; i++ {
+		err := s.client.Watch(ctx, txFn, key)
+
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return record, nil
+	}
+
+	return nil, redis.TxFailedErr
+}
+
+// Purge does nothing, the records expire on their own once not updated for longer than the retention
+func (s *RedisStore) Purge(before time.Time) (int, error) {
+	return 0, nil
+}
+
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,215 @@
+package status
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+type MailStatus string
+
+const (
+	// The mail request was consumed and is being processed
+	Queued MailStatus = "queued"
+
+	// The mail request is over its tenant or recipient domain limit and was delayed
+	Scheduled MailStatus = "scheduled"
+
+	// A send attempt failed and the request is waiting for the next attempt
+	Retrying MailStatus = "retrying"
+
+	// The email was accepted by the mail provider, see the record Provider and ProviderId
+	Sent MailStatus = "sent"
+
+	// The email could not be sent, see the record Reason
+	Failed MailStatus = "failed"
+
+	// The mail request was canceled by a admin request before it could be sent
+	Canceled MailStatus = "canceled"
+)
+
+var (
+	ErrNotFound       = errors.New("mail status not found")
+	ErrNotCancellable = errors.New("mail request can no longer be canceled")
+	ErrCanceled       = errors.New("mail request was canceled")
+	ErrProcessed      = errors.New("mail request was already processed")
+)
+
+type Record struct {
+	Uuid   string     `json:"uuid"`
+	Status MailStatus `json:"status"`
+
+	// The name of the mail provider that sent the email, set when the status is `sent`
+	Provider string `json:"provider,omitempty"`
+
+	// The id the mail provider assigned to the email, set when the status is `sent`
+	ProviderId string `json:"provider_id,omitempty"`
+
+	// The failure or cancelation description, set when the status is `failed` or `canceled`
+	Reason string `json:"reason,omitempty"`
+
+	// The last send attempt number
+	Attempt int `json:"attempt"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Cancellable returns if the mail request is still waiting to be sent
+// and therefore can be canceled
+func (r *Record) Cancellable() bool {
+	return r.Status == Retrying || r.Status == Scheduled
+}
+
+// Final returns if the mail request was sent, failed or canceled, after which its status no longer changes
+func (r *Record) Final() bool {
+	return r.Status == Sent || r.Status == Failed || r.Status == Canceled
+}
+
+type Store interface {
+	// Get returns the status record of a mail request or ErrNotFound
+	Get(uuid string) (*Record, error)
+
+	// Update atomically applies fn to the record of a mail request, fn receives
+	// a empty record with the given uuid if there is no stored record yet, if
+	// fn returns a error the record is not updated and the error is returned
+	Update(uuid string, fn func(r *Record) error) (*Record, error)
+
+	// Purge removes the records not updated since the given time, returning how many were removed
+	Purge(before time.Time) (int, error)
+
+	Close() error
+}
+
+// NewStore creates the store of the configured backend, a local bolt file that can only be used by a
+// single replica or a redis server shared by every replica, records expire after the retention
+func NewStore(backend, path, redisUrl string, retention time.Duration) (Store, error) {
+	switch backend {
+	case "bolt":
+		return NewBoltStore(path)
+	case "redis":
+		return NewRedisStore(redisUrl, retention)
+	}
+
+	return nil, fmt.Errorf("invalid status store: %q, expected bolt or redis", backend)
+}
+
+// StartPurging removes the records older than the retention every hour until the stop
+// channel is closed, records are kept forever if the retention is zero
+func StartPurging(store Store, retention time.Duration, stop <-chan struct{}) {
+	if retention <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Hour)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			if removed, err := store.Purge(time.Now().Add(-retention)); err != nil {
+				log.Printf("[STATUS] failed to purge expired mail statuses: %v", err)
+			} else if removed > 0 {
+				log.Printf("[STATUS] purged %d expired mail statuses", removed)
+			}
+
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Queue stores the queued status of a consumed mail request, unless the request was canceled or
+// already processed (sent or failed), in which case the stored record and ErrCanceled or
+// ErrProcessed are returned, so redelivered or duplicated requests are not sent again
+func Queue(store Store, uuid string) (*Record, error) {
+	var final *Record
+
+	record, err := store.Update(uuid, func(r *Record) error {
+		if r.Final() {
+			stored := *r
+			final = &stored
+
+			if r.Status == Canceled {
+				return ErrCanceled
+			}
+
+			return ErrProcessed
+		}
+
+		r.Status = Queued
+		r.Attempt = 0
+		r.Reason = ""
+		r.ProviderId = ""
+		r.Provider = ""
+
+		return nil
+	})
+
+	if err != nil {
+		return final, err
+	}
+
+	return record, nil
+}
+
+// Set stores the new status of a mail request, unless the request was canceled
+// in which case ErrCanceled is returned
+func Set(store Store, uuid string, status MailStatus, attempt int, reason, providerId string) error {
+	_, err := store.Update(uuid, func(r *Record) error {
+		if r.Status == Canceled {
+			return ErrCanceled
+		}
+
+		r.Status = status
+		r.Attempt = attempt
+		r.Reason = reason
+		r.ProviderId = providerId
+		r.Provider = ""
+
+		return nil
+	})
+
+	return err
+}
+
+// SetSent stores the sent status of a mail request with the provider that sent it, unless the
+// request was canceled in which case ErrCanceled is returned
+func SetSent(store Store, uuid string, attempt int, provider, providerId string) error {
+	_, err := store.Update(uuid, func(r *Record) error {
+		if r.Status == Canceled {
+			return ErrCanceled
+		}
+
+		r.Status = Sent
+		r.Attempt = attempt
+		r.Reason = ""
+		r.Provider = provider
+		r.ProviderId = providerId
+
+		return nil
+	})
+
+	return err
+}
+
+// Cancel marks a mail request as canceled if it has not been sent or failed yet
+func Cancel(store Store, uuid string) (*Record, error) {
+	return store.Update(uuid, func(r *Record) error {
+		if r.Status == "" {
+			return ErrNotFound
+		}
+
+		if !r.Cancellable() {
+			return ErrNotCancellable
+		}
+
+		r.Status = Canceled
+		r.Reason = "canceled by admin request"
+
+		return nil
+	})
+}
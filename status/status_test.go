@@ -0,0 +1,214 @@
+package status
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newStores returns a bolt and a redis store, so every test runs against both implementations
+func newStores(t *testing.T) map[string]Store {
+	t.Helper()
+
+	bolt, err := NewBoltStore(filepath.Join(t.TempDir(), "status.db"))
+	if err != nil {
+		t.Fatalf("failed to open bolt store: %v", err)
+	}
+
+	server := miniredis.RunT(t)
+
+	redis, err := NewRedisStore("redis://"+server.Addr(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to open redis store: %v", err)
+	}
+
+	t.Cleanup(func() {
+		bolt.Close()
+		redis.Close()
+	})
+
+	return map[string]Store{"bolt": bolt, "redis": redis}
+}
+
+func TestQueue(t *testing.T) {
+	tests := []struct {
+		name       string
+		stored     MailStatus
+		wantErr    error
+		wantStatus MailStatus
+	}{
+		{name: "new request", wantStatus: Queued},
+		{name: "scheduled request", stored: Scheduled, wantStatus: Queued},
+		{name: "retrying request", stored: Retrying, wantStatus: Queued},
+		{name: "sent request is not overwritten", stored: Sent, wantErr: ErrProcessed, wantStatus: Sent},
+		{name: "failed request is not overwritten", stored: Failed, wantErr: ErrProcessed, wantStatus: Failed},
+		{name: "canceled request is not overwritten", stored: Canceled, wantErr: ErrCanceled, wantStatus: Canceled},
+	}
+
+	for storeName, store := range newStores(t) {
+		for _, tt := range tests {
+			t.Run(storeName+"/"+tt.name, func(t *testing.T) {
+				uuid := storeName + tt.name
+
+				if tt.stored != "" {
+					store.Update(uuid, func(r *Record) error {
+						r.Status = tt.stored
+						r.ProviderId = "provider-id"
+						return nil
+					})
+				}
+
+				record, err := Queue(store, uuid)
+
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+
+				if record == nil || record.Status != tt.wantStatus {
+					t.Fatalf("expected returned status %s, got %+v", tt.wantStatus, record)
+				}
+
+				stored, _ := store.Get(uuid)
+
+				if stored.Status != tt.wantStatus {
+					t.Fatalf("expected stored status %s, got %s", tt.wantStatus, stored.Status)
+				}
+
+				if tt.wantErr != nil && stored.ProviderId != "provider-id" {
+					t.Fatalf("expected the final record to be kept, got %+v", stored)
+				}
+			})
+		}
+	}
+}
+
+func TestSetAndSetSentOnCanceledRequest(t *testing.T) {
+	for storeName, store := range newStores(t) {
+		t.Run(storeName, func(t *testing.T) {
+			store.Update("uuid", func(r *Record) error {
+				r.Status = Canceled
+				return nil
+			})
+
+			if err := Set(store, "uuid", Retrying, 1, "", ""); !errors.Is(err, ErrCanceled) {
+				t.Fatalf("expected Set to return ErrCanceled, got %v", err)
+			}
+
+			if err := SetSent(store, "uuid", 1, "ses", "id"); !errors.Is(err, ErrCanceled) {
+				t.Fatalf("expected SetSent to return ErrCanceled, got %v", err)
+			}
+
+			if record, _ := store.Get("uuid"); record.Status != Canceled {
+				t.Fatalf("expected the request to stay canceled, got %s", record.Status)
+			}
+		})
+	}
+}
+
+func TestCancel(t *testing.T) {
+	tests := []struct {
+		name    string
+		stored  MailStatus
+		wantErr error
+	}{
+		{name: "unknown request", wantErr: ErrNotFound},
+		{name: "queued request", stored: Queued, wantErr: ErrNotCancellable},
+		{name: "sent request", stored: Sent, wantErr: ErrNotCancellable},
+		{name: "retrying request", stored: Retrying},
+		{name: "scheduled request", stored: Scheduled},
+	}
+
+	for storeName, store := range newStores(t) {
+		for _, tt := range tests {
+			t.Run(storeName+"/"+tt.name, func(t *testing.T) {
+				uuid := storeName + tt.name
+
+				if tt.stored != "" {
+					store.Update(uuid, func(r *Record) error {
+						r.Status = tt.stored
+						return nil
+					})
+				}
+
+				record, err := Cancel(store, uuid)
+
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+
+				if tt.wantErr == nil && record.Status != Canceled {
+					t.Fatalf("expected the request to be canceled, got %s", record.Status)
+				}
+			})
+		}
+	}
+}
+
+func TestBoltStorePurge(t *testing.T) {
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "status.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for _, uuid := range []string{"a", "b", "c"} {
+		Set(store, uuid, Queued, 0, "", "")
+	}
+
+	removed, err := store.Purge(time.Now().Add(time.Minute))
+	if err != nil || removed != 3 {
+		t.Fatalf("expected 3 records purged, got %d: %v", removed, err)
+	}
+
+	Set(store, "d", Queued, 0, "", "")
+
+	removed, err = store.Purge(time.Now().Add(-time.Minute))
+	if err != nil || removed != 0 {
+		t.Fatalf("expected recent records to be kept, got %d purged: %v", removed, err)
+	}
+
+	if _, err := store.Get("a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected purged record to be gone, got %v", err)
+	}
+}
+
+func TestRedisStoreExpiresRecords(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	store, err := NewRedisStore("redis://"+server.Addr(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	Set(store, "uuid", Queued, 0, "", "")
+
+	server.FastForward(2 * time.Hour)
+
+	if _, err := store.Get("uuid"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected the record to expire, got %v", err)
+	}
+}
+
+func TestRedisStoreSharedBetweenReplicas(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	replicaA, _ := NewRedisStore("redis://"+server.Addr(), 0)
+	replicaB, _ := NewRedisStore("redis://"+server.Addr(), 0)
+
+	defer replicaA.Close()
+	defer replicaB.Close()
+
+	Set(replicaA, "uuid", Retrying, 1, "throttled", "")
+
+	if _, err := Cancel(replicaB, "uuid"); err != nil {
+		t.Fatalf("expected a replica to cancel the request of another, got %v", err)
+	}
+
+	if err := Set(replicaA, "uuid", Queued, 2, "", ""); !errors.Is(err, ErrCanceled) {
+		t.Fatalf("expected the owner replica to see the cancelation, got %v", err)
+	}
+}
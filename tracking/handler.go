@@ -0,0 +1,116 @@
+package tracking
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"mailer-ms/tracer"
+	"net/http"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// a transparent 1x1 gif
+var pixelGif = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+type Event struct {
+	Uuid string `json:"uuid"`
+
+	// open or click
+	Type string `json:"type"`
+
+	// The index of the clicked link on the email and its url, only set on clicks
+	LinkIndex *int   `json:"link_index,omitempty"`
+	Url       string `json:"url,omitempty"`
+
+	UserAgent string    `json:"user_agent"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ServeHTTP handles the tracking pixel and link requests, publishing their events to the tracking events
+// exchange once responded, click requests are redirected to the original link url
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, span := tracer.NewSpan(r.Context(), "tracking", "ServeHTTP")
+	defer span.End()
+
+	if !t.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, PathPrefix)
+
+	var token, eventType string
+
+	switch {
+	case strings.HasPrefix(path, clickPath):
+		token, eventType = strings.TrimPrefix(path, clickPath), "click"
+	case strings.HasPrefix(path, openPath):
+		token, eventType = strings.TrimPrefix(path, openPath), "open"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	p, err := verify(t.secret, token)
+	if err != nil || (eventType == "click" && p.Link == openLinkIndex) {
+		tracer.AddSpanErrorAndFail(span, ErrInvalidToken, "invalid tracking token")
+		http.NotFound(w, r)
+		return
+	}
+
+	span.SetAttributes(attribute.Key("uuid").String(p.Uuid))
+	span.SetAttributes(attribute.Key("type").String(eventType))
+
+	event := Event{Uuid: p.Uuid, Type: eventType, UserAgent: r.UserAgent(), Timestamp: time.Now()}
+
+	if eventType == "click" {
+		event.LinkIndex = &p.Link
+		event.Url = p.Url
+	}
+
+	// the response does not depend on the event, which is published without waiting for its confirmation
+	// and even if the request context is canceled, as email clients often abort pixel requests
+	go t.publishEvent(trace.ContextWithSpan(context.Background(), span), event)
+
+	if eventType == "click" {
+		http.Redirect(w, r, p.Url, http.StatusFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Write(pixelGif)
+}
+
+func (t *Tracker) publishEvent(ctx context.Context, event Event) {
+	ctx, span := tracer.NewSpan(ctx, "tracking", "PublishEvent")
+	defer span.End()
+
+	body, _ := json.Marshal(event)
+
+	err := t.queue.Publish(ctx, t.cfg.EventsExchange, t.cfg.EventsRoutingKey, amqp.Publishing{
+		Body:        body,
+		Type:        event.Type,
+		ContentType: "application/json",
+		Timestamp:   event.Timestamp,
+	})
+
+	if err != nil {
+		log.Printf("[TRACKING] failed to publish %s event of %s: %v", event.Type, event.Uuid, err)
+		tracer.AddSpanErrorAndFail(span, err, "failed to publish tracking event")
+	}
+}
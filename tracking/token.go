@@ -0,0 +1,73 @@
+package tracking
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var ErrInvalidToken = errors.New("invalid tracking token")
+
+// openLinkIndex is the link index of the tokens used by the tracking pixel
+const openLinkIndex = -1
+
+type payload struct {
+	Uuid string `json:"u"`
+
+	// The index of the link on the email, or openLinkIndex for the tracking pixel
+	Link int `json:"i"`
+
+	// The original url of the link
+	Url string `json:"l,omitempty"`
+}
+
+// sign encodes the payload as a token in the format: base64(payload).base64(hmac(payload))
+func sign(secret []byte, p payload) string {
+	data, _ := json.Marshal(p)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+
+	return base64.RawURLEncoding.EncodeToString(data) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify decodes a token created by sign, returning ErrInvalidToken if its signature does not match,
+// tokens are never valid without a secret since anyone could sign them
+func verify(secret []byte, token string) (*payload, error) {
+	if len(secret) == 0 {
+		return nil, ErrInvalidToken
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalidToken
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrInvalidToken
+	}
+
+	p := &payload{}
+
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	return p, nil
+}
@@ -0,0 +1,137 @@
+package tracking
+
+import (
+	"errors"
+	"fmt"
+	"mailer-ms/config"
+	"mailer-ms/queue"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	// PathPrefix is the path the tracking handler should be registered on
+	PathPrefix = "/t/"
+
+	clickPath = "c/"
+	openPath  = "o/"
+)
+
+// Tracker rewrites the links of emails to the tracking redirect url and
+// publishes the open and click events when they are requested
+type Tracker struct {
+	cfg    config.TrackingConfig
+	secret []byte
+	queue  *queue.Server
+}
+
+func New(cfg config.TrackingConfig, queue *queue.Server) (*Tracker, error) {
+	if cfg.BaseUrl != "" && cfg.Secret == "" {
+		return nil, errors.New("a tracking secret is required when tracking is enabled")
+	}
+
+	cfg.BaseUrl = strings.TrimSuffix(cfg.BaseUrl, "/")
+
+	return &Tracker{cfg: cfg, secret: []byte(cfg.Secret), queue: queue}, nil
+}
+
+// Enabled returns if the tracking base url is configured
+func (t *Tracker) Enabled() bool {
+	return t.cfg.BaseUrl != ""
+}
+
+// EventsQueue returns the queue the events are published to when tracking is enabled and they are published
+// to the default exchange, so it can be declared, empty if the events are routed by a exchange of the user
+func (t *Tracker) EventsQueue() string {
+	if !t.Enabled() || t.cfg.EventsExchange != "" {
+		return ""
+	}
+
+	return t.cfg.EventsRoutingKey
+}
+
+// Rewrite replaces the http links of the html document with signed tracking links
+// if clicks is true and appends a 1x1 tracking pixel to its body if opens is true
+func (t *Tracker) Rewrite(doc, uuid string, opens, clicks bool) (string, error) {
+	if !t.Enabled() {
+		return "", errors.New("tracking is not enabled")
+	}
+
+	root, err := html.Parse(strings.NewReader(doc))
+	if err != nil {
+		return "", err
+	}
+
+	if clicks {
+		links := 0
+		t.rewriteLinks(root, uuid, &links)
+	}
+
+	if opens {
+		if body := findBody(root); body != nil {
+			body.AppendChild(t.pixel(uuid))
+		}
+	}
+
+	var rendered strings.Builder
+
+	if err := html.Render(&rendered, root); err != nil {
+		return "", err
+	}
+
+	return rendered.String(), nil
+}
+
+func (t *Tracker) rewriteLinks(n *html.Node, uuid string, links *int) {
+	if n.Type == html.ElementNode && n.DataAtom == atom.A {
+		for i, a := range n.Attr {
+			href := strings.TrimSpace(a.Val)
+
+			if a.Key != "href" || !(strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://")) {
+				continue
+			}
+
+			n.Attr[i].Val = t.url(clickPath, payload{Uuid: uuid, Link: *links, Url: href})
+			*links++
+		}
+	}
+
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		t.rewriteLinks(child, uuid, links)
+	}
+}
+
+func (t *Tracker) pixel(uuid string) *html.Node {
+	return &html.Node{
+		Type:     html.ElementNode,
+		Data:     "img",
+		DataAtom: atom.Img,
+		Attr: []html.Attribute{
+			{Key: "src", Val: t.url(openPath, payload{Uuid: uuid, Link: openLinkIndex})},
+			{Key: "width", Val: "1"},
+			{Key: "height", Val: "1"},
+			{Key: "alt", Val: ""},
+			{Key: "style", Val: "border:0;width:1px;height:1px;"},
+		},
+	}
+}
+
+func (t *Tracker) url(path string, p payload) string {
+	return fmt.Sprintf("%s%s%s%s", t.cfg.BaseUrl, PathPrefix, path, sign(t.secret, p))
+}
+
+func findBody(n *html.Node) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == atom.Body {
+		return n
+	}
+
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if body := findBody(child); body != nil {
+			return body
+		}
+	}
+
+	return nil
+}
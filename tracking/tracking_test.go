@@ -0,0 +1,160 @@
+package tracking
+
+import (
+	"errors"
+	"mailer-ms/config"
+	"mailer-ms/queue"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var testSecret = []byte("secret")
+
+func TestVerify(t *testing.T) {
+	token := sign(testSecret, payload{Uuid: "uuid", Link: 2, Url: "https://rastercar.com"})
+	data, signature, _ := strings.Cut(token, ".")
+
+	forged := sign([]byte("other"), payload{Uuid: "uuid", Link: 0, Url: "https://evil.com"})
+	forgedData, _, _ := strings.Cut(forged, ".")
+
+	tests := []struct {
+		name    string
+		secret  []byte
+		token   string
+		want    *payload
+		wantErr bool
+	}{
+		{name: "valid token", secret: testSecret, token: token, want: &payload{Uuid: "uuid", Link: 2, Url: "https://rastercar.com"}},
+		{name: "signed with another secret", secret: testSecret, token: forged, wantErr: true},
+		{name: "tampered payload", secret: testSecret, token: forgedData + "." + signature, wantErr: true},
+		{name: "empty secret", secret: nil, token: sign(nil, payload{Uuid: "uuid", Url: "https://evil.com"}), wantErr: true},
+		{name: "missing signature", secret: testSecret, token: data, wantErr: true},
+		{name: "invalid encoding", secret: testSecret, token: "!!!.???", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verify(tt.secret, tt.token)
+
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Fatalf("expected ErrInvalidToken, got %v", err)
+				}
+				return
+			}
+
+			if err != nil || *got != *tt.want {
+				t.Fatalf("expected %+v, got %+v: %v", tt.want, got, err)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(config.TrackingConfig{BaseUrl: "https://t.rastercar.com"}, &queue.Server{}); err == nil {
+		t.Fatal("expected tracking without a secret to be refused")
+	}
+
+	tracker, err := New(config.TrackingConfig{}, &queue.Server{})
+	if err != nil || tracker.Enabled() {
+		t.Fatalf("expected tracking to be disabled without a base url, got %v", err)
+	}
+}
+
+func TestEventsQueue(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.TrackingConfig
+		want string
+	}{
+		{name: "disabled", cfg: config.TrackingConfig{EventsRoutingKey: "mail_tracking_events"}},
+		{name: "default exchange", cfg: config.TrackingConfig{BaseUrl: "https://t.rastercar.com", Secret: "secret", EventsRoutingKey: "mail_tracking_events"}, want: "mail_tracking_events"},
+		{name: "user exchange", cfg: config.TrackingConfig{BaseUrl: "https://t.rastercar.com", Secret: "secret", EventsExchange: "events", EventsRoutingKey: "mail.tracking"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker, _ := New(tt.cfg, &queue.Server{})
+
+			if got := tracker.EventsQueue(); got != tt.want {
+				t.Fatalf("expected the events queue %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	tracker, _ := New(config.TrackingConfig{BaseUrl: "https://t.rastercar.com/", Secret: "secret"}, &queue.Server{})
+
+	got, err := tracker.Rewrite(`<p><a href="https://rastercar.com/a">a</a><a href="mailto:bruce@wayne.com">b</a><a href="http://rastercar.com/c">c</a></p>`, "uuid", true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	urls := regexp.MustCompile(`https://t\.rastercar\.com/t/([co])/([\w-]+\.[\w-]+)`).FindAllStringSubmatch(got, -1)
+
+	if len(urls) != 3 {
+		t.Fatalf("expected 2 tracked links and a pixel, got %s", got)
+	}
+
+	want := []payload{
+		{Uuid: "uuid", Link: 0, Url: "https://rastercar.com/a"},
+		{Uuid: "uuid", Link: 1, Url: "http://rastercar.com/c"},
+		{Uuid: "uuid", Link: openLinkIndex},
+	}
+
+	for i, u := range urls {
+		p, err := verify(tracker.secret, u[2])
+		if err != nil || *p != want[i] {
+			t.Errorf("expected url %d to have payload %+v, got %+v: %v", i, want[i], p, err)
+		}
+	}
+
+	if !strings.Contains(got, `href="mailto:bruce@wayne.com"`) {
+		t.Errorf("expected non http links to be kept, got %s", got)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	enabled, _ := New(config.TrackingConfig{BaseUrl: "https://t.rastercar.com", Secret: "secret"}, &queue.Server{})
+	disabled, _ := New(config.TrackingConfig{}, &queue.Server{})
+
+	click := sign(testSecret, payload{Uuid: "uuid", Link: 0, Url: "https://rastercar.com"})
+	open := sign(testSecret, payload{Uuid: "uuid", Link: openLinkIndex})
+
+	tests := []struct {
+		name         string
+		tracker      *Tracker
+		method       string
+		path         string
+		wantStatus   int
+		wantLocation string
+	}{
+		{name: "click", tracker: enabled, method: http.MethodGet, path: "/t/c/" + click, wantStatus: http.StatusFound, wantLocation: "https://rastercar.com"},
+		{name: "open", tracker: enabled, method: http.MethodGet, path: "/t/o/" + open, wantStatus: http.StatusOK},
+		{name: "pixel token used as a click", tracker: enabled, method: http.MethodGet, path: "/t/c/" + open, wantStatus: http.StatusNotFound},
+		{name: "forged click", tracker: enabled, method: http.MethodGet, path: "/t/c/" + sign(nil, payload{Url: "https://evil.com"}), wantStatus: http.StatusNotFound},
+		{name: "unknown path", tracker: enabled, method: http.MethodGet, path: "/t/x/" + click, wantStatus: http.StatusNotFound},
+		{name: "post", tracker: enabled, method: http.MethodPost, path: "/t/c/" + click, wantStatus: http.StatusMethodNotAllowed},
+		{name: "disabled tracking", tracker: disabled, method: http.MethodGet, path: "/t/c/" + sign(nil, payload{Url: "https://evil.com"}), wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+
+			tt.tracker.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+
+			if location := rec.Header().Get("Location"); location != tt.wantLocation {
+				t.Fatalf("expected location %q, got %q", tt.wantLocation, location)
+			}
+		})
+	}
+}